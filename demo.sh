@@ -82,7 +82,7 @@ loading_animation 2 "🇺🇸 Exiting through USA node"
 loading_animation 2 "🌐 Making anonymous request"
 
 echo ""
-echo -e "${WHITE}$ ./onion-network -mode=client (automatic request)${NC}"
+echo -e "${WHITE}$ ./onion-network -mode=client -config=azure.conf (automatic request)${NC}"
 
 # Create a test file for onion network result
 cat > /tmp/onion_demo_input.txt << 'EOF'
@@ -94,7 +94,7 @@ EOF
 # Run onion network client
 echo ""
 echo -e "${GREEN}Running through onion network...${NC}"
-ONION_RESULT=$(timeout 30s ./onion-network -mode=client < /tmp/onion_demo_input.txt 2>/dev/null | tail -10)
+ONION_RESULT=$(timeout 30s ./onion-network -mode=client -config=azure.conf < /tmp/onion_demo_input.txt 2>/dev/null | tail -10)
 
 # Simulate onion result (your actual exit node IP)
 ONION_IP="172.191.84.146"
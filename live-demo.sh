@@ -27,15 +27,15 @@ echo -e "${BLUE}./onion-network-real-ip -mode=directory -port=9000${NC}"
 echo ""
 echo -e "${GREEN}Terminal 2 (Guard - Europe):${NC}"
 echo -e "${BLUE}ssh onion@172.201.12.43${NC}"
-echo -e "${BLUE}./onion-network-real-ip -mode=node -type=guard -port=8080${NC}"
+echo -e "${BLUE}./onion-network-real-ip -mode=node -type=guard -port=8080 -config=azure.conf${NC}"
 echo ""
 echo -e "${GREEN}Terminal 3 (Relay - Australia):${NC}"
 echo -e "${BLUE}ssh onion@68.218.3.154${NC}"
-echo -e "${BLUE}./onion-network-real-ip -mode=node -type=relay -port=8081${NC}"
+echo -e "${BLUE}./onion-network-real-ip -mode=node -type=relay -port=8081 -config=azure.conf${NC}"
 echo ""
 echo -e "${GREEN}Terminal 4 (Exit - USA):${NC}"
 echo -e "${BLUE}ssh onion@172.191.84.146${NC}"
-echo -e "${BLUE}./onion-network-real-ip -mode=node -type=exit -port=8082${NC}"
+echo -e "${BLUE}./onion-network-real-ip -mode=node -type=exit -port=8082 -config=azure.conf${NC}"
 echo ""
 echo -e "${YELLOW}Wait for all servers to show 'Registered with directory server: 200 OK'${NC}"
 echo ""
@@ -76,7 +76,7 @@ read
 echo -e "${GREEN}🔒 Creating encrypted circuit...${NC}"
 sleep 1
 
-echo -e "${WHITE}$ ./onion-network -mode=client${NC}"
+echo -e "${WHITE}$ ./onion-network -mode=client -config=azure.conf${NC}"
 echo ""
 
 # Create input for onion client
@@ -90,7 +90,7 @@ echo -e "${GREEN}📡 Sending encrypted request through global network...${NC}"
 echo ""
 
 # Run the actual onion network client
-timeout 30s ./onion-network -mode=client < /tmp/live_demo_input.txt
+timeout 30s ./onion-network -mode=client -config=azure.conf < /tmp/live_demo_input.txt
 
 echo ""
 echo -e "${GREEN}✅ Request completed! Check your server terminals to see:${NC}"
@@ -1,55 +1,274 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 	
+	"onion-network/pkg/bandwidth"
+	"onion-network/pkg/buildtime"
+	"onion-network/pkg/circuit"
 	"onion-network/pkg/client"
+	"onion-network/pkg/config"
+	"onion-network/pkg/crypto"
 	"onion-network/pkg/directory"
+	"onion-network/pkg/dos"
 	"onion-network/pkg/node"
+	"onion-network/pkg/padding"
+	"onion-network/pkg/policy"
+	"onion-network/pkg/pow"
+	"onion-network/pkg/scheduler"
+	"onion-network/pkg/service"
+	"onion-network/pkg/transport"
 )
 
 func main() {
-	var mode = flag.String("mode", "node", "Mode: node, client, or directory")
+	var mode = flag.String("mode", "node", "Mode: node, client, service, or directory")
 	var port = flag.Int("port", 8080, "Port to listen on")
-	var nodeType = flag.String("type", "relay", "Node type: guard, relay, or exit")
+	var nodeType = flag.String("type", "relay", "Node roles, comma-separated: guard, relay, exit, or bridge, e.g. guard,exit; every node can be a middle")
+	var configFile = flag.String("config", "", "Config file of \"Key value\" lines naming these flags, e.g. \"BandwidthRate 1 MB\"; the command line takes precedence")
+	var directoryURL = flag.String("directory", config.DefaultDirectoryURL, "Directory server URL")
+	var address = flag.String("address", "", "Node mode: address advertised to the directory (default the one it sees)")
+	var listenAddress = flag.String("listen", "", "Node mode: interface to accept links on (default all)")
+	var dataDir = flag.String("data-dir", "", "Node mode: directory keeping the node's identity key and state (default node-<port>)")
+	var exitPolicy = flag.String("exit-policy", "accept *:*", "Node mode: comma-separated exit policy rules, e.g. \"reject *:25, accept *:*\"")
+	var family = flag.String("family", "", "Node mode: comma-separated IDs of other nodes run by the same operator")
+	var socksAddr = flag.String("socks", "", "Client SOCKS5 listen address, e.g. 127.0.0.1:9050")
+	var httpProxyAddr = flag.String("http-proxy", "", "Client HTTP proxy listen address, e.g. 127.0.0.1:8118")
+	var target = flag.String("target", "127.0.0.1:8000", "Service mode: local address streams are forwarded to")
+	var serviceKey = flag.String("hs-key", "onion_service.key", "Service mode: private key file, created if missing")
+	var serviceAuthDir = flag.String("hs-auth-dir", "", "Service mode: directory of authorized client keys (*.pub); empty allows anyone")
+	var clientAuthKey = flag.String("hs-client-key", "", "Client mode: key proving authorization to onion services, created if missing")
+	var transportName = flag.String("transport", "plain", "Node mode: pluggable transport for accepted links: "+strings.Join(transport.Names(), ", "))
+	var paddingSpec = flag.String("padding", "", "Padding: link, circuit, a machine (burst, cover) or none, comma-separated (default link,circuit for nodes, link otherwise)")
+	var buildTimesFile = flag.String("build-times", "", "Client/service mode: file keeping circuit build times across restarts (default circuit_build_times.json, or service_build_times.json for services)")
+	var bandwidthRate = flag.String("bandwidth-rate", "", "Node mode: average link bandwidth allowed in each direction, e.g. 1 MB (per second); empty for unlimited")
+	var bandwidthBurst = flag.String("bandwidth-burst", "", "Node mode: largest burst above -bandwidth-rate, e.g. 2 MB (default the rate)")
+	var accountingMax = flag.String("accounting-max", "", "Node mode: traffic allowed per accounting period in each direction, e.g. 100 GB; the node hibernates once it is used")
+	var accountingPeriod = flag.String("accounting-period", "month", "Node mode: accounting period: day, week or month")
+	var schedulerName = flag.String("scheduler", "ewma", "Node mode: order of the circuits sharing a link: "+strings.Join(scheduler.Names(), ", "))
+	var kist = flag.Bool("kist", true, "Node mode: write links only as fast as the kernel can send (KIST), so the scheduler's order holds")
+	defaultDoS := dos.DefaultConfig()
+	var connLimit = flag.Int("dos-conn-limit", defaultDoS.MaxConnectionsPerIP, "Node mode: concurrent links allowed from one client address, 0 for no limit")
+	var circuitRate = flag.Float64("dos-circuit-rate", defaultDoS.CircuitRate, "Node mode: circuits per second one client address may create, 0 for no limit")
+	var circuitBurst = flag.Int("dos-circuit-burst", defaultDoS.CircuitBurst, "Node mode: circuits one client address may create at once")
+	var powThreshold = flag.Int("dos-pow-threshold", defaultDoS.PowThreshold, "Node mode: create onions awaiting decryption at which clients must solve a puzzle; 0 always, -1 never")
+	var powBits = flag.Int("dos-pow-bits", defaultDoS.PowBits, "Node mode: puzzle difficulty in leading zero bits")
+	var maxQueued = flag.String("max-queued-memory", bandwidth.FormatBytes(defaultDoS.MaxQueuedBytes), "Node mode: cell memory queued on all links before the largest queues' circuits are destroyed")
+	var onionKeyLifetime = positiveDuration(node.DefaultOnionKeyLifetime)
+	flag.Var(&onionKeyLifetime, "onion-key-lifetime", "Node mode: how long each onion key is used before the node rotates to a new one")
+	var shutdownDrain = flag.Duration("shutdown-drain", node.DefaultShutdownDrain, "Node mode: how long circuits may finish after SIGINT or SIGTERM before they are destroyed")
+	var linkDelay = flag.Duration("link-delay", 0, "Simulated delay added to every link message this process sends, for testing congestion control")
+	var isolate = flag.String("isolate", "auth,listener", "Client mode: stream properties that keep circuits apart: auth, host, port, listener or none, comma-separated")
+	var bridges bridgeLines
+	flag.Var(&bridges, "bridge", "Client/service mode: bridge line to use as first hop (repeatable)")
 	flag.Parse()
+	
+	if *configFile != "" {
+		settings, err := config.Load(*configFile)
+		if err != nil {
+			log.Fatal("Failed to read config file:", err)
+		}
+		if err := config.Apply(settings, flag.CommandLine); err != nil {
+			log.Fatalf("Invalid config file %s: %v", *configFile, err)
+		}
+	}
+
+	if *paddingSpec == "" {
+		*paddingSpec = "link"
+		if *mode == "node" {
+			*paddingSpec = "link,circuit"
+		}
+	}
+	paddingConfig, err := padding.ParseConfig(*paddingSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	
+	if *buildTimesFile == "" {
+		*buildTimesFile = "circuit_build_times.json"
+		if *mode == "service" {
+			*buildTimesFile = "service_build_times.json"
+		}
+	}
 
 	switch *mode {
 	case "node":
-		var nodeTypeEnum node.NodeType
-		switch *nodeType {
-		case "guard":
-			nodeTypeEnum = node.Guard
-		case "relay":
-			nodeTypeEnum = node.Relay
-		case "exit":
-			nodeTypeEnum = node.Exit
-		default:
-			fmt.Println("Invalid node type. Use: guard, relay, or exit")
+		roles, err := node.ParseRoles(*nodeType)
+		if err != nil {
+			fmt.Println(err)
 			os.Exit(1)
 		}
 		
-		n, err := node.NewNode(nodeTypeEnum, "localhost", *port)
+		n, err := node.NewNode(roles, *address, *port)
 		if err != nil {
 			log.Fatal("Failed to create node:", err)
 		}
+		n.ListenAddress = *listenAddress
+		n.DirectoryURL = *directoryURL
+		n.Padding = paddingConfig
+		n.LinkDelay = *linkDelay
+		if _, err := scheduler.New(*schedulerName); err != nil {
+			log.Fatal(err)
+		}
+		n.Scheduler = *schedulerName
+		n.KIST = *kist
+		n.ShutdownDrain = *shutdownDrain
+		n.OnionKeyLifetime = time.Duration(onionKeyLifetime)
+		n.DoS.MaxConnectionsPerIP = *connLimit
+		n.DoS.CircuitRate = *circuitRate
+		n.DoS.CircuitBurst = *circuitBurst
+		n.DoS.PowThreshold = *powThreshold
+		if *powBits < 0 || *powBits > pow.MaxBits {
+			log.Fatalf("Puzzle difficulty must be between 0 and %d bits", pow.MaxBits)
+		}
+		n.DoS.PowBits = *powBits
+		if n.DoS.MaxQueuedBytes, err = bandwidth.ParseBytes(*maxQueued); err != nil {
+			log.Fatal("Invalid queued memory limit:", err)
+		}
+		if *bandwidthRate != "" {
+			rate, err := bandwidth.ParseBytes(*bandwidthRate)
+			if err != nil {
+				log.Fatal("Invalid bandwidth rate:", err)
+			}
+			burst := rate
+			if *bandwidthBurst != "" {
+				if burst, err = bandwidth.ParseBytes(*bandwidthBurst); err != nil {
+					log.Fatal("Invalid bandwidth burst:", err)
+				}
+			}
+			n.Bandwidth = bandwidth.NewLimit(rate, burst)
+		}
+		if *accountingMax != "" {
+			max, err := bandwidth.ParseBytes(*accountingMax)
+			if err != nil {
+				log.Fatal("Invalid accounting limit:", err)
+			}
+			period, err := bandwidth.ParsePeriod(*accountingPeriod)
+			if err != nil {
+				log.Fatal(err)
+			}
+			n.Accounting = bandwidth.NewAccounting(max, period)
+		}
+		if n.ExitPolicy, err = policy.Parse(*exitPolicy); err != nil {
+			log.Fatal(err)
+		}
+		for _, id := range strings.Split(*family, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				n.Family = append(n.Family, id)
+			}
+		}
+		if *dataDir == "" {
+			*dataDir = fmt.Sprintf("node-%d", *port)
+		}
+		if err := n.LoadDataDirectory(*dataDir); err != nil {
+			log.Fatal(err)
+		}
+		if n.Transport, err = transport.New(*transportName); err != nil {
+			log.Fatal("Failed to set up transport:", err)
+		}
+		if n.Transport.Name() != "plain" && !roles.Has(node.Bridge) {
+			// Other nodes extend circuits to listed nodes without transport arguments
+			log.Fatal("Only bridges can use a pluggable transport")
+		}
 		
-		fmt.Printf("Starting %s node %s on port %d\n", *nodeType, n.ID, *port)
+		fmt.Printf("Starting %s node %s on port %d\n", strings.ToLower(roles.String()), n.ID, *port)
 		fmt.Printf("Node IP: %s\n", n.GetVirtualIP())
-		if err := n.Start(); err != nil {
+		
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			// A second signal exits at once instead of waiting for circuits
+			<-ctx.Done()
+			stop()
+		}()
+		watchHibernation(n)
+		if err := n.Run(ctx); err != nil {
 			log.Fatal("Failed to start node:", err)
 		}
 		
 	case "client":
-		onionClient := client.NewOnionClient("http://172.191.95.78:9000")
+		onionClient := client.NewOnionClient(*directoryURL)
+		onionClient.CircuitManager.Padding = paddingConfig
+		onionClient.CircuitManager.LinkDelay = *linkDelay
+		if onionClient.CircuitManager.BuildTimes, err = buildtime.Load(*buildTimesFile); err != nil {
+			log.Fatal("Failed to load circuit build times:", err)
+		}
+		if *clientAuthKey != "" {
+			key, err := crypto.LoadOrCreatePrivateKey(*clientAuthKey)
+			if err != nil {
+				log.Fatal("Failed to load client authorization key:", err)
+			}
+			if err := crypto.SavePublicKey(*clientAuthKey+".pub", &key.PublicKey); err != nil {
+				log.Fatal("Failed to save client authorization key:", err)
+			}
+			onionClient.CircuitManager.ClientAuthKey = key
+			fmt.Printf("Client authorization key: %s.pub\n", *clientAuthKey)
+		}
+		for _, line := range bridges {
+			if err := onionClient.CircuitManager.AddBridge(line); err != nil {
+				log.Fatal("Invalid bridge line:", err)
+			}
+		}
+		if onionClient.CircuitManager.Isolation, err = circuit.ParseIsolation(*isolate); err != nil {
+			log.Fatal(err)
+		}
+		go onionClient.CircuitManager.RunPool(context.Background())
+		if *socksAddr != "" || *httpProxyAddr != "" {
+			fmt.Println("Starting onion client proxy")
+			errs := make(chan error, 2)
+			if *socksAddr != "" {
+				go func() {
+					errs <- fmt.Errorf("SOCKS proxy failed: %v", onionClient.ServeSOCKS(*socksAddr))
+				}()
+			}
+			if *httpProxyAddr != "" {
+				go func() {
+					errs <- fmt.Errorf("HTTP proxy failed: %v", onionClient.ServeHTTPProxy(*httpProxyAddr))
+				}()
+			}
+			log.Fatal(<-errs)
+		}
+		
 		fmt.Println("Starting onion client")
 		if err := onionClient.Start(); err != nil {
 			log.Fatal("Failed to start client:", err)
 		}
 		
+	case "service":
+		key, err := crypto.LoadOrCreatePrivateKey(*serviceKey)
+		if err != nil {
+			log.Fatal("Failed to load service key:", err)
+		}
+		
+		svc := service.NewOnionService(*directoryURL, key, *target)
+		svc.CircuitManager.Padding = paddingConfig
+		svc.CircuitManager.LinkDelay = *linkDelay
+		if svc.CircuitManager.BuildTimes, err = buildtime.Load(*buildTimesFile); err != nil {
+			log.Fatal("Failed to load circuit build times:", err)
+		}
+		for _, line := range bridges {
+			if err := svc.CircuitManager.AddBridge(line); err != nil {
+				log.Fatal("Invalid bridge line:", err)
+			}
+		}
+		if *serviceAuthDir != "" {
+			if svc.AuthorizedClients, err = service.LoadAuthorizedClients(*serviceAuthDir); err != nil {
+				log.Fatal("Failed to load authorized clients:", err)
+			}
+			fmt.Printf("Authorized clients: %d\n", len(svc.AuthorizedClients))
+		}
+		fmt.Printf("Starting onion service %s\n", svc.Address)
+		if err := svc.Start(); err != nil {
+			log.Fatal("Failed to start service:", err)
+		}
+		
 	case "directory":
 		ds := directory.NewDirectoryServer(*port)
 		fmt.Printf("Starting directory server on port %d\n", *port)
@@ -58,7 +277,38 @@ func main() {
 		}
 		
 	default:
-		fmt.Println("Invalid mode. Use: node, client, or directory")
+		fmt.Println("Invalid mode. Use: node, client, service, or directory")
 		os.Exit(1)
 	}
-}
\ No newline at end of file
+}
+
+// bridgeLines collects repeated -bridge flags
+type bridgeLines []string
+
+func (b *bridgeLines) String() string {
+	return strings.Join(*b, "; ")
+}
+
+func (b *bridgeLines) Set(line string) error {
+	*b = append(*b, line)
+	return nil
+}
+
+// positiveDuration is a duration flag that refuses zero and negative values
+type positiveDuration time.Duration
+
+func (d *positiveDuration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *positiveDuration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v <= 0 {
+		return fmt.Errorf("must be positive, not %v", v)
+	}
+	*d = positiveDuration(v)
+	return nil
+}
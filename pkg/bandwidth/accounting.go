@@ -0,0 +1,161 @@
+package bandwidth
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Period is the length of an accounting period. Periods start at the
+// beginning of a UTC calendar day, week (Monday) or month.
+type Period int
+
+const (
+	Day Period = iota
+	Week
+	Month
+)
+
+var periodNames = []string{"day", "week", "month"}
+
+// ParsePeriod reads "day", "week" or "month"
+func ParsePeriod(s string) (Period, error) {
+	for i, name := range periodNames {
+		if strings.EqualFold(strings.TrimSpace(s), name) {
+			return Period(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown accounting period %q (use day, week or month)", s)
+}
+
+func (p Period) String() string {
+	if int(p) < len(periodNames) {
+		return periodNames[p]
+	}
+	return "unknown"
+}
+
+// Start returns the beginning of the period containing t
+func (p Period) Start(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch p {
+	case Week:
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case Month:
+		return day.AddDate(0, 0, 1-day.Day())
+	default:
+		return day
+	}
+}
+
+// End returns the beginning of the period after the one starting at start
+func (p Period) End(start time.Time) time.Time {
+	switch p {
+	case Week:
+		return start.AddDate(0, 0, 7)
+	case Month:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// Accounting counts the bytes a node reads and writes in each period. As
+// with Tor's default AccountingRule, the allowance is spent once either
+// direction reaches Max, and a new period starts it afresh.
+type Accounting struct {
+	Max    int64
+	Period Period
+
+	mutex   sync.Mutex
+	start   time.Time
+	read    int64
+	written int64
+}
+
+// NewAccounting starts counting in the current period
+func NewAccounting(max int64, period Period) *Accounting {
+	return &Accounting{Max: max, Period: period, start: period.Start(time.Now())}
+}
+
+// Add counts traffic against the current period
+func (a *Accounting) Add(read, written int64) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	a.read += read
+	a.written += written
+	a.mutex.Unlock()
+}
+
+// Exhausted reports whether the period's allowance is used up
+func (a *Accounting) Exhausted() bool {
+	if a == nil {
+		return false
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.read >= a.Max || a.written >= a.Max
+}
+
+// Rollover starts a new period once now is past the current one,
+// reporting whether it did
+func (a *Accounting) Rollover(now time.Time) bool {
+	if a == nil {
+		return false
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if now.Before(a.Period.End(a.start)) {
+		return false
+	}
+	a.start = a.Period.Start(now)
+	a.read, a.written = 0, 0
+	return true
+}
+
+// AccountingState is the usage a node saves to keep counting across a
+// restart
+type AccountingState struct {
+	Start   time.Time `json:"start"`
+	Read    int64     `json:"read"`
+	Written int64     `json:"written"`
+}
+
+// State returns the current period's usage for saving
+func (a *Accounting) State() AccountingState {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return AccountingState{Start: a.start, Read: a.read, Written: a.written}
+}
+
+// Restore resumes counting from a saved state, unless it belongs to an
+// earlier period
+func (a *Accounting) Restore(state AccountingState) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if state.Start.Equal(a.start) {
+		a.read, a.written = state.Read, state.Written
+	}
+}
+
+// Usage returns the bytes read and written this period, and when it ends
+func (a *Accounting) Usage() (read, written int64, end time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.read, a.written, a.Period.End(a.start)
+}
+
+func (a *Accounting) String() string {
+	if a == nil {
+		return "unlimited"
+	}
+	read, written, end := a.Usage()
+	return fmt.Sprintf("%s read, %s written of %s per %s, resets in %v",
+		FormatBytes(read), FormatBytes(written), FormatBytes(a.Max), a.Period,
+		time.Until(end).Round(time.Minute))
+}
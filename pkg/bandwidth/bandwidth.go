@@ -0,0 +1,176 @@
+package bandwidth
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket: it refills at Rate bytes per second up to
+// Burst bytes, and traffic waits until enough tokens have accumulated.
+// A nil Bucket never limits.
+type Bucket struct {
+	Rate  int64
+	Burst int64
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket. A burst below rate is raised to rate,
+// as a smaller burst could never pass a second's worth of traffic.
+func NewBucket(rate, burst int64) *Bucket {
+	if burst < rate {
+		burst = rate
+	}
+	return &Bucket{Rate: rate, Burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+// Take removes n tokens, sleeping until the bucket has refilled enough.
+// Tokens are taken up front, so a large n waits its full share without
+// holding up the callers after it.
+func (b *Bucket) Take(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.Rate)
+	if b.tokens > float64(b.Burst) {
+		b.tokens = float64(b.Burst)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.mutex.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / float64(b.Rate) * float64(time.Second)))
+	}
+}
+
+func (b *Bucket) String() string {
+	if b == nil {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%s/s, burst %s", FormatBytes(b.Rate), FormatBytes(b.Burst))
+}
+
+// Limit holds the token buckets for traffic read and written, as Tor's
+// BandwidthRate and BandwidthBurst apply to each direction separately
+type Limit struct {
+	Read  *Bucket
+	Write *Bucket
+}
+
+// NewLimit limits each direction to rate bytes per second with the given
+// burst. A zero rate means unlimited and returns nil.
+func NewLimit(rate, burst int64) *Limit {
+	if rate <= 0 {
+		return nil
+	}
+	return &Limit{Read: NewBucket(rate, burst), Write: NewBucket(rate, burst)}
+}
+
+func (l *Limit) String() string {
+	if l == nil {
+		return "unlimited"
+	}
+	return l.Read.String()
+}
+
+// Conn wraps conn so its traffic waits for limit's buckets and counts
+// against accounting. Either may be nil.
+func Conn(conn net.Conn, limit *Limit, accounting *Accounting) net.Conn {
+	if limit == nil && accounting == nil {
+		return conn
+	}
+	c := &meteredConn{Conn: conn, accounting: accounting}
+	if limit != nil {
+		c.read, c.write = limit.Read, limit.Write
+	}
+	return c
+}
+
+type meteredConn struct {
+	net.Conn
+	read       *Bucket
+	write      *Bucket
+	accounting *Accounting
+}
+
+// Read charges for what it read afterwards, since the size is not known
+// up front; the wait then holds back the next read
+func (c *meteredConn) Read(b []byte) (int, error) {
+	if c.read != nil && int64(len(b)) > c.read.Burst {
+		b = b[:c.read.Burst]
+	}
+	n, err := c.Conn.Read(b)
+	c.read.Take(n)
+	c.accounting.Add(int64(n), 0)
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if c.write != nil && int64(len(chunk)) > c.write.Burst {
+			chunk = chunk[:c.write.Burst]
+		}
+		c.write.Take(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		c.accounting.Add(0, int64(n))
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// ParseBytes reads a size such as "100 GB", "1.5MB" or "4096". Units are
+// powers of 1024, as in Tor's configuration.
+func ParseBytes(input string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(input))
+	size := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			size = unit.size
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q (e.g. 500 KB, 1.5 MB, 100 GB)", input)
+	}
+	return int64(value * float64(size)), nil
+}
+
+// FormatBytes writes a size in the largest unit that keeps it at least one
+func FormatBytes(n int64) string {
+	for _, unit := range byteUnits {
+		if n >= unit.size && unit.size > 1 {
+			return fmt.Sprintf("%.1f %s", float64(n)/float64(unit.size), unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%d B", n)
+}
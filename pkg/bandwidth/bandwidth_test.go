@@ -0,0 +1,125 @@
+package bandwidth
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int64
+		fails bool
+	}{
+		{"4096", 4096, false},
+		{"500 KB", 500 << 10, false},
+		{"1.5MB", 3 << 19, false},
+		{" 100 gb ", 100 << 30, false},
+		{"2 TB", 2 << 40, false},
+		{"12 B", 12, false},
+		{"0", 0, false},
+		{"", 0, true},
+		{"GB", 0, true},
+		{"-1 MB", 0, true},
+		{"ten MB", 0, true},
+		{"5 PB", 0, true},
+	}
+	for _, test := range tests {
+		got, err := ParseBytes(test.input)
+		if test.fails {
+			if err == nil {
+				t.Errorf("ParseBytes(%q) = %d, want an error", test.input, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("ParseBytes(%q) = %d, %v, want %d", test.input, got, err, test.want)
+		}
+	}
+}
+
+func TestConnCountsAgainstAccounting(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	accounting := NewAccounting(1000, Day)
+	conn := Conn(local, nil, accounting)
+	go func() {
+		buf := make([]byte, 600)
+		io.ReadFull(remote, buf)
+		remote.Write(buf[:400])
+		io.Copy(io.Discard, remote)
+	}()
+
+	if _, err := conn.Write(make([]byte, 600)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 400)); err != nil {
+		t.Fatal(err)
+	}
+	if read, written, _ := accounting.Usage(); read != 400 || written != 600 {
+		t.Errorf("counted %d read, %d written, want 400 and 600", read, written)
+	}
+	if accounting.Exhausted() {
+		t.Error("allowance used up below Max")
+	}
+
+	conn.Write(make([]byte, 400))
+	if !accounting.Exhausted() {
+		t.Error("allowance not used up once writes reached Max")
+	}
+}
+
+func TestAccountingRestart(t *testing.T) {
+	before := NewAccounting(1<<20, Week)
+	before.Add(300, 500)
+	saved := before.State()
+
+	after := NewAccounting(1<<20, Week)
+	after.Restore(saved)
+	if read, written, _ := after.Usage(); read != 300 || written != 500 {
+		t.Errorf("restored %d read, %d written, want 300 and 500", read, written)
+	}
+
+	// Usage saved in an earlier week does not count against this one
+	saved.Start = saved.Start.AddDate(0, 0, -7)
+	stale := NewAccounting(1<<20, Week)
+	stale.Restore(saved)
+	if read, written, _ := stale.Usage(); read != 0 || written != 0 {
+		t.Errorf("restored %d read, %d written from last week", read, written)
+	}
+}
+
+func TestPeriodStart(t *testing.T) {
+	// A Wednesday afternoon at the end of January
+	now := time.Date(2024, time.January, 31, 15, 0, 0, 0, time.UTC)
+	for _, want := range []struct {
+		period Period
+		start  time.Time
+		end    time.Time
+	}{
+		{Day, time.Date(2024, time.January, 31, 0, 0, 0, 0, time.UTC), time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{Week, time.Date(2024, time.January, 29, 0, 0, 0, 0, time.UTC), time.Date(2024, time.February, 5, 0, 0, 0, 0, time.UTC)},
+		{Month, time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		start := want.period.Start(now)
+		if !start.Equal(want.start) || !want.period.End(start).Equal(want.end) {
+			t.Errorf("%s runs %v to %v, want %v to %v", want.period, start, want.period.End(start), want.start, want.end)
+		}
+		if parsed, err := ParsePeriod(" " + want.period.String() + " "); err != nil || parsed != want.period {
+			t.Errorf("ParsePeriod(%q) = %v, %v", want.period, parsed, err)
+		}
+	}
+
+	a := &Accounting{Max: 100, Period: Day, start: Day.Start(now)}
+	a.Add(100, 0)
+	if a.Rollover(now.Add(8 * time.Hour)) {
+		t.Error("rolled over within the day")
+	}
+	if !a.Rollover(now.Add(9*time.Hour)) || a.Exhausted() {
+		t.Error("allowance not renewed the next day")
+	}
+}
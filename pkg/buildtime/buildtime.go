@@ -0,0 +1,253 @@
+package buildtime
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// InitialTimeout is used until enough builds have been observed
+	InitialTimeout = 10 * time.Second
+	MinTimeout     = 1 * time.Second
+	MaxTimeout     = 60 * time.Second
+
+	// MaxObservations is how many recent builds the fit is based on
+	MaxObservations = 1000
+	// MinObservations is how many completed builds are needed for a fit
+	MinObservations = 25
+
+	// Quantile is the share of builds expected to finish within the timeout
+	Quantile = 0.8
+
+	binWidth = 10 // Milliseconds per histogram bin when finding the mode
+	numModes = 10 // Most common bins averaged into the Pareto scale
+
+	// If nearly all recent builds time out, the network has changed (or
+	// the client moved) and the history no longer describes it
+	recentBuilds       = 20
+	recentTimeoutLimit = 18
+)
+
+// Observation is one circuit build. Abandoned builds record the timeout
+// they ran into, a lower bound on how long they would have taken.
+type Observation struct {
+	Millis    int64 `json:"ms"`
+	Abandoned bool  `json:"abandoned,omitempty"`
+}
+
+type state struct {
+	Builds []Observation `json:"builds"`
+}
+
+// Estimator learns a circuit build timeout from observed build times, as
+// Tor does: it fits a Pareto distribution to the history and times builds
+// out at the Quantile point of the fit.
+type Estimator struct {
+	path    string
+	builds  []Observation
+	recent  []bool // Whether each of the latest builds timed out
+	initial time.Duration
+	timeout time.Duration
+	mutex   sync.Mutex
+}
+
+func New() *Estimator {
+	return &Estimator{initial: InitialTimeout, timeout: InitialTimeout}
+}
+
+// Load reads the build history kept at path, starting an empty one if the
+// file does not exist yet. Save writes the history back to the same path.
+func Load(path string) (*Estimator, error) {
+	e := New()
+	e.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved state
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("invalid build time history %s: %w", path, err)
+	}
+	e.builds = saved.Builds
+	if len(e.builds) > MaxObservations {
+		e.builds = e.builds[len(e.builds)-MaxObservations:]
+	}
+	e.fit()
+	return e, nil
+}
+
+// Save writes the history to the path it was loaded from, if any
+func (e *Estimator) Save() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(&state{Builds: e.builds})
+	if err != nil {
+		return err
+	}
+
+	tmp := e.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.path)
+}
+
+// Timeout is how long a circuit build may take before it is abandoned
+func (e *Estimator) Timeout() time.Duration {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.timeout
+}
+
+// Completed records a build that finished in d
+func (e *Estimator) Completed(d time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.add(Observation{Millis: d.Milliseconds()}, false)
+}
+
+// Abandoned records a build given up on after timeout
+func (e *Estimator) Abandoned(timeout time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.add(Observation{Millis: timeout.Milliseconds(), Abandoned: true}, true)
+	if e.recentTimeouts() >= recentTimeoutLimit {
+		// Start over from a generous timeout rather than abandoning every
+		// circuit on a network that has become slower
+		e.initial = e.timeout * 2
+		if e.initial < InitialTimeout {
+			e.initial = InitialTimeout
+		}
+		if e.initial > MaxTimeout {
+			e.initial = MaxTimeout
+		}
+		e.builds, e.recent = nil, nil
+		e.fit()
+	}
+}
+
+func (e *Estimator) add(obs Observation, timedOut bool) {
+	e.builds = append(e.builds, obs)
+	if len(e.builds) > MaxObservations {
+		e.builds = e.builds[len(e.builds)-MaxObservations:]
+	}
+	e.recent = append(e.recent, timedOut)
+	if len(e.recent) > recentBuilds {
+		e.recent = e.recent[len(e.recent)-recentBuilds:]
+	}
+	e.fit()
+}
+
+func (e *Estimator) recentTimeouts() int {
+	count := 0
+	for _, timedOut := range e.recent {
+		if timedOut {
+			count++
+		}
+	}
+	return count
+}
+
+// fit sets the timeout from the history. The Pareto scale is the weighted
+// mode of the build times; the shape is its maximum likelihood estimate,
+// with abandoned builds counted as censored at their timeout.
+func (e *Estimator) fit() {
+	completed := 0
+	for _, obs := range e.builds {
+		if !obs.Abandoned {
+			completed++
+		}
+	}
+	if completed < MinObservations {
+		e.timeout = e.initial
+		return
+	}
+
+	xm := e.mode()
+	var sum float64
+	for _, obs := range e.builds {
+		if x := float64(obs.Millis); x > xm {
+			sum += math.Log(x / xm)
+		}
+	}
+
+	timeout := xm
+	if sum > 0 {
+		alpha := float64(completed) / sum
+		timeout = xm / math.Pow(1-Quantile, 1/alpha)
+	}
+
+	e.timeout = time.Duration(timeout * float64(time.Millisecond))
+	if e.timeout < MinTimeout {
+		e.timeout = MinTimeout
+	}
+	if e.timeout > MaxTimeout {
+		e.timeout = MaxTimeout
+	}
+}
+
+// mode averages the midpoints of the most common histogram bins of the
+// completed builds, weighted by how many builds fell in each
+func (e *Estimator) mode() float64 {
+	counts := make(map[int64]int)
+	for _, obs := range e.builds {
+		if !obs.Abandoned {
+			counts[obs.Millis/binWidth]++
+		}
+	}
+
+	bins := make([]int64, 0, len(counts))
+	for bin := range counts {
+		bins = append(bins, bin)
+	}
+	sort.Slice(bins, func(i, j int) bool {
+		if counts[bins[i]] != counts[bins[j]] {
+			return counts[bins[i]] > counts[bins[j]]
+		}
+		return bins[i] < bins[j]
+	})
+	if len(bins) > numModes {
+		bins = bins[:numModes]
+	}
+
+	var total, weight float64
+	for _, bin := range bins {
+		midpoint := float64(bin*binWidth) + binWidth/2.0
+		total += midpoint * float64(counts[bin])
+		weight += float64(counts[bin])
+	}
+	return total / weight
+}
+
+func (e *Estimator) String() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	abandoned := 0
+	for _, obs := range e.builds {
+		if obs.Abandoned {
+			abandoned++
+		}
+	}
+	if len(e.builds)-abandoned < MinObservations {
+		return fmt.Sprintf("%v (initial, %d of %d builds observed)", e.timeout, len(e.builds)-abandoned, MinObservations)
+	}
+	return fmt.Sprintf("%v (fitted to %d builds, %d abandoned)", e.timeout.Round(time.Millisecond), len(e.builds), abandoned)
+}
@@ -0,0 +1,92 @@
+package buildtime
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// paretoBuilds returns n evenly spread quantiles of a Pareto distribution
+// with scale xm milliseconds and shape alpha
+func paretoBuilds(n int, xm, alpha float64) []Observation {
+	builds := make([]Observation, n)
+	for i := range builds {
+		u := (float64(i) + 0.5) / float64(n)
+		builds[i].Millis = int64(xm / math.Pow(1-u, 1/alpha))
+	}
+	return builds
+}
+
+func constantBuilds(n int, millis int64, abandoned bool) []Observation {
+	builds := make([]Observation, n)
+	for i := range builds {
+		builds[i] = Observation{Millis: millis, Abandoned: abandoned}
+	}
+	return builds
+}
+
+func TestFit(t *testing.T) {
+	// The Quantile point of Pareto(1000ms, 2)
+	pareto := time.Duration(1000/math.Sqrt(1-Quantile)) * time.Millisecond
+
+	tests := []struct {
+		name   string
+		builds []Observation
+		want   time.Duration
+		within time.Duration
+	}{
+		{"no history", nil, InitialTimeout, 0},
+		{"too few builds", constantBuilds(MinObservations-1, 3000, false), InitialTimeout, 0},
+		{"abandoned builds do not count", append(constantBuilds(MinObservations-1, 3000, false), constantBuilds(10, 10000, true)...), InitialTimeout, 0},
+		{"constant build time", constantBuilds(MinObservations, 3000, false), 3005 * time.Millisecond, 0},
+		{"fast network", constantBuilds(MinObservations, 200, false), MinTimeout, 0},
+		{"slow network", constantBuilds(MinObservations, 90000, false), MaxTimeout, 0},
+		{"pareto", paretoBuilds(MaxObservations, 1000, 2), pareto, pareto / 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := New()
+			e.builds = test.builds
+			e.fit()
+			if diff := e.timeout - test.want; diff > test.within || diff < -test.within {
+				t.Errorf("timeout = %v, want %v within %v", e.timeout, test.want, test.within)
+			}
+		})
+	}
+}
+
+func TestFitCountsAbandonedBuilds(t *testing.T) {
+	builds := paretoBuilds(500, 1000, 2)
+
+	e := New()
+	e.builds = builds
+	e.fit()
+	completed := e.timeout
+
+	// Builds that ran into a timeout took at least that long, which makes
+	// the tail heavier
+	e.builds = append(builds, constantBuilds(100, completed.Milliseconds(), true)...)
+	e.fit()
+	if e.timeout <= completed {
+		t.Errorf("timeout with abandoned builds = %v, not above %v", e.timeout, completed)
+	}
+}
+
+func TestAbandonedResetsHistory(t *testing.T) {
+	e := New()
+	for i := 0; i < MinObservations; i++ {
+		e.Completed(8 * time.Second)
+	}
+	fitted := e.Timeout()
+
+	for i := 0; i < recentTimeoutLimit; i++ {
+		e.Abandoned(fitted)
+	}
+	if len(e.builds) != 0 {
+		t.Errorf("%d builds kept after the network changed", len(e.builds))
+	}
+	// Twice the last timeout, which the abandoned builds only raised
+	if timeout := e.Timeout(); timeout < 2*fitted || timeout > MaxTimeout {
+		t.Errorf("timeout after reset = %v, want at least %v", timeout, 2*fitted)
+	}
+}
@@ -1,21 +1,62 @@
 package circuit
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+
+	"onion-network/pkg/buildtime"
+	"onion-network/pkg/config"
+	"onion-network/pkg/congestion"
+	"onion-network/pkg/crypto"
+	"onion-network/pkg/message"
+	"onion-network/pkg/padding"
+	"onion-network/pkg/pow"
+	"onion-network/pkg/transport"
 )
 
+// DialTimeout bounds fetching nodes from the directory. Building the
+// circuit itself is bounded by the learned BuildTimes timeout.
+const DialTimeout = 10 * time.Second
+
+var errCircuitClosed = errors.New("circuit closed")
+
+// DestroyedError reports a circuit one of its hops tore down
+type DestroyedError struct {
+	Reason byte
+}
+
+func (e *DestroyedError) Error() string {
+	return "circuit destroyed: " + message.DestroyReasonString(e.Reason)
+}
+
 type NodeInfo struct {
 	ID        string           `json:"id"`
-	Type      string           `json:"type"`
+	Flags     []string         `json:"flags,omitempty"` // Positions the directory lists the node for
 	Address   string           `json:"address"`
 	Port      int              `json:"port"`
-	PublicKey *rsa.PublicKey   `json:"public_key"`
+	PublicKey *rsa.PublicKey   `json:"public_key"` // Current onion key
+	IdentityKey *rsa.PublicKey `json:"identity_key"`
+	Family    []string         `json:"family,omitempty"` // Nodes the directory confirmed share an operator
+	
+	// Pluggable transport for reaching a bridge, empty for plain
+	Transport     string            `json:"transport,omitempty"`
+	TransportArgs map[string]string `json:"transport_args,omitempty"`
+}
+
+// Addr is the host:port used to reach the node
+func (n NodeInfo) Addr() string {
+	return net.JoinHostPort(n.Address, strconv.Itoa(n.Port))
 }
 
 type Circuit struct {
@@ -23,72 +64,759 @@ type Circuit struct {
 	Nodes []NodeInfo
 	Path  []string
 	mutex sync.RWMutex
+
+	conn       net.Conn
+	writeMutex sync.Mutex
+	layers     []crypto.OnionLayer   // Check the create confirmation
+	hops       []*crypto.RelayCrypto // Relay cell state, one per layer
+	relayMutex sync.Mutex            // Keeps forward cells in keystream order
+	streams    map[uint16]*Stream
+	resolves   map[uint16]chan []message.ResolvedAnswer
+	dnsCache   map[string]dnsEntry
+	control    chan *message.RelayCell
+	onStream   func(*Stream)
+	nextStream uint16
+	dirtySince time.Time // When first handed out for streams, zero while clean
+	isolation  IsolationKey // Key of the first stream, once dirty
+	created    chan error
+	puzzles    chan message.Puzzle // From a guard asking for proof of work
+	closed     chan struct{}
+	closeOnce  sync.Once
+
+	// SENDME flow control for DATA cells, shared with the streams' windows
+	flowMutex     sync.Mutex
+	congestion    *congestion.Vegas // Circuit package window
+	deliverWindow int
+	consumed      int // DATA cells read or dropped since the last SENDME
+	windowSignal  chan struct{}
+
+	LinkPadding    padding.Stats // Messages on the link to the guard
+	CircuitPadding padding.Stats // Cells to and from the last hop
+	linkPadder     *padding.Padder
+	circuitPadder  *padding.Padder
 }
 
 type CircuitManager struct {
-	DirectoryURL string
-	Circuits     map[string]*Circuit
-	mutex        sync.RWMutex
+	DirectoryURL    string
+	ClientAuthKey   *rsa.PrivateKey // Proves authorization to onion services that require it
+	Padding         padding.Config
+	Bridges         []NodeInfo      // First hops to use instead of the listed guards
+	BuildTimes      *buildtime.Estimator
+	Isolation       Isolation // Stream properties that keep circuits apart
+	LinkDelay       time.Duration // Simulated delay on the link to the guard
+	Circuits        map[string]*Circuit
+	serviceCircuits map[string]*Circuit // Rendezvous circuits by onion address
+	predictedPorts  map[int]time.Time   // Ports streams were recently opened to
+	mutex           sync.RWMutex
+	buildSlots      map[IsolationKey]*buildSlot // Builds in progress by isolated key
 }
 
 func NewCircuitManager(directoryURL string) *CircuitManager {
 	if directoryURL == "" {
-		directoryURL = "http://172.191.95.78:9000"
+		directoryURL = config.DefaultDirectoryURL
 	}
 	return &CircuitManager{
-		DirectoryURL: directoryURL,
-		Circuits:     make(map[string]*Circuit),
+		DirectoryURL:    directoryURL,
+		Circuits:        make(map[string]*Circuit),
+		serviceCircuits: make(map[string]*Circuit),
+		predictedPorts:  make(map[int]time.Time),
+		BuildTimes:      buildtime.New(),
+		Isolation:       DefaultIsolation,
+		buildSlots:      make(map[IsolationKey]*buildSlot),
 	}
 }
 
 func (cm *CircuitManager) CreateCircuit() (*Circuit, error) {
+	return cm.CreateCircuitContext(context.Background())
+}
+
+// CreateCircuitContext builds a circuit, giving up when ctx is done or
+// the directory or build times out, whichever comes first
+func (cm *CircuitManager) CreateCircuitContext(ctx context.Context) (*Circuit, error) {
+	return cm.createCircuit(ctx, nil)
+}
+
+// createCircuit builds a circuit for the pool, or already claimed for
+// streams with key when one is given, before other callers can see it
+func (cm *CircuitManager) createCircuit(ctx context.Context, key *IsolationKey) (*Circuit, error) {
+	dirCtx, cancel := context.WithTimeout(ctx, DialTimeout)
+	defer cancel()
+
 	// Get available nodes from directory
-	guardNodes, err := cm.getNodesByType("guard")
+	guardNodes, err := cm.guardNodes(dirCtx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get guard nodes: %v", err)
+		return nil, fmt.Errorf("failed to get guard nodes: %w", err)
 	}
-	
-	relayNodes, err := cm.getNodesByType("relay")
+
+	middleNodes, err := cm.GetNodesByFlag(dirCtx, "middle")
 	if err != nil {
-		return nil, fmt.Errorf("failed to get relay nodes: %v", err)
+		return nil, fmt.Errorf("failed to get middle nodes: %w", err)
 	}
-	
-	exitNodes, err := cm.getNodesByType("exit")
+
+	exitNodes, err := cm.GetNodesByFlag(dirCtx, "exit")
 	if err != nil {
-		return nil, fmt.Errorf("failed to get exit nodes: %v", err)
+		return nil, fmt.Errorf("failed to get exit nodes: %w", err)
 	}
 
-	if len(guardNodes) == 0 || len(relayNodes) == 0 || len(exitNodes) == 0 {
+	if len(guardNodes) == 0 {
 		return nil, errors.New("insufficient nodes for circuit creation")
 	}
 
-	// Select one node of each type (simple selection for now)
-	circuit := &Circuit{
-		ID: generateCircuitID(),
-		Nodes: []NodeInfo{
-			guardNodes[0], // Guard node
-			relayNodes[0], // Relay node
-			exitNodes[0],  // Exit node
-		},
-		Path: []string{guardNodes[0].ID, relayNodes[0].ID, exitNodes[0].ID},
+	// Select a node for each position (simple selection for now), never
+	// two from the same family, so no operator sees both ends of the
+	// circuit. A node listed for several positions fills only one.
+	guard := guardNodes[0]
+	exit, ok := firstUnrelated(exitNodes, guard)
+	if !ok {
+		return nil, errors.New("insufficient nodes for circuit creation: no exit outside the guard's family")
+	}
+	relay, ok := firstUnrelated(middleNodes, guard, exit)
+	if !ok {
+		return nil, errors.New("insufficient nodes for circuit creation: no middle outside the guard's and exit's families")
+	}
+	circuit := newCircuit([]NodeInfo{guard, relay, exit})
+
+	if err := cm.buildCircuit(ctx, circuit); err != nil {
+		return nil, fmt.Errorf("failed to build circuit: %w", err)
+	}
+	if key != nil {
+		circuit.claim(*key, cm.Isolation)
 	}
 
 	cm.mutex.Lock()
 	cm.Circuits[circuit.ID] = circuit
 	cm.mutex.Unlock()
 
-	fmt.Printf("Created circuit %s: %s -> %s -> %s\n", 
-		circuit.ID, guardNodes[0].ID, relayNodes[0].ID, exitNodes[0].ID)
+	fmt.Printf("Created circuit %s: %s -> %s -> %s\n",
+		circuit.ID, guard.ID, relay.ID, exit.ID)
+
+	return circuit, nil
+}
+
+// CreateCircuitTo builds a circuit whose last hop is target, for reaching
+// onion service introduction and rendezvous points. Such circuits are not
+// handed out for exit streams.
+func (cm *CircuitManager) CreateCircuitTo(ctx context.Context, target NodeInfo) (*Circuit, error) {
+	dirCtx, cancel := context.WithTimeout(ctx, DialTimeout)
+	defer cancel()
+
+	guardNodes, err := cm.guardNodes(dirCtx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get guard nodes: %w", err)
+	}
+
+	middleNodes, err := cm.GetNodesByFlag(dirCtx, "middle")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get middle nodes: %w", err)
+	}
+
+	guard, ok := firstUnrelated(guardNodes, target)
+	if !ok {
+		return nil, errors.New("insufficient nodes for circuit creation")
+	}
+	middle, ok := firstUnrelated(middleNodes, target, guard)
+	if !ok {
+		return nil, errors.New("insufficient nodes for circuit creation")
+	}
 
+	circuit := newCircuit([]NodeInfo{guard, middle, target})
+	if err := cm.buildCircuit(ctx, circuit); err != nil {
+		return nil, fmt.Errorf("failed to build circuit: %w", err)
+	}
 	return circuit, nil
 }
 
-func (cm *CircuitManager) getNodesByType(nodeType string) ([]NodeInfo, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/nodes/%s", cm.DirectoryURL, nodeType))
+func newCircuit(nodes []NodeInfo) *Circuit {
+	path := make([]string, len(nodes))
+	for i, node := range nodes {
+		path[i] = node.ID
+	}
+	return &Circuit{
+		ID:    generateCircuitID(),
+		Nodes: nodes,
+		Path:  path,
+	}
+}
+
+// firstExcept returns the first node whose ID is not excluded
+func firstExcept(nodes []NodeInfo, exclude ...string) (NodeInfo, bool) {
+	for _, node := range nodes {
+		excluded := false
+		for _, id := range exclude {
+			if node.ID == id {
+				excluded = true
+			}
+		}
+		if !excluded {
+			return node, true
+		}
+	}
+	return NodeInfo{}, false
+}
+
+// firstUnrelated returns the first node in the family of none of chosen
+func firstUnrelated(nodes []NodeInfo, chosen ...NodeInfo) (NodeInfo, bool) {
+	for _, node := range nodes {
+		related := false
+		for _, other := range chosen {
+			if node.SameFamily(other) {
+				related = true
+			}
+		}
+		if !related {
+			return node, true
+		}
+	}
+	return NodeInfo{}, false
+}
+
+// SameFamily reports whether two nodes must not share a circuit: they are
+// the same node, or either lists the other in its family
+func (n NodeInfo) SameFamily(other NodeInfo) bool {
+	if n.ID == other.ID {
+		return true
+	}
+	for _, id := range n.Family {
+		if id == other.ID {
+			return true
+		}
+	}
+	for _, id := range other.Family {
+		if id == n.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// TargetNodes lists the middle nodes CreateCircuitTo can reach: those
+// outside the family of the guard circuits start at, which could not also
+// be the last hop
+func (cm *CircuitManager) TargetNodes(ctx context.Context) ([]NodeInfo, error) {
+	guardNodes, err := cm.guardNodes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get guard nodes: %w", err)
+	}
+	middleNodes, err := cm.GetNodesByFlag(ctx, "middle")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get middle nodes: %w", err)
+	}
+	if len(guardNodes) == 0 {
+		return nil, errors.New("no guard nodes")
+	}
+
+	var targets []NodeInfo
+	for _, node := range middleNodes {
+		if !node.SameFamily(guardNodes[0]) {
+			targets = append(targets, node)
+		}
+	}
+	return targets, nil
+}
+
+// buildCircuit builds c within the learned build timeout and records how
+// long it took. A build that runs out of time is abandoned and recorded
+// too, so the timeout keeps up with the network.
+func (cm *CircuitManager) buildCircuit(ctx context.Context, c *Circuit) error {
+	timeout := cm.BuildTimes.Timeout()
+	buildCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := cm.build(buildCtx, c)
+	switch {
+	case err == nil:
+		cm.BuildTimes.Completed(time.Since(start))
+	case ctx.Err() == nil && buildCtx.Err() == context.DeadlineExceeded:
+		cm.BuildTimes.Abandoned(timeout)
+		err = fmt.Errorf("abandoned after %v build timeout: %w", timeout, err)
+	default:
+		return err
+	}
+
+	if saveErr := cm.BuildTimes.Save(); saveErr != nil {
+		fmt.Printf("Warning: failed to save circuit build times: %v\n", saveErr)
+	}
+	return err
+}
+
+// build sends a create onion through the circuit's nodes and waits for the
+// exit's confirmation to travel back
+func (cm *CircuitManager) build(ctx context.Context, c *Circuit) error {
+	nodeKeys := make([]*rsa.PublicKey, len(c.Nodes))
+	for i, node := range c.Nodes {
+		nodeKeys[i] = node.PublicKey
+	}
+
+	layers, err := crypto.CreateOnionLayers(nodeKeys, c.Path)
+	if err != nil {
+		return err
+	}
+
+	// Each layer tells its hop where to send the rest of the onion
+	var onion []byte
+	for i := len(layers) - 1; i >= 0; i-- {
+		info := &message.OnionMessage{
+			Type:      message.CircuitCreate,
+			Payload:   onion,
+			IsLastHop: i == len(layers)-1,
+			Timestamp: time.Now().Unix(),
+		}
+		if !info.IsLastHop {
+			info.NextHop = c.Nodes[i+1].Addr()
+		}
+
+		data, err := info.ToJSON()
+		if err != nil {
+			return err
+		}
+		if onion, err = crypto.EncryptOnionLayer(data, layers[i]); err != nil {
+			return err
+		}
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.Nodes[0].Addr())
+	if err != nil {
+		return fmt.Errorf("failed to connect to guard node: %w", err)
+	}
+
+	guard := c.Nodes[0]
+	wrapped, err := transport.Dial(conn, guard.Transport, guard.TransportArgs)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("%s handshake with guard node failed: %w", guard.Transport, err)
+	}
+	conn = transport.Delay(wrapped, cm.LinkDelay)
+
+	hops := make([]*crypto.RelayCrypto, len(layers))
+	for i, layer := range layers {
+		if hops[i], err = crypto.NewRelayCrypto(layer.AESKey, false); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	c.conn = conn
+	c.layers = layers
+	c.hops = hops
+	c.streams = make(map[uint16]*Stream)
+	c.resolves = make(map[uint16]chan []message.ResolvedAnswer)
+	c.dnsCache = make(map[string]dnsEntry)
+	c.control = make(chan *message.RelayCell, 16)
+	c.created = make(chan error, 1)
+	c.puzzles = make(chan message.Puzzle, 1)
+	c.closed = make(chan struct{})
+	c.initWindows()
+
+	go cm.readCircuit(c)
+
+	if err := c.send(&message.OnionMessage{Type: message.CircuitCreate, CircuitID: c.ID, Payload: onion}); err != nil {
+		c.Close()
+		return err
+	}
+
+	// A loaded guard may answer with a puzzle; the create is sent again
+	// with its proof, which counts towards the build time
+	for {
+		select {
+		case err := <-c.created:
+			if err != nil {
+				c.Close()
+				return err
+			}
+			cm.startPadding(c)
+			return nil
+		case puzzle := <-c.puzzles:
+			fmt.Printf("Circuit %s: 🧩 Guard is under load, solving a %d-bit puzzle\n", c.ID, puzzle.Bits)
+			proof, err := pow.Solve(ctx, puzzle, onion)
+			if err != nil {
+				c.Destroy(message.DestroyTimeout)
+				return fmt.Errorf("solving guard's puzzle: %w", err)
+			}
+			if err := c.send(&message.OnionMessage{Type: message.CircuitCreate, CircuitID: c.ID, Payload: onion, Proof: proof}); err != nil {
+				c.Close()
+				return err
+			}
+		case <-ctx.Done():
+			c.Destroy(message.DestroyTimeout)
+			return fmt.Errorf("waiting for circuit: %w", ctx.Err())
+		}
+	}
+}
+
+// readCircuit handles everything the guard sends back on this circuit
+func (cm *CircuitManager) readCircuit(c *Circuit) {
+	defer func() {
+		c.Close()
+		cm.mutex.Lock()
+		if cm.Circuits[c.ID] == c {
+			delete(cm.Circuits, c.ID)
+		}
+		cm.mutex.Unlock()
+	}()
+
+	for {
+		msg, err := message.ReadMessage(c.conn)
+		if err != nil {
+			select {
+			case c.created <- err:
+			default:
+			}
+			return
+		}
+
+		if padding.IsPadding(msg, msg.CircuitID == c.ID) {
+			c.LinkPadding.PaddingReceived.Add(1)
+			continue
+		}
+		switch msg.Type {
+		case message.LinkPaddingNegotiate:
+			c.handleLinkPaddingNegotiate(msg)
+			continue
+		}
+		c.LinkPadding.RealReceived.Add(1)
+
+		switch msg.Type {
+		case message.CircuitCreated:
+			if _, err := c.peel(msg.Payload); err != nil {
+				fmt.Printf("Circuit %s: failed to decrypt cell: %v\n", c.ID, err)
+				continue
+			}
+			select {
+			case c.created <- nil:
+			default:
+			}
+		case message.CircuitPuzzle:
+			var puzzle message.Puzzle
+			if err := json.Unmarshal(msg.Payload, &puzzle); err != nil {
+				fmt.Printf("Circuit %s: invalid puzzle: %v\n", c.ID, err)
+				continue
+			}
+			select {
+			case c.puzzles <- puzzle:
+			default:
+			}
+		case message.CircuitRelay:
+			if !c.receiveRelay(msg.Payload) {
+				c.Destroy(message.DestroyProtocol)
+				return
+			}
+		case message.CircuitDestroy:
+			err := &DestroyedError{Reason: msg.DestroyReason()}
+			fmt.Printf("Circuit %s: 💥 %v\n", c.ID, err)
+			select {
+			case c.created <- err:
+			default:
+			}
+			c.closeWith(err)
+			return
+		}
+	}
+}
+
+// peel removes the layer added by each hop to the create confirmation
+func (c *Circuit) peel(data []byte) ([]byte, error) {
+	var err error
+	for _, layer := range c.layers {
+		if data, err = crypto.OpenLayer(layer.GCM, data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// receiveRelay removes layers from a backward cell until the hop that sent
+// it recognizes it. A cell no hop recognizes was modified on the way, and
+// the circuit is torn down.
+func (c *Circuit) receiveRelay(data []byte) bool {
+	if len(data) == message.RelayCellSize {
+		for _, hop := range c.relayHops() {
+			hop.Backward.Crypt(data)
+			if !message.RecognizeRelayCell(data, hop.Backward) {
+				continue
+			}
+
+			cell, err := message.DecodeRelayCell(data)
+			if err != nil {
+				break
+			}
+			c.handleRelayCell(cell)
+			return true
+		}
+	}
+
+	fmt.Printf("Circuit %s: 🛑 relay cell digest mismatch, tearing down circuit\n", c.ID)
+	return false
+}
+
+// sendRelay sends a cell to the circuit's last layer
+func (c *Circuit) sendRelay(cell *message.RelayCell) error {
+	return c.sendRelayTo(len(c.relayHops())-1, cell)
+}
+
+// sendRelayTo seals a cell for one hop and adds the layers of that hop and
+// every hop before it
+func (c *Circuit) sendRelayTo(hop int, cell *message.RelayCell) error {
+	data, err := cell.Encode()
+	if err != nil {
+		return err
+	}
+
+	hops := c.relayHops()
+	c.relayMutex.Lock()
+	message.SealRelayCell(data, hops[hop].Forward)
+	for i := hop; i >= 0; i-- {
+		hops[i].Forward.Crypt(data)
+	}
+	err = c.send(&message.OnionMessage{Type: message.CircuitRelay, CircuitID: c.ID, Payload: data})
+	c.relayMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if cell.Command == message.RelayDrop {
+		c.CircuitPadding.PaddingSent.Add(1)
+	} else {
+		c.CircuitPadding.RealSent.Add(1)
+		_, circuitPadder := c.padders()
+		circuitPadder.Activity()
+	}
+	return nil
+}
+
+func (c *Circuit) relayHops() []*crypto.RelayCrypto {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.hops
+}
+
+// AddLayer adds an end-to-end layer under key beyond the circuit's last
+// hop, as when a rendezvous joins client and service circuits. The
+// responder, the service, uses the client's directions reversed.
+func (c *Circuit) AddLayer(key []byte, responder bool) error {
+	hop, err := crypto.NewRelayCrypto(key, responder)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	hops := make([]*crypto.RelayCrypto, len(c.hops), len(c.hops)+1)
+	copy(hops, c.hops)
+	c.hops = append(hops, hop)
+	return nil
+}
+
+// SendControl sends a circuit-level cell to the circuit's last node,
+// underneath any end-to-end layer
+func (c *Circuit) SendControl(command message.RelayCommand, data []byte) error {
+	return c.sendRelayTo(len(c.Nodes)-1, &message.RelayCell{Command: command, Data: data})
+}
+// Control delivers circuit-level cells, such as onion service handshakes,
+// that are not addressed to a stream
+func (c *Circuit) Control() <-chan *message.RelayCell {
+	return c.control
+}
+
+// Done is closed once the circuit has closed
+func (c *Circuit) Done() <-chan struct{} {
+	return c.closed
+}
+
+// WaitControl waits for the next circuit-level cell of the given command,
+// discarding any others
+func (c *Circuit) WaitControl(ctx context.Context, command message.RelayCommand) (*message.RelayCell, error) {
+	for {
+		select {
+		case cell := <-c.control:
+			if cell.Command == command {
+				return cell, nil
+			}
+		case <-c.closed:
+			return nil, errCircuitClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *Circuit) send(msg *message.OnionMessage) error {
+	return c.write(msg, false)
+}
+
+// sendPadding writes one link padding message to the guard
+func (c *Circuit) sendPadding() error {
+	return c.write(padding.PaddingMessage(), true)
+}
+
+func (c *Circuit) write(msg *message.OnionMessage, isPadding bool) error {
+	c.writeMutex.Lock()
+	select {
+	case <-c.closed:
+		c.writeMutex.Unlock()
+		return errCircuitClosed
+	default:
+	}
+	err := message.WriteMessage(c.conn, msg)
+	c.writeMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if isPadding {
+		c.LinkPadding.PaddingSent.Add(1)
+	} else {
+		c.LinkPadding.RealSent.Add(1)
+		linkPadder, _ := c.padders()
+		linkPadder.Activity()
+	}
+	return nil
+}
+
+// IsClosed reports whether the circuit's connection to the guard is gone
+func (c *Circuit) IsClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Destroy asks every hop to tear the circuit down, then closes it
+func (c *Circuit) Destroy(reason byte) {
+	if !c.IsClosed() {
+		c.send(message.DestroyMessage(c.ID, reason))
+	}
+	c.Close()
+}
+
+// Close tears down the guard connection and every stream on the circuit.
+// The guard sees the link close and destroys the rest of the circuit.
+func (c *Circuit) Close() {
+	c.closeWith(errCircuitClosed)
+}
+
+// closeWith closes the circuit, failing its streams with err
+func (c *Circuit) closeWith(err error) {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+		linkPadder, circuitPadder := c.padders()
+		linkPadder.Stop()
+		circuitPadder.Stop()
+
+		c.mutex.Lock()
+		streams := c.streams
+		c.streams = make(map[uint16]*Stream)
+		c.mutex.Unlock()
+
+		for _, s := range streams {
+			s.remoteClosed(err)
+		}
+	})
+}
+
+// AddBridge adds a bridge, given as a bridge line, to use as first hop
+func (cm *CircuitManager) AddBridge(line string) error {
+	bridge, err := message.ParseBridgeLine(line)
+	if err != nil {
+		return err
+	}
+
+	if !transport.Supported(bridge.Transport) {
+		return fmt.Errorf("bridge %s uses unsupported transport %q (supported: %s)",
+			bridge.ID, bridge.Transport, strings.Join(transport.Names(), ", "))
+	}
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	cm.Bridges = append(cm.Bridges, NodeInfo{
+		ID:            bridge.ID,
+		Address:       bridge.Address,
+		Port:          bridge.Port,
+		IdentityKey:   bridge.IdentityKey,
+		Transport:     bridge.Transport,
+		TransportArgs: bridge.TransportArgs,
+	})
+	return nil
+}
+
+// guardNodes returns the configured bridges if there are any, so the
+// listed guards are never contacted, and the directory's guards otherwise
+func (cm *CircuitManager) guardNodes(ctx context.Context) ([]NodeInfo, error) {
+	cm.mutex.RLock()
+	bridges := cm.Bridges
+	cm.mutex.RUnlock()
+	if len(bridges) == 0 {
+		return cm.GetNodesByFlag(ctx, "guard")
+	}
+
+	// A bridge line names only the identity key, so the current onion key
+	// comes from the bridge's descriptor, which that key must have signed
+	var usable []NodeInfo
+	for _, bridge := range bridges {
+		onionKey, err := cm.bridgeOnionKey(ctx, bridge)
+		if err != nil {
+			fmt.Printf("Warning: skipping bridge %s: %v\n", bridge.ID, err)
+			continue
+		}
+		bridge.PublicKey = onionKey
+		usable = append(usable, bridge)
+	}
+	if len(usable) == 0 {
+		return nil, fmt.Errorf("no bridge descriptor could be verified")
+	}
+	return usable, nil
+}
+
+// bridgeOnionKey fetches a bridge's signed descriptor and returns its
+// onion key, if the descriptor is signed by the bridge line's identity key
+func (cm *CircuitManager) bridgeOnionKey(ctx context.Context, bridge NodeInfo) (*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/bridges/%s", cm.DirectoryURL, bridge.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("directory answered %s", resp.Status)
+	}
+
+	var desc message.NodeDescriptor
+	if err := json.NewDecoder(resp.Body).Decode(&desc); err != nil {
+		return nil, err
+	}
+	if err := desc.Verify(); err != nil {
+		return nil, err
+	}
+	if crypto.KeyID(desc.IdentityKey) != crypto.KeyID(bridge.IdentityKey) {
+		return nil, fmt.Errorf("descriptor is for a different identity key")
+	}
+	return desc.PublicKey, nil
+}
+
+// GetNodesByFlag lists the directory's fresh nodes with a flag: guard,
+// middle or exit
+func (cm *CircuitManager) GetNodesByFlag(ctx context.Context, flag string) ([]NodeInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/nodes/%s", cm.DirectoryURL, flag), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("no %s nodes: directory answered %s", flag, resp.Status)
+	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -106,15 +834,69 @@ func (cm *CircuitManager) getNodesByType(nodeType string) ([]NodeInfo, error) {
 func (cm *CircuitManager) GetCircuit(circuitID string) (*Circuit, bool) {
 	cm.mutex.RLock()
 	defer cm.mutex.RUnlock()
-	
+
 	circuit, exists := cm.Circuits[circuitID]
 	return circuit, exists
 }
 
+// ListCircuits returns a snapshot of the open circuits
+func (cm *CircuitManager) ListCircuits() []*Circuit {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	circuits := make([]*Circuit, 0, len(cm.Circuits))
+	for _, c := range cm.Circuits {
+		circuits = append(circuits, c)
+	}
+	return circuits
+}
+
+// GetOrCreateCircuit returns an open circuit for new streams, building one
+// if none is ready
+func (cm *CircuitManager) GetOrCreateCircuit() (*Circuit, error) {
+	return cm.GetOrCreateCircuitContext(context.Background())
+}
+
+// GetOrCreateCircuitContext is GetOrCreateCircuit bounded by ctx, for a
+// stream with the isolation key attached to ctx. A circuit already in use
+// within MaxCircuitDirtiness by compatible streams is preferred, then a
+// clean one from the pool. Builds are serialized only among callers whose
+// streams could share a circuit, so they share the new one while streams
+// kept apart build theirs at the same time.
+func (cm *CircuitManager) GetOrCreateCircuitContext(ctx context.Context) (*Circuit, error) {
+	key := IsolationFrom(ctx)
+
+	release, err := cm.acquireBuildSlot(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var clean []*Circuit
+	for _, c := range cm.ListCircuits() {
+		switch {
+		case c.IsClosed():
+		case !c.IsDirty():
+			clean = append(clean, c)
+		case !c.dirtyFor(MaxCircuitDirtiness) && c.Isolation().compatible(key, cm.Isolation):
+			return c, nil
+		}
+	}
+	for _, c := range clean {
+		if c.claim(key, cm.Isolation) {
+			return c, nil
+		}
+	}
+	return cm.createCircuit(ctx, &key)
+}
+
 func (cm *CircuitManager) DestroyCircuit(circuitID string) {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
-	
+
+	if circuit, exists := cm.Circuits[circuitID]; exists {
+		circuit.Destroy(message.DestroyRequested)
+	}
 	delete(cm.Circuits, circuitID)
 	fmt.Printf("Destroyed circuit %s\n", circuitID)
 }
@@ -126,8 +908,11 @@ func generateCircuitID() string {
 func randomString(length int) string {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
 	for i := range b {
-		b[i] = charset[i%len(charset)] // Simple deterministic selection for now
+		b[i] = charset[int(b[i])%len(charset)]
 	}
 	return string(b)
-}
\ No newline at end of file
+}
@@ -0,0 +1,122 @@
+package circuit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"onion-network/pkg/crypto"
+	"onion-network/pkg/message"
+)
+
+func TestGetNodesByFlag(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		nodes  int
+		fails  bool
+	}{
+		{"listed", http.StatusOK, `[{"id":"node_a","address":"192.0.2.1","port":9001}]`, 1, false},
+		{"none listed", http.StatusOK, `[]`, 0, false},
+		{"unknown flag", http.StatusNotFound, "Unknown flag\n", 0, true},
+		{"directory failing", http.StatusInternalServerError, `[]`, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+			defer dir.Close()
+
+			nodes, err := NewCircuitManager(dir.URL).GetNodesByFlag(context.Background(), "guard")
+			if test.fails {
+				if err == nil {
+					t.Fatalf("got %d nodes from a %d answer", len(nodes), test.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(nodes) != test.nodes {
+				t.Errorf("got %d nodes, want %d", len(nodes), test.nodes)
+			}
+		})
+	}
+}
+
+func TestTamperedCellNotDelivered(t *testing.T) {
+	c, _ := exitCircuit(t)
+	s, err := c.newStream("example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exit, err := crypto.NewRelayCrypto(make([]byte, 32), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cell := func(data string, tamper bool) []byte {
+		cell, err := (&message.RelayCell{Command: message.RelayData, StreamID: s.ID, Data: []byte(data)}).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		message.SealRelayCell(cell, exit.Backward)
+		exit.Backward.Crypt(cell)
+		if tamper {
+			cell[len(cell)-1] ^= 1
+		}
+		return cell
+	}
+
+	if !c.receiveRelay(cell("first", false)) {
+		t.Fatal("untouched cell refused")
+	}
+	if c.receiveRelay(cell("second", true)) {
+		t.Fatal("tampered cell accepted")
+	}
+	if got := len(s.incoming); got != 1 {
+		t.Errorf("%d cells delivered, want only the untouched one", got)
+	}
+}
+
+func TestDestroyFromGuardReachesStreams(t *testing.T) {
+	local, guard := net.Pipe()
+	defer guard.Close()
+	c := &Circuit{
+		ID:      "test",
+		conn:    local,
+		streams: make(map[uint16]*Stream),
+		created: make(chan error, 1),
+		closed:  make(chan struct{}),
+	}
+	c.initWindows()
+	cm := NewCircuitManager("http://127.0.0.1:0")
+	cm.Circuits[c.ID] = c
+	s, err := c.newStream("example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cm.readCircuit(c)
+	}()
+	if err := message.WriteMessage(guard, message.DestroyMessage(c.ID, message.DestroyResourceLimit)); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	var destroyed *DestroyedError
+	if _, err := s.Read(make([]byte, 1)); !errors.As(err, &destroyed) || destroyed.Reason != message.DestroyResourceLimit {
+		t.Errorf("stream read after DESTROY: %v", err)
+	}
+	if len(cm.ListCircuits()) != 0 {
+		t.Error("destroyed circuit still listed")
+	}
+}
@@ -0,0 +1,197 @@
+package circuit
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"onion-network/pkg/congestion"
+	"onion-network/pkg/message"
+)
+
+// initWindows opens the circuit's flow control windows. The caller holds
+// c.mutex or has not yet shared the circuit.
+func (c *Circuit) initWindows() {
+	c.congestion = congestion.NewVegas(message.CircuitSendmeIncrement, message.CircuitWindow)
+	c.deliverWindow = message.CircuitWindow
+	c.windowSignal = make(chan struct{})
+}
+
+// windowChanged wakes writers waiting for a package window. The caller
+// holds c.flowMutex.
+func (c *Circuit) windowChanged() {
+	close(c.windowSignal)
+	c.windowSignal = make(chan struct{})
+}
+
+// reservePackage takes one DATA cell from the stream's package window and
+// the circuit's congestion window, waiting for SENDMEs from the far end
+// while either is full. The caller sends the cell right away.
+func (s *Stream) reservePackage() error {
+	c := s.circuit
+	for {
+		c.flowMutex.Lock()
+		if s.packageWindow > 0 && c.congestion.Reserve() {
+			s.packageWindow--
+			c.congestion.Sent(time.Now())
+			c.flowMutex.Unlock()
+			return nil
+		}
+		signal := c.windowSignal
+		c.flowMutex.Unlock()
+
+		select {
+		case <-signal:
+		case <-s.done:
+			return net.ErrClosed
+		case <-s.eof:
+			if s.err != nil {
+				return s.err
+			}
+			return io.ErrClosedPipe
+		case <-c.closed:
+			return errCircuitClosed
+		case <-s.writeDeadline.wait():
+			return os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// handleSendme opens a package window. A SENDME beyond the full window
+// means the far end is not following the protocol. Circuit SENDMEs also
+// time the round trip for congestion control.
+func (c *Circuit) handleSendme(cell *message.RelayCell) {
+	c.flowMutex.Lock()
+	violation := false
+	if cell.StreamID == 0 {
+		violation = !c.congestion.Acked(time.Now())
+	} else {
+		c.mutex.RLock()
+		s, exists := c.streams[cell.StreamID]
+		c.mutex.RUnlock()
+		if exists {
+			s.packageWindow += message.StreamSendmeIncrement
+			violation = s.packageWindow > message.StreamWindow
+		}
+	}
+	c.windowChanged()
+	c.flowMutex.Unlock()
+
+	if violation {
+		fmt.Printf("Circuit %s: unexpected SENDME on stream %d\n", c.ID, cell.StreamID)
+		c.Destroy(message.DestroyProtocol)
+	}
+}
+
+// receiveCircuitCell counts a received DATA cell against the circuit's
+// deliver window. The window reopens only as streams read or drop their
+// cells, so it reports false when the far end sent past it.
+func (c *Circuit) receiveCircuitCell() bool {
+	c.flowMutex.Lock()
+	c.deliverWindow--
+	overran := c.deliverWindow < 0
+	c.flowMutex.Unlock()
+
+	if overran {
+		fmt.Printf("Circuit %s: far end overran the circuit window\n", c.ID)
+		c.Destroy(message.DestroyProtocol)
+		return false
+	}
+	return true
+}
+
+// consume gives back the circuit window of DATA cells that were read or
+// dropped and returns how many SENDMEs are due. The caller holds
+// c.flowMutex.
+func (c *Circuit) consume(cells int) int {
+	c.consumed += cells
+	sendmes := c.consumed / message.CircuitSendmeIncrement
+	c.consumed -= sendmes * message.CircuitSendmeIncrement
+	c.deliverWindow += sendmes * message.CircuitSendmeIncrement
+	return sendmes
+}
+
+// sendSendmes acknowledges increments of the circuit's DATA cells
+func (c *Circuit) sendSendmes(sendmes int) {
+	for i := 0; i < sendmes; i++ {
+		c.sendRelay(&message.RelayCell{Command: message.RelaySendme})
+	}
+}
+
+// dropData gives back the window of a DATA cell no stream takes
+func (c *Circuit) dropData() {
+	c.flowMutex.Lock()
+	sendmes := c.consume(1)
+	c.flowMutex.Unlock()
+	c.sendSendmes(sendmes)
+}
+
+// buffer queues a DATA cell for Read, reporting false when the buffer is
+// full, which only a far end ignoring the stream window causes. A closed
+// stream drops the cell instead.
+func (s *Stream) buffer(data []byte) bool {
+	c := s.circuit
+	c.flowMutex.Lock()
+	sendmes, fits := 0, true
+	select {
+	case <-s.done:
+		sendmes = c.consume(1)
+	default:
+		select {
+		case s.incoming <- data:
+		default:
+			fits = false
+		}
+	}
+	c.flowMutex.Unlock()
+	c.sendSendmes(sendmes)
+	return fits
+}
+
+// discard drops the cells a closed stream never read, giving back their
+// circuit window
+func (s *Stream) discard() {
+	c := s.circuit
+	c.flowMutex.Lock()
+	cells := 0
+	for drained := false; !drained; {
+		select {
+		case <-s.incoming:
+			cells++
+		default:
+			drained = true
+		}
+	}
+	sendmes := c.consume(cells)
+	c.flowMutex.Unlock()
+	c.sendSendmes(sendmes)
+}
+
+// delivered counts a DATA cell the application has read against the
+// stream's and the circuit's deliver windows. Acknowledging only what was
+// read keeps the far end from sending faster than the reader consumes.
+func (s *Stream) delivered() {
+	c := s.circuit
+	c.flowMutex.Lock()
+	s.deliverWindow--
+	sendme := s.deliverWindow <= message.StreamWindow-message.StreamSendmeIncrement
+	if sendme {
+		s.deliverWindow += message.StreamSendmeIncrement
+	}
+	sendmes := c.consume(1)
+	c.flowMutex.Unlock()
+
+	c.sendSendmes(sendmes)
+	if sendme {
+		c.sendRelay(&message.RelayCell{Command: message.RelaySendme, StreamID: s.ID})
+	}
+}
+
+// Congestion describes the circuit's congestion window and RTT
+func (c *Circuit) Congestion() string {
+	c.flowMutex.Lock()
+	defer c.flowMutex.Unlock()
+	return c.congestion.String()
+}
@@ -0,0 +1,151 @@
+package circuit
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"onion-network/pkg/crypto"
+	"onion-network/pkg/message"
+)
+
+// exitCircuit is a one hop circuit whose far end is the test, with the
+// cells the exit receives on it, which close when the circuit is destroyed
+func exitCircuit(t *testing.T) (*Circuit, <-chan *message.RelayCell) {
+	t.Helper()
+	key := make([]byte, 32)
+	client, err := crypto.NewRelayCrypto(key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exit, err := crypto.NewRelayCrypto(key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, remote := net.Pipe()
+	c := &Circuit{
+		ID:      "test",
+		conn:    local,
+		hops:    []*crypto.RelayCrypto{client},
+		streams: make(map[uint16]*Stream),
+		closed:  make(chan struct{}),
+	}
+	c.initWindows()
+	t.Cleanup(c.Close)
+
+	cells := make(chan *message.RelayCell, 16)
+	go func() {
+		defer close(cells)
+		for {
+			msg, err := message.ReadMessage(remote)
+			if err != nil || msg.Type == message.CircuitDestroy {
+				return
+			}
+			exit.Forward.Crypt(msg.Payload)
+			cell, err := message.DecodeRelayCell(msg.Payload)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			cells <- cell
+		}
+	}()
+	return c, cells
+}
+
+func deliverData(c *Circuit, s *Stream, cells int) {
+	for i := 0; i < cells; i++ {
+		c.handleRelayCell(&message.RelayCell{Command: message.RelayData, StreamID: s.ID, Data: []byte{byte(i)}})
+	}
+}
+
+func expectCell(t *testing.T, cells <-chan *message.RelayCell, command message.RelayCommand, streamID uint16) {
+	t.Helper()
+	select {
+	case cell, ok := <-cells:
+		if !ok {
+			t.Fatal("circuit destroyed")
+		}
+		if cell.Command != command || cell.StreamID != streamID {
+			t.Fatalf("got command %d on stream %d, want %d on stream %d", cell.Command, cell.StreamID, command, streamID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no command %d on stream %d", command, streamID)
+	}
+}
+
+func TestSendmeFollowsReads(t *testing.T) {
+	c, cells := exitCircuit(t)
+	s, err := c.newStream("example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliverData(c, s, message.StreamSendmeIncrement)
+	select {
+	case cell := <-cells:
+		t.Fatalf("command %d sent before the data was read", cell.Command)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := io.ReadFull(s, make([]byte, message.StreamSendmeIncrement)); err != nil {
+		t.Fatal(err)
+	}
+	expectCell(t, cells, message.RelaySendme, s.ID)
+}
+
+func TestClosedStreamGivesBackCircuitWindow(t *testing.T) {
+	c, cells := exitCircuit(t)
+	s, err := c.newStream("example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliverData(c, s, message.CircuitSendmeIncrement)
+	s.Close()
+	expectCell(t, cells, message.RelaySendme, 0)
+	expectCell(t, cells, message.RelayEnd, s.ID)
+}
+
+func TestFarEndOverrunningStreamWindow(t *testing.T) {
+	c, cells := exitCircuit(t)
+	s, err := c.newStream("example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliverData(c, s, message.StreamWindow)
+	if c.IsClosed() {
+		t.Fatal("circuit destroyed within the window")
+	}
+	deliverData(c, s, 1)
+	if !c.IsClosed() {
+		t.Fatal("circuit kept after the far end overran the stream window")
+	}
+	for range cells {
+	}
+}
+
+func TestFarEndOverrunningCircuitWindow(t *testing.T) {
+	c, _ := exitCircuit(t)
+	var s *Stream
+	for i := 0; i <= message.CircuitWindow/message.StreamWindow; i++ {
+		var err error
+		if s, err = c.newStream("example.com:80"); err != nil {
+			t.Fatal(err)
+		}
+		if i < message.CircuitWindow/message.StreamWindow {
+			deliverData(c, s, message.StreamWindow)
+		}
+	}
+	if c.IsClosed() {
+		t.Fatal("circuit destroyed within the window")
+	}
+
+	deliverData(c, s, 1)
+	if !c.IsClosed() {
+		t.Fatal("circuit kept after the far end overran the circuit window")
+	}
+}
@@ -0,0 +1,158 @@
+package circuit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Isolation selects which properties of a stream keep it off circuits
+// used by streams that differ in them
+type Isolation uint8
+
+const (
+	IsolateAuth     Isolation = 1 << iota // SOCKS username and password
+	IsolateHost                           // Destination host
+	IsolatePort                           // Destination port
+	IsolateListener                       // Proxy listener the stream arrived on
+)
+
+// DefaultIsolation keeps apart streams from different SOCKS credentials and
+// different listeners, as Tor does by default
+const DefaultIsolation = IsolateAuth | IsolateListener
+
+var isolationNames = []struct {
+	name string
+	flag Isolation
+}{
+	{"auth", IsolateAuth},
+	{"host", IsolateHost},
+	{"port", IsolatePort},
+	{"listener", IsolateListener},
+}
+
+// ParseIsolation reads a comma-separated list of auth, host, port and
+// listener, or "none"
+func ParseIsolation(spec string) (Isolation, error) {
+	var isolation Isolation
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(strings.ToLower(item))
+		if item == "" || item == "none" {
+			continue
+		}
+
+		found := false
+		for _, known := range isolationNames {
+			if item == known.name {
+				isolation |= known.flag
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown isolation %q (use auth, host, port, listener or none)", item)
+		}
+	}
+	return isolation, nil
+}
+
+func (i Isolation) String() string {
+	var names []string
+	for _, known := range isolationNames {
+		if i&known.flag != 0 {
+			names = append(names, known.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// IsolationKey describes where a stream comes from and goes to. A circuit
+// takes the key of the first stream it carries, and later streams may only
+// join it if they match in every property the manager isolates on. Streams
+// with different tokens never share a circuit.
+type IsolationKey struct {
+	Auth     string
+	Host     string
+	Port     int
+	Listener string
+	Token    string // Set through WithIsolationToken by Go callers
+}
+
+func (k IsolationKey) compatible(other IsolationKey, isolation Isolation) bool {
+	switch {
+	case k.Token != other.Token:
+		return false
+	case isolation&IsolateAuth != 0 && k.Auth != other.Auth:
+		return false
+	case isolation&IsolateHost != 0 && k.Host != other.Host:
+		return false
+	case isolation&IsolatePort != 0 && k.Port != other.Port:
+		return false
+	case isolation&IsolateListener != 0 && k.Listener != other.Listener:
+		return false
+	}
+	return true
+}
+
+// isolatedBy keeps only the properties isolation looks at, so two keys are
+// compatible exactly when their results are equal
+func (k IsolationKey) isolatedBy(isolation Isolation) IsolationKey {
+	if isolation&IsolateAuth == 0 {
+		k.Auth = ""
+	}
+	if isolation&IsolateHost == 0 {
+		k.Host = ""
+	}
+	if isolation&IsolatePort == 0 {
+		k.Port = 0
+	}
+	if isolation&IsolateListener == 0 {
+		k.Listener = ""
+	}
+	return k
+}
+
+// String describes the key without revealing credentials
+func (k IsolationKey) String() string {
+	var parts []string
+	if k.Auth != "" {
+		parts = append(parts, "auth")
+	}
+	if k.Host != "" {
+		parts = append(parts, "host="+k.Host)
+	}
+	if k.Port != 0 {
+		parts = append(parts, fmt.Sprintf("port=%d", k.Port))
+	}
+	if k.Listener != "" {
+		parts = append(parts, "listener="+k.Listener)
+	}
+	if k.Token != "" {
+		parts = append(parts, "token="+k.Token)
+	}
+	return strings.Join(parts, " ")
+}
+
+type isolationContextKey struct{}
+
+// WithIsolation attaches a stream's isolation key to ctx, for the circuit
+// manager to choose a circuit by
+func WithIsolation(ctx context.Context, key IsolationKey) context.Context {
+	return context.WithValue(ctx, isolationContextKey{}, key)
+}
+
+// WithIsolationToken keeps streams dialed with ctx off circuits used by
+// streams with any other token, or none
+func WithIsolationToken(ctx context.Context, token string) context.Context {
+	key := IsolationFrom(ctx)
+	key.Token = token
+	return WithIsolation(ctx, key)
+}
+
+// IsolationFrom returns the isolation key attached to ctx, if any
+func IsolationFrom(ctx context.Context) IsolationKey {
+	key, _ := ctx.Value(isolationContextKey{}).(IsolationKey)
+	return key
+}
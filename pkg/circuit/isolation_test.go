@@ -0,0 +1,83 @@
+package circuit
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseIsolation(t *testing.T) {
+	tests := []struct {
+		spec      string
+		isolation Isolation
+		fails     bool
+	}{
+		{spec: "none", isolation: 0},
+		{spec: "", isolation: 0},
+		{spec: "auth,listener", isolation: DefaultIsolation},
+		{spec: " Host , PORT ", isolation: IsolateHost | IsolatePort},
+		{spec: "auth,host,port,listener", isolation: IsolateAuth | IsolateHost | IsolatePort | IsolateListener},
+		{spec: "none,port", isolation: IsolatePort},
+		{spec: "auth,dest", fails: true},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			isolation, err := ParseIsolation(test.spec)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("ParseIsolation accepted %q as %s", test.spec, isolation)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isolation != test.isolation {
+				t.Errorf("isolation = %s, want %s", isolation, test.isolation)
+			}
+
+			// String is read back as the same isolation
+			if again, err := ParseIsolation(isolation.String()); err != nil || again != isolation {
+				t.Errorf("ParseIsolation(%q) = %s, %v", isolation.String(), again, err)
+			}
+		})
+	}
+}
+
+func TestIsolationKeyCompatible(t *testing.T) {
+	base := IsolationKey{Auth: "alice:pw", Host: "example.com", Port: 443, Listener: "127.0.0.1:9050"}
+	tests := []struct {
+		name       string
+		other      func(IsolationKey) IsolationKey
+		isolation  Isolation
+		compatible bool
+	}{
+		{"same key", func(k IsolationKey) IsolationKey { return k }, IsolateAuth | IsolateHost | IsolatePort | IsolateListener, true},
+		{"other auth", func(k IsolationKey) IsolationKey { k.Auth = "bob:pw"; return k }, DefaultIsolation, false},
+		{"other auth unisolated", func(k IsolationKey) IsolationKey { k.Auth = "bob:pw"; return k }, IsolateHost, true},
+		{"other host", func(k IsolationKey) IsolationKey { k.Host = "example.org"; return k }, IsolateHost, false},
+		{"other host by default", func(k IsolationKey) IsolationKey { k.Host = "example.org"; return k }, DefaultIsolation, true},
+		{"other port", func(k IsolationKey) IsolationKey { k.Port = 80; return k }, IsolatePort, false},
+		{"other listener", func(k IsolationKey) IsolationKey { k.Listener = "127.0.0.1:9150"; return k }, DefaultIsolation, false},
+		{"other token", func(k IsolationKey) IsolationKey { k.Token = "alice"; return k }, 0, false},
+	}
+	for _, test := range tests {
+		other := test.other(base)
+		if got := base.compatible(other, test.isolation); got != test.compatible {
+			t.Errorf("%s: compatible = %v, want %v", test.name, got, test.compatible)
+		}
+		if got := other.compatible(base, test.isolation); got != test.compatible {
+			t.Errorf("%s: compatible is not symmetric", test.name)
+		}
+	}
+}
+
+func TestWithIsolationToken(t *testing.T) {
+	ctx := WithIsolation(context.Background(), IsolationKey{Host: "example.com"})
+	ctx = WithIsolationToken(ctx, "alice")
+	if key := IsolationFrom(ctx); key.Host != "example.com" || key.Token != "alice" {
+		t.Errorf("IsolationFrom = %+v", key)
+	}
+	if key := IsolationFrom(context.Background()); key != (IsolationKey{}) {
+		t.Errorf("IsolationFrom without a key = %+v", key)
+	}
+}
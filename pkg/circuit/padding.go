@@ -0,0 +1,58 @@
+package circuit
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"onion-network/pkg/message"
+	"onion-network/pkg/padding"
+)
+
+// startPadding negotiates the manager's padding for a newly built circuit:
+// link padding with the guard and a padding machine with the last hop
+func (cm *CircuitManager) startPadding(c *Circuit) {
+	config := cm.Padding
+
+	if config.Link {
+		if payload, err := json.Marshal(padding.LinkParams(config.LinkSchedule)); err == nil {
+			c.send(&message.OnionMessage{Type: message.LinkPaddingNegotiate, Payload: payload})
+		}
+		linkPadder := padding.NewLinkPadder(config.LinkSchedule, c.sendPadding)
+		c.mutex.Lock()
+		c.linkPadder = linkPadder
+		c.mutex.Unlock()
+	}
+
+	if machine, exists := padding.Machines[config.Machine]; exists {
+		c.SendControl(message.RelayPaddingNegotiate, []byte(machine.Name))
+		circuitPadder := padding.NewPadder(machine, func() error {
+			return c.sendRelay(&message.RelayCell{Command: message.RelayDrop})
+		})
+		c.mutex.Lock()
+		c.circuitPadder = circuitPadder
+		c.mutex.Unlock()
+	}
+
+	if c.IsClosed() {
+		linkPadder, circuitPadder := c.padders()
+		linkPadder.Stop()
+		circuitPadder.Stop()
+	}
+}
+
+// padders returns the link and circuit padders, either of which may be nil
+func (c *Circuit) padders() (*padding.Padder, *padding.Padder) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.linkPadder, c.circuitPadder
+}
+
+func (c *Circuit) handleLinkPaddingNegotiate(msg *message.OnionMessage) {
+	var params message.LinkPaddingParams
+	if err := json.Unmarshal(msg.Payload, &params); err != nil {
+		return
+	}
+	if params.Ack && !params.Enabled {
+		fmt.Printf("Circuit %s: guard declined link padding\n", c.ID)
+	}
+}
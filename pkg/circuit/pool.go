@@ -0,0 +1,206 @@
+package circuit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"onion-network/pkg/message"
+)
+
+const (
+	// MaxCircuitDirtiness is how long a circuit takes new streams after it
+	// was first used; it closes once its last stream ends after that
+	MaxCircuitDirtiness = 10 * time.Minute
+
+	// PredictionTime is how long a used port keeps circuits ready for it
+	PredictionTime = time.Hour
+
+	// MaxPoolSize caps the clean circuits kept ready
+	MaxPoolSize = 4
+
+	minPoolSize    = 2 // Clean circuits kept while any port is predicted
+	poolInterval   = time.Second
+	poolRetryDelay = 10 * time.Second
+)
+
+// PredictPort notes that a stream to port was just requested, so the pool
+// keeps clean circuits ready for the next one
+func (cm *CircuitManager) PredictPort(port int) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	cm.predictedPorts[port] = time.Now()
+}
+
+// countPredictedPorts returns how many ports were used within
+// PredictionTime, forgetting the others
+func (cm *CircuitManager) countPredictedPorts() int {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	for port, used := range cm.predictedPorts {
+		if time.Since(used) > PredictionTime {
+			delete(cm.predictedPorts, port)
+		}
+	}
+	return len(cm.predictedPorts)
+}
+
+// PoolTarget is how many clean circuits the pool keeps ready: none while
+// the client is idle, two as soon as any port is predicted, as Tor keeps
+// for each predicted port, and one more per further port up to MaxPoolSize
+func (cm *CircuitManager) PoolTarget() int {
+	ports := cm.countPredictedPorts()
+	switch {
+	case ports == 0:
+		return 0
+	case ports < minPoolSize:
+		return minPoolSize
+	case ports > MaxPoolSize:
+		return MaxPoolSize
+	default:
+		return ports
+	}
+}
+
+// RunPool builds circuits ahead of demand and retires dirty ones until ctx
+// is done. Like Tor, it starts out predicting port 80, so the first
+// request after startup finds a circuit ready.
+func (cm *CircuitManager) RunPool(ctx context.Context) {
+	cm.PredictPort(80)
+
+	ticker := time.NewTicker(poolInterval)
+	defer ticker.Stop()
+
+	var retryAt time.Time
+	for {
+		cm.expireDirty()
+
+		clean := 0
+		for _, c := range cm.ListCircuits() {
+			if !c.IsClosed() && !c.IsDirty() {
+				clean++
+			}
+		}
+
+		if clean < cm.PoolTarget() && time.Now().After(retryAt) {
+			if c, err := cm.CreateCircuitContext(ctx); err != nil {
+				fmt.Printf("Circuit pool: build failed, retrying in %v: %v\n", poolRetryDelay, err)
+				retryAt = time.Now().Add(poolRetryDelay)
+			} else {
+				fmt.Printf("Circuit pool: %s ready (%d of %d clean)\n", c.ID, clean+1, cm.PoolTarget())
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expireDirty closes circuits past MaxCircuitDirtiness once no streams use
+// them any more
+func (cm *CircuitManager) expireDirty() {
+	for _, c := range cm.ListCircuits() {
+		if c.IsClosed() || !c.dirtyFor(MaxCircuitDirtiness) || c.openStreams() > 0 {
+			continue
+		}
+
+		cm.mutex.Lock()
+		delete(cm.Circuits, c.ID)
+		cm.mutex.Unlock()
+		fmt.Printf("Circuit %s: dirty for %v, closing\n", c.ID, MaxCircuitDirtiness)
+		c.Destroy(message.DestroyFinished)
+	}
+}
+
+// IsDirty reports whether the circuit has been handed out for streams
+func (c *Circuit) IsDirty() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return !c.dirtySince.IsZero()
+}
+
+// DirtySince is when the circuit was first handed out, zero while clean
+func (c *Circuit) DirtySince() time.Time {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.dirtySince
+}
+
+// claim hands a clean circuit out to streams with the given key, reporting
+// whether they may use it. A circuit another caller claimed first is only
+// theirs to share if its key is compatible.
+func (c *Circuit) claim(key IsolationKey, isolation Isolation) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.dirtySince.IsZero() {
+		c.dirtySince = time.Now()
+		c.isolation = key
+		return true
+	}
+	return c.isolation.compatible(key, isolation)
+}
+
+// buildSlot serializes circuit builds among streams that could share a
+// circuit; users counts the callers holding or waiting for it
+type buildSlot struct {
+	ch    chan struct{}
+	users int
+}
+
+// acquireBuildSlot waits until no other caller with a compatible key is
+// choosing or building a circuit, returning the function that lets the
+// next one in
+func (cm *CircuitManager) acquireBuildSlot(ctx context.Context, key IsolationKey) (func(), error) {
+	key = key.isolatedBy(cm.Isolation)
+	cm.mutex.Lock()
+	slot, exists := cm.buildSlots[key]
+	if !exists {
+		slot = &buildSlot{ch: make(chan struct{}, 1)}
+		cm.buildSlots[key] = slot
+	}
+	slot.users++
+	cm.mutex.Unlock()
+
+	leave := func() {
+		cm.mutex.Lock()
+		defer cm.mutex.Unlock()
+		if slot.users--; slot.users == 0 {
+			delete(cm.buildSlots, key)
+		}
+	}
+
+	select {
+	case slot.ch <- struct{}{}:
+		return func() {
+			<-slot.ch
+			leave()
+		}, nil
+	case <-ctx.Done():
+		leave()
+		return nil, ctx.Err()
+	}
+}
+
+// Isolation is the key of the first stream the circuit was handed out for
+func (c *Circuit) Isolation() IsolationKey {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.isolation
+}
+
+// dirtyFor reports whether the circuit was first used at least d ago
+func (c *Circuit) dirtyFor(d time.Duration) bool {
+	since := c.DirtySince()
+	return !since.IsZero() && time.Since(since) >= d
+}
+
+func (c *Circuit) openStreams() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return len(c.streams) + len(c.resolves)
+}
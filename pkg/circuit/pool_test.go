@@ -0,0 +1,87 @@
+package circuit
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBuildSlotsByIsolationKey(t *testing.T) {
+	cm := NewCircuitManager("http://127.0.0.1:0")
+	held := IsolationKey{Auth: "alice", Listener: "socks"}
+	release, err := cm.acquireBuildSlot(context.Background(), held)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		key   IsolationKey
+		waits bool
+	}{
+		{"other credentials", IsolationKey{Auth: "bob", Listener: "socks"}, false},
+		{"other listener", IsolationKey{Auth: "alice", Listener: "http"}, false},
+		{"other token", IsolationKey{Auth: "alice", Listener: "socks", Token: "t"}, false},
+		{"same key", held, true},
+		{"other host only", IsolationKey{Auth: "alice", Host: "example.com", Listener: "socks"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			release, err := cm.acquireBuildSlot(ctx, test.key)
+			if test.waits {
+				if err == nil {
+					release()
+					t.Fatal("build slot taken while a compatible build holds it")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("waited for a build the key is isolated from: %v", err)
+			}
+			release()
+		})
+	}
+
+	release()
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	if len(cm.buildSlots) != 0 {
+		t.Errorf("%d build slots left after every caller released", len(cm.buildSlots))
+	}
+}
+
+func TestClaimKeepsIncompatibleKeysApart(t *testing.T) {
+	c := &Circuit{}
+	keys := []IsolationKey{{Auth: "alice"}, {Auth: "bob"}, {Auth: "carol"}, {Auth: "dave"}}
+
+	var wg sync.WaitGroup
+	claimed := make(chan IsolationKey, len(keys))
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key IsolationKey) {
+			defer wg.Done()
+			if c.claim(key, DefaultIsolation) {
+				claimed <- key
+			}
+		}(key)
+	}
+	wg.Wait()
+	close(claimed)
+
+	var winners []IsolationKey
+	for key := range claimed {
+		winners = append(winners, key)
+	}
+	if len(winners) != 1 {
+		t.Fatalf("%d incompatible keys claimed one circuit, want 1", len(winners))
+	}
+	if c.Isolation() != winners[0] {
+		t.Errorf("circuit isolated as %v, claimed by %v", c.Isolation(), winners[0])
+	}
+	if !c.claim(IsolationKey{Auth: winners[0].Auth, Host: "example.com"}, DefaultIsolation) {
+		t.Error("compatible key refused a claimed circuit")
+	}
+}
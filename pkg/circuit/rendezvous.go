@@ -0,0 +1,244 @@
+package circuit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"onion-network/pkg/crypto"
+	"onion-network/pkg/message"
+)
+
+// rendezvousHandshake is sealed under the end-to-end key by the service so
+// the client knows the joined circuit really ends at the service
+const rendezvousHandshake = "rendezvous"
+
+// IsOnionAddress reports whether host names an onion service
+func IsOnionAddress(host string) bool {
+	return strings.HasSuffix(strings.ToLower(host), ".onion")
+}
+
+// NodeInfoFromService converts a node named in a service message
+func NodeInfoFromService(node message.ServiceNode) NodeInfo {
+	return NodeInfo{ID: node.ID, Address: node.Address, Port: node.Port, PublicKey: node.PublicKey}
+}
+
+// ServiceNode is the form of a node used in service messages
+func (n NodeInfo) ServiceNode() message.ServiceNode {
+	return message.ServiceNode{ID: n.ID, Address: n.Address, Port: n.Port, PublicKey: n.PublicKey}
+}
+
+// RendezvousHandshake seals the proof a service sends back in Rendezvous1
+func RendezvousHandshake(key []byte) ([]byte, error) {
+	gcm, err := crypto.NewLayerCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.SealLayer(gcm, []byte(rendezvousHandshake))
+}
+
+// FetchDescriptor gets and verifies an onion service's descriptor
+func (cm *CircuitManager) FetchDescriptor(ctx context.Context, address string) (*message.ServiceDescriptor, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/hs/descriptors/%s", cm.DirectoryURL, address), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("no descriptor for %s", address)
+	}
+
+	var desc message.ServiceDescriptor
+	if err := json.NewDecoder(resp.Body).Decode(&desc); err != nil {
+		return nil, err
+	}
+	if desc.Address != address {
+		return nil, fmt.Errorf("descriptor is for %s, not %s", desc.Address, address)
+	}
+	if err := desc.Verify(); err != nil {
+		return nil, err
+	}
+	return &desc, nil
+}
+
+// ConnectService returns a circuit joined end to end with the onion service
+// at address, reusing an open one if there is one. Streams opened on it are
+// accepted by the service itself.
+func (cm *CircuitManager) ConnectService(ctx context.Context, address string) (*Circuit, error) {
+	address = strings.ToLower(address)
+
+	cm.mutex.RLock()
+	c, exists := cm.serviceCircuits[address]
+	cm.mutex.RUnlock()
+	if exists && !c.IsClosed() {
+		return c, nil
+	}
+
+	desc, err := cm.FetchDescriptor(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if desc.RequiresAuth() {
+		if cm.ClientAuthKey == nil {
+			return nil, fmt.Errorf("%s requires client authorization", address)
+		}
+		if desc.IntroPoints, err = desc.DecryptIntroPoints(cm.ClientAuthKey); err != nil {
+			return nil, err
+		}
+	}
+	if len(desc.IntroPoints) == 0 {
+		return nil, fmt.Errorf("%s has no introduction points", address)
+	}
+
+	c, err = cm.rendezvous(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+
+	cm.mutex.Lock()
+	if old, exists := cm.serviceCircuits[address]; exists {
+		old.Close()
+	}
+	cm.serviceCircuits[address] = c
+	cm.mutex.Unlock()
+
+	fmt.Printf("Connected to onion service %s via circuit %s\n", address, c.ID)
+	return c, nil
+}
+
+// rendezvous sets up a rendezvous point, asks the service to meet there
+// through one of its introduction points and waits for it to arrive
+func (cm *CircuitManager) rendezvous(ctx context.Context, desc *message.ServiceDescriptor) (*Circuit, error) {
+	nodes, err := cm.TargetNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var introIDs []string
+	for _, intro := range desc.IntroPoints {
+		introIDs = append(introIDs, intro.ID)
+	}
+	point, ok := firstExcept(nodes, introIDs...)
+	if !ok {
+		if point, ok = firstExcept(nodes); !ok {
+			return nil, errors.New("no node available as rendezvous point")
+		}
+	}
+
+	c, err := cm.CreateCircuitTo(ctx, point)
+	if err != nil {
+		return nil, err
+	}
+
+	cookie := make([]byte, message.CookieSize)
+	key := make([]byte, 32)
+	if _, err := rand.Read(cookie); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if _, err := rand.Read(key); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if err := c.SendControl(message.RelayEstablishRendezvous, cookie); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if _, err := c.WaitControl(ctx, message.RelayRendezvousEstablished); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("rendezvous point did not answer: %w", err)
+	}
+
+	data := message.IntroduceData{RendezvousPoint: point.ServiceNode(), Cookie: cookie, Key: key}
+	if desc.RequiresAuth() {
+		data.ClientKey = &cm.ClientAuthKey.PublicKey
+		if data.ClientSignature, err = crypto.Sign(cm.ClientAuthKey, message.IntroduceAuthData(desc.Address, cookie)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	intro, err := json.Marshal(&data)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	encrypted, err := crypto.EncryptForKey(intro, desc.PublicKey)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if err := cm.introduce(ctx, desc, encrypted); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	cell, err := c.WaitControl(ctx, message.RelayRendezvous2)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("service did not arrive at rendezvous: %w", err)
+	}
+
+	gcm, err := crypto.NewLayerCipher(key)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if handshake, err := crypto.OpenLayer(gcm, cell.Data); err != nil || string(handshake) != rendezvousHandshake {
+		c.Close()
+		return nil, errors.New("invalid rendezvous handshake")
+	}
+
+	if err := c.AddLayer(key, false); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// introduce delivers an introduction through the first introduction point
+// that accepts it
+func (cm *CircuitManager) introduce(ctx context.Context, desc *message.ServiceDescriptor, encrypted []byte) error {
+	data, err := json.Marshal(&message.Introduce1{ServiceAddress: desc.Address, Encrypted: encrypted})
+	if err != nil {
+		return err
+	}
+
+	lastErr := errors.New("no introduction point accepted")
+	for _, intro := range desc.IntroPoints {
+		c, err := cm.CreateCircuitTo(ctx, NodeInfoFromService(intro))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		err = c.SendControl(message.RelayIntroduce1, data)
+		var ack *message.RelayCell
+		if err == nil {
+			ack, err = c.WaitControl(ctx, message.RelayIntroduceAck)
+		}
+		c.Close()
+
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(ack.Data) == 1 && ack.Data[0] == message.IntroduceAckSuccess {
+			return nil
+		}
+		lastErr = fmt.Errorf("introduction point %s refused introduction", intro.ID)
+	}
+	return lastErr
+}
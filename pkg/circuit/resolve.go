@@ -0,0 +1,126 @@
+package circuit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"onion-network/pkg/message"
+)
+
+// ResolveError reports a name the exit could not resolve
+type ResolveError struct {
+	Name   string
+	Reason string
+}
+
+func (e *ResolveError) Error() string {
+	return fmt.Sprintf("resolving %s: %s", e.Name, e.Reason)
+}
+
+// dnsEntry is a cached exit answer, kept only for the life of its circuit
+// so lookups cannot link activity across circuits
+type dnsEntry struct {
+	answers []message.ResolvedAnswer
+	expires time.Time
+}
+
+// Resolve asks the circuit's exit for name's records of recordType
+// (message.RecordA, RecordAAAA, RecordPTR, or "" for both address types).
+// Answers are cached on the circuit until their TTL runs out.
+func (c *Circuit) Resolve(ctx context.Context, name, recordType string) ([]message.ResolvedAnswer, error) {
+	key := recordType + " " + strings.ToLower(name)
+
+	c.mutex.RLock()
+	entry, cached := c.dnsCache[key]
+	c.mutex.RUnlock()
+	if cached && time.Now().Before(entry.expires) {
+		return append([]message.ResolvedAnswer(nil), entry.answers...), nil
+	}
+
+	data, err := json.Marshal(&message.ResolveRequest{Name: name, Type: recordType})
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	if c.IsClosed() {
+		c.mutex.Unlock()
+		return nil, errCircuitClosed
+	}
+	id, err := c.allocStreamID()
+	if err != nil {
+		c.mutex.Unlock()
+		return nil, err
+	}
+	reply := make(chan []message.ResolvedAnswer, 1)
+	c.resolves[id] = reply
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.resolves, id)
+		c.mutex.Unlock()
+	}()
+
+	if err := c.sendRelay(&message.RelayCell{Command: message.RelayResolve, StreamID: id, Data: data}); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, StreamTimeout)
+	defer cancel()
+
+	var answers []message.ResolvedAnswer
+	select {
+	case answers = <-reply:
+	case <-c.closed:
+		return nil, errCircuitClosed
+	case <-ctx.Done():
+		return nil, fmt.Errorf("resolving %s: %w", name, ctx.Err())
+	}
+
+	if len(answers) == 0 || answers[0].Type == message.RecordError {
+		reason := "no records"
+		if len(answers) > 0 {
+			reason = answers[0].Value
+		}
+		return nil, &ResolveError{Name: name, Reason: reason}
+	}
+
+	ttl := answers[0].TTL
+	for _, answer := range answers {
+		if answer.TTL < ttl {
+			ttl = answer.TTL
+		}
+	}
+
+	c.mutex.Lock()
+	c.dnsCache[key] = dnsEntry{
+		answers: answers,
+		expires: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	c.mutex.Unlock()
+
+	return append([]message.ResolvedAnswer(nil), answers...), nil
+}
+
+func (c *Circuit) handleResolved(cell *message.RelayCell) {
+	c.mutex.RLock()
+	reply, pending := c.resolves[cell.StreamID]
+	c.mutex.RUnlock()
+	if !pending {
+		return
+	}
+
+	var answers []message.ResolvedAnswer
+	if err := json.Unmarshal(cell.Data, &answers); err != nil {
+		answers = []message.ResolvedAnswer{{Type: message.RecordError, Value: "invalid answer from exit"}}
+	}
+
+	select {
+	case reply <- answers:
+	default:
+	}
+}
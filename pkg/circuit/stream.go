@@ -0,0 +1,465 @@
+package circuit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"onion-network/pkg/message"
+)
+
+// StreamTimeout bounds how long the exit may take to connect a stream
+const StreamTimeout = 15 * time.Second
+
+// StreamError reports a stream the exit refused or closed
+type StreamError struct {
+	Reason byte
+}
+
+func (e *StreamError) Error() string {
+	return "stream closed by exit: " + message.EndReasonString(e.Reason)
+}
+
+// Stream is one TCP connection carried through a circuit's exit
+type Stream struct {
+	ID      uint16
+	Target  string
+	circuit *Circuit
+
+	incoming  chan []byte
+	pending   []byte
+	connected chan error
+	err       error
+	eof       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	endOnce   sync.Once
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+
+	// Flow control windows, guarded by the circuit's flowMutex
+	packageWindow int
+	deliverWindow int
+}
+
+// OpenStream asks the exit to connect to target ("host:port") and returns
+// the stream once it is connected
+func (c *Circuit) OpenStream(target string) (*Stream, error) {
+	return c.OpenStreamContext(context.Background(), target)
+}
+
+// OpenStreamContext is OpenStream bounded by ctx as well as StreamTimeout.
+// A stream abandoned because ctx ended is closed at the exit too.
+func (c *Circuit) OpenStreamContext(ctx context.Context, target string) (*Stream, error) {
+	ctx, cancel := context.WithTimeout(ctx, StreamTimeout)
+	defer cancel()
+
+	s, err := c.newStream(target)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.sendRelay(&message.RelayCell{Command: message.RelayBegin, StreamID: s.ID, Data: []byte(target)}); err != nil {
+		c.removeStream(s)
+		return nil, err
+	}
+
+	select {
+	case err := <-s.connected:
+		if err != nil {
+			c.removeStream(s)
+			return nil, err
+		}
+		return s, nil
+	case <-ctx.Done():
+		s.Close()
+		return nil, fmt.Errorf("connecting to %s: %w", target, ctx.Err())
+	}
+}
+
+func (c *Circuit) newStream(target string) (*Stream, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.IsClosed() {
+		return nil, errCircuitClosed
+	}
+
+	id, err := c.allocStreamID()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Stream{
+		ID:            id,
+		Target:        target,
+		circuit:       c,
+		incoming:      make(chan []byte, message.StreamWindow),
+		connected:     make(chan error, 1),
+		eof:           make(chan struct{}),
+		done:          make(chan struct{}),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		packageWindow: message.StreamWindow,
+		deliverWindow: message.StreamWindow,
+	}
+	c.streams[s.ID] = s
+	return s, nil
+}
+
+// allocStreamID picks an ID not used by a stream or a pending resolve.
+// Stream IDs are per circuit; zero is reserved for circuit-level cells.
+// The caller holds c.mutex.
+func (c *Circuit) allocStreamID() (uint16, error) {
+	for i := 0; i < 1<<16; i++ {
+		c.nextStream++
+		if c.nextStream == 0 {
+			continue
+		}
+		if _, used := c.streams[c.nextStream]; used {
+			continue
+		}
+		if _, used := c.resolves[c.nextStream]; used {
+			continue
+		}
+		return c.nextStream, nil
+	}
+	return 0, errors.New("no free stream IDs on circuit")
+}
+
+func (c *Circuit) removeStream(s *Stream) {
+	c.mutex.Lock()
+	if c.streams[s.ID] == s {
+		delete(c.streams, s.ID)
+	}
+	c.mutex.Unlock()
+}
+
+// handleRelayCell delivers a cell from the exit to its stream
+func (c *Circuit) handleRelayCell(cell *message.RelayCell) {
+	if cell.Command == message.RelayDrop {
+		c.CircuitPadding.PaddingReceived.Add(1)
+		return
+	}
+	c.CircuitPadding.RealReceived.Add(1)
+
+	switch cell.Command {
+	case message.RelayPaddingNegotiated:
+		if len(cell.Data) != 1 || cell.Data[0] != message.PaddingNegotiateOK {
+			fmt.Printf("Circuit %s: last hop refused circuit padding\n", c.ID)
+		}
+		return
+	case message.RelayResolved:
+		c.handleResolved(cell)
+		return
+	case message.RelayBegin:
+		c.handleBegin(cell)
+		return
+	case message.RelaySendme:
+		c.handleSendme(cell)
+		return
+	case message.RelayData:
+		if !c.receiveCircuitCell() {
+			return
+		}
+	case message.RelayConnected, message.RelayEnd:
+	default:
+		select {
+		case c.control <- cell:
+		default:
+			fmt.Printf("Circuit %s: dropping control cell %d\n", c.ID, cell.Command)
+		}
+		return
+	}
+
+	c.mutex.RLock()
+	s, exists := c.streams[cell.StreamID]
+	c.mutex.RUnlock()
+	if !exists {
+		if cell.Command == message.RelayData {
+			c.dropData()
+		}
+		return
+	}
+
+	switch cell.Command {
+	case message.RelayConnected:
+		select {
+		case s.connected <- nil:
+		default:
+		}
+	case message.RelayData:
+		// The stream window bounds what the far end may have in flight, so
+		// a full buffer means it ignored the window
+		if !s.buffer(cell.Data) {
+			fmt.Printf("Circuit %s: stream %d overran its window\n", c.ID, s.ID)
+			c.Destroy(message.DestroyProtocol)
+		}
+	case message.RelayEnd:
+		reason := message.EndReasonMisc
+		if len(cell.Data) > 0 {
+			reason = cell.Data[0]
+		}
+		c.removeStream(s)
+		if reason == message.EndReasonDone {
+			s.remoteClosed(nil)
+		} else {
+			s.remoteClosed(&StreamError{Reason: reason})
+		}
+	}
+}
+
+// SetStreamHandler accepts streams opened by the far end of a rendezvous
+// circuit. handler runs in its own goroutine and must Accept or Reject.
+func (c *Circuit) SetStreamHandler(handler func(*Stream)) {
+	c.mutex.Lock()
+	c.onStream = handler
+	c.mutex.Unlock()
+}
+
+func (c *Circuit) handleBegin(cell *message.RelayCell) {
+	c.mutex.Lock()
+	handler := c.onStream
+	_, used := c.streams[cell.StreamID]
+	if handler == nil || used || cell.StreamID == 0 {
+		c.mutex.Unlock()
+		c.sendRelay(&message.RelayCell{Command: message.RelayEnd, StreamID: cell.StreamID, Data: []byte{message.EndReasonExitPolicy}})
+		return
+	}
+
+	s := &Stream{
+		ID:            cell.StreamID,
+		Target:        string(cell.Data),
+		circuit:       c,
+		incoming:      make(chan []byte, message.StreamWindow),
+		connected:     make(chan error, 1),
+		eof:           make(chan struct{}),
+		done:          make(chan struct{}),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		packageWindow: message.StreamWindow,
+		deliverWindow: message.StreamWindow,
+	}
+	c.streams[s.ID] = s
+	c.mutex.Unlock()
+
+	go handler(s)
+}
+
+// Accept tells the peer that opened the stream it is connected
+func (s *Stream) Accept() error {
+	return s.circuit.sendRelay(&message.RelayCell{Command: message.RelayConnected, StreamID: s.ID})
+}
+
+// Reject refuses a stream opened by the peer
+func (s *Stream) Reject(reason byte) error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.circuit.removeStream(s)
+		s.discard()
+		err = s.circuit.sendRelay(&message.RelayCell{Command: message.RelayEnd, StreamID: s.ID, Data: []byte{reason}})
+	})
+	return err
+}
+
+// remoteClosed ends the stream from the circuit side; data already
+// delivered can still be read before the end is reported
+func (s *Stream) remoteClosed(err error) {
+	s.endOnce.Do(func() {
+		s.err = err
+		select {
+		case s.connected <- err:
+		default:
+		}
+		close(s.eof)
+	})
+}
+
+func (s *Stream) Read(b []byte) (int, error) {
+	if len(s.pending) == 0 {
+		select {
+		case data := <-s.incoming:
+			s.pending = data
+			s.delivered()
+		case <-s.eof:
+			select {
+			case data := <-s.incoming:
+				s.pending = data
+				s.delivered()
+			default:
+				if s.err != nil {
+					return 0, s.err
+				}
+				return 0, io.EOF
+			}
+		case <-s.done:
+			return 0, net.ErrClosed
+		case <-s.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		select {
+		case <-s.done:
+			return written, net.ErrClosed
+		case <-s.writeDeadline.wait():
+			return written, os.ErrDeadlineExceeded
+		default:
+		}
+		if err := s.reservePackage(); err != nil {
+			return written, err
+		}
+
+		chunk := b[written:]
+		if len(chunk) > message.MaxRelayData {
+			chunk = chunk[:message.MaxRelayData]
+		}
+
+		cell := &message.RelayCell{Command: message.RelayData, StreamID: s.ID, Data: chunk}
+		if err := s.circuit.sendRelay(cell); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// Close ends the stream and tells the exit to close its connection
+func (s *Stream) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.circuit.removeStream(s)
+		s.discard()
+		err = s.circuit.sendRelay(&message.RelayCell{
+			Command:  message.RelayEnd,
+			StreamID: s.ID,
+			Data:     []byte{message.EndReasonDone},
+		})
+		if err == errCircuitClosed {
+			err = nil
+		}
+	})
+	return err
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return streamAddr(s.circuit.ID)
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return streamAddr(s.Target)
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
+
+type streamAddr string
+
+func (a streamAddr) Network() string { return "onion" }
+func (a streamAddr) String() string  { return string(a) }
+
+// deadline is a resettable timer whose channel closes once it passes
+type deadline struct {
+	mutex  sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // Wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(dur, func() {
+			close(d.cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// Splice copies between a local connection and a stream until either side
+// finishes, then closes both
+func Splice(conn net.Conn, stream net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(stream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, stream)
+		done <- struct{}{}
+	}()
+
+	<-done
+	conn.Close()
+	stream.Close()
+	<-done
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"onion-network/pkg/node"
+	"onion-network/pkg/transport"
+)
+
+// bridgeLine waits for the directory to hand out a bridge line for the
+// transport
+func bridgeLine(t *testing.T, directoryURL, transportName string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(directoryURL + "/bridges?transport=" + transportName)
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if line := strings.TrimSpace(string(body)); resp.StatusCode == http.StatusOK && line != "" {
+				return strings.Split(line, "\n")[0]
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("directory handed out no %s bridge", transportName)
+	return ""
+}
+
+func TestFetchThroughUnlistedBridge(t *testing.T) {
+	directoryURL := startNetwork(t)
+	bridge := startNode(t, directoryURL, node.Bridge, func(n *node.Node) {
+		obfs, err := transport.New("obfs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.Transport = obfs
+	})
+	line := bridgeLine(t, directoryURL, "obfs")
+
+	resp, err := http.Get(directoryURL + "/nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []struct{ ID string }
+	err = json.NewDecoder(resp.Body).Decode(&listed)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range listed {
+		if n.ID == bridge.ID {
+			t.Fatal("the directory lists the bridge among its nodes")
+		}
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer target.Close()
+
+	dialer := NewDialer(directoryURL)
+	defer destroyCircuits(dialer.CircuitManager)
+	if err := dialer.CircuitManager.AddBridge(line); err != nil {
+		t.Fatalf("bridge line %q: %v", line, err)
+	}
+	client := &http.Client{Transport: dialer.RoundTripper()}
+
+	resp, err = client.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Fatalf("got %q through the bridge", body)
+	}
+
+	circuits := dialer.CircuitManager.ListCircuits()
+	if len(circuits) == 0 {
+		t.Fatal("no circuit was built")
+	}
+	for _, c := range circuits {
+		if c.Nodes[0].ID != bridge.ID {
+			t.Errorf("circuit %s entered through %s, not the bridge", c.ID, c.Nodes[0].ID)
+		}
+	}
+}
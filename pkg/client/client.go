@@ -2,25 +2,32 @@ package client
 
 import (
 	"bufio"
-	"crypto/rsa"
+	"context"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	neturl "net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 	
 	"onion-network/pkg/circuit"
-	"onion-network/pkg/crypto"
+	"onion-network/pkg/message"
 )
 
 type OnionClient struct {
 	CircuitManager *circuit.CircuitManager
+	Dialer         *Dialer
 	DirectoryURL   string
 }
 
 func NewOnionClient(directoryURL string) *OnionClient {
+	dialer := NewDialer(directoryURL)
 	return &OnionClient{
-		CircuitManager: circuit.NewCircuitManager(directoryURL),
+		CircuitManager: dialer.CircuitManager,
+		Dialer:         dialer,
 		DirectoryURL:   directoryURL,
 	}
 }
@@ -30,6 +37,7 @@ func (oc *OnionClient) Start() error {
 	fmt.Println("Commands:")
 	fmt.Println("  create - Create a new circuit")
 	fmt.Println("  request <url> - Make anonymous request")
+	fmt.Println("  resolve <name> - Resolve a name (or an IP, in reverse) at the exit")
 	fmt.Println("  circuits - List active circuits")
 	fmt.Println("  quit - Exit client")
 	
@@ -65,6 +73,12 @@ func (oc *OnionClient) Start() error {
 				url := parts[1]
 				oc.handleRequest(url)
 			}
+		case "resolve":
+			if len(parts) < 2 {
+				fmt.Println("Usage: resolve <name>")
+				continue
+			}
+			oc.handleResolve(parts[1])
 		case "circuits":
 			oc.handleListCircuits()
 		case "quit":
@@ -90,31 +104,19 @@ func (oc *OnionClient) handleCreateCircuit() {
 }
 
 func (oc *OnionClient) handleRequest(url string) {
-	// Get first available circuit
-	circuits := oc.CircuitManager.Circuits
-	if len(circuits) == 0 {
-		fmt.Println("No circuits available. Create one first.")
-		return
+	if port, ok := urlPort(url); ok {
+		oc.CircuitManager.PredictPort(port)
 	}
 	
-	var selectedCircuit *circuit.Circuit
-	for _, c := range circuits {
-		selectedCircuit = c
-		break
+	// Take a circuit from the pool, building one only if none is ready
+	selectedCircuit, err := oc.CircuitManager.GetOrCreateCircuit()
+	if err != nil {
+		fmt.Printf("❌ No circuit available: %v\n", err)
+		return
 	}
 	
 	fmt.Printf("Making request to %s via circuit %s\n", url, selectedCircuit.ID)
 	
-	
-	// Create onion layers for encryption
-	nodeKeys := make([]*rsa.PublicKey, len(selectedCircuit.Nodes))
-	nodeIDs := make([]string, len(selectedCircuit.Nodes))
-	
-	for i, node := range selectedCircuit.Nodes {
-		nodeKeys[i] = node.PublicKey
-		nodeIDs[i] = node.ID
-	}
-	
 	// Actually send request through circuit
 	fmt.Printf("Sending request through circuit:\n")
 	fmt.Printf("  Guard: %s:%d\n", selectedCircuit.Nodes[0].Address, selectedCircuit.Nodes[0].Port)
@@ -122,79 +124,109 @@ func (oc *OnionClient) handleRequest(url string) {
 	fmt.Printf("  Exit: %s:%d\n", selectedCircuit.Nodes[2].Address, selectedCircuit.Nodes[2].Port)
 	fmt.Printf("  Final destination: %s\n", url)
 	
-	// Create request data
-	requestData := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", url, extractHost(url))
+	// The exit only ever sees a TCP stream; TLS for https runs end to end
+	fmt.Printf("🧅 Opening stream through %d onion layers...\n", len(selectedCircuit.Nodes))
+	httpClient := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: circuitTransport(selectedCircuit),
+	}
 	
-	// Create REAL onion layers
-	fmt.Printf("🧅 Creating onion encryption layers...\n")
-	layers, err := crypto.CreateOnionLayers(nodeKeys, nodeIDs)
+	resp, err := httpClient.Get(url)
 	if err != nil {
-		fmt.Printf("❌ Failed to create onion layers: %v\n", err)
+		fmt.Printf("❌ Request failed: %v\n", err)
 		return
 	}
+	defer resp.Body.Close()
 	
-	// Encrypt with onion layers
-	fmt.Printf("🔒 Encrypting request with %d layers...\n", len(layers))
-	encryptedPacket, err := crypto.EncryptOnion([]byte(requestData), layers)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Printf("❌ Failed to encrypt request: %v\n", err)
+		fmt.Printf("❌ Failed to read response: %v\n", err)
 		return
 	}
 	
-	fmt.Printf("📦 Encrypted packet size: %d bytes\n", len(encryptedPacket.Data))
+	fmt.Printf("✅ SUCCESS! Got %d bytes from %s\n", len(body), url)
+	fmt.Printf("📊 Response Status: %s\n", resp.Status)
+	fmt.Printf("📋 Response Preview: %.200s...\n", string(body))
+}
+
+func (oc *OnionClient) handleResolve(name string) {
+	c, err := oc.CircuitManager.GetOrCreateCircuit()
+	if err != nil {
+		fmt.Printf("❌ No circuit available: %v\n", err)
+		return
+	}
 	
-	// Send encrypted packet to guard node
-	if err := oc.sendThroughCircuit(encryptedPacket.Data, selectedCircuit); err != nil {
-		fmt.Printf("❌ Failed to send request: %v\n", err)
-	} else {
-		fmt.Printf("✅ Encrypted request sent successfully!\n")
+	recordType := ""
+	if net.ParseIP(name) != nil {
+		recordType = message.RecordPTR
+	}
+	
+	fmt.Printf("🔎 Resolving %s at the exit of circuit %s\n", name, c.ID)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	
+	answers, err := c.Resolve(ctx, name, recordType)
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+	
+	for _, answer := range answers {
+		fmt.Printf("  %-4s %s (ttl %ds)\n", answer.Type, answer.Value, answer.TTL)
 	}
 }
 
 func (oc *OnionClient) handleListCircuits() {
-	circuits := oc.CircuitManager.Circuits
+	circuits := oc.CircuitManager.ListCircuits()
 	if len(circuits) == 0 {
 		fmt.Println("No active circuits")
 		return
 	}
 	
 	fmt.Println("Active circuits:")
+	fmt.Printf("  build timeout: %s\n", oc.CircuitManager.BuildTimes)
+	fmt.Printf("  pool target: %d clean, isolating by %s\n", oc.CircuitManager.PoolTarget(), oc.CircuitManager.Isolation)
 	for _, c := range circuits {
-		fmt.Printf("  %s: %s -> %s -> %s\n", 
-			c.ID, c.Nodes[0].ID, c.Nodes[1].ID, c.Nodes[2].ID)
+		state := "clean"
+		if c.IsDirty() {
+			state = fmt.Sprintf("dirty for %v", time.Since(c.DirtySince()).Round(time.Second))
+			if key := c.Isolation().String(); key != "" {
+				state += ", isolated to " + key
+			}
+		}
+		fmt.Printf("  %s: %s -> %s -> %s (%s)\n", 
+			c.ID, c.Nodes[0].ID, c.Nodes[1].ID, c.Nodes[2].ID, state)
+		fmt.Printf("    link padding: %s\n", &c.LinkPadding)
+		fmt.Printf("    circuit padding: %s\n", &c.CircuitPadding)
+		fmt.Printf("    congestion: %s\n", c.Congestion())
 	}
 }
 
-func (oc *OnionClient) sendThroughCircuit(data []byte, circuit *circuit.Circuit) error {
-	// Connect to guard node - use real Azure IP
-	guardAddr := "172.201.12.43:8080" // Guard node in Europe
-	conn, err := net.DialTimeout("tcp", guardAddr, 10*time.Second)
+// urlPort returns the port a request to rawURL connects to
+func urlPort(rawURL string) (int, bool) {
+	u, err := neturl.Parse(rawURL)
 	if err != nil {
-		return fmt.Errorf("failed to connect to guard node: %v", err)
+		return 0, false
 	}
-	defer conn.Close()
-	
-	// Send encrypted data
-	_, err = conn.Write(data)
-	if err != nil {
-		return fmt.Errorf("failed to send data: %v", err)
+	if u.Port() != "" {
+		port, err := strconv.Atoi(u.Port())
+		return port, err == nil
 	}
-	
-	return nil
+	switch u.Scheme {
+	case "https":
+		return 443, true
+	case "http":
+		return 80, true
+	}
+	return 0, false
 }
 
-func extractHost(url string) string {
-	// Simple URL parsing - extract hostname
-	if len(url) > 8 && url[:8] == "https://" {
-		url = url[8:]
-	} else if len(url) > 7 && url[:7] == "http://" {
-		url = url[7:]
+// circuitTransport sends HTTP requests over streams on the given circuit
+func circuitTransport(c *circuit.Circuit) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return c.OpenStream(addr)
+		},
+		DisableKeepAlives: true,
 	}
-	
-	for i, char := range url {
-		if char == '/' || char == ':' {
-			return url[:i]
-		}
-	}
-	return url
-}
\ No newline at end of file
+}
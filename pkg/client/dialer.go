@@ -0,0 +1,138 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"onion-network/pkg/circuit"
+	"onion-network/pkg/message"
+)
+
+// Dialer opens TCP connections through the onion network. It can be used
+// wherever a net.Dialer's DialContext is expected.
+type Dialer struct {
+	CircuitManager *circuit.CircuitManager
+}
+
+// NewDialer returns a Dialer with its own circuits, built from the nodes
+// listed by the directory at directoryURL
+func NewDialer(directoryURL string) *Dialer {
+	return &Dialer{CircuitManager: circuit.NewCircuitManager(directoryURL)}
+}
+
+// Dial connects to addr ("host:port") through a managed circuit. Hostnames
+// are resolved by the exit; ".onion" hosts are reached through a rendezvous
+// with the service. ctx bounds building a circuit and opening the
+// stream; once connected, the connection's own deadlines apply. Streams
+// are kept apart as ctx's isolation key and the manager's Isolation say.
+func (d *Dialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	var c *circuit.Circuit
+	if circuit.IsOnionAddress(host) {
+		c, err = d.CircuitManager.ConnectService(ctx, host)
+	} else {
+		key := circuit.IsolationFrom(ctx)
+		key.Host = host
+		if port, err := strconv.Atoi(portString); err == nil {
+			d.CircuitManager.PredictPort(port)
+			key.Port = port
+		}
+		c, err = d.CircuitManager.GetOrCreateCircuitContext(circuit.WithIsolation(ctx, key))
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	stream, err := c.OpenStreamContext(ctx, addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	return stream, nil
+}
+
+// DialContext is Dial under the name used by net.Dialer and http.Transport
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.Dial(ctx, network, addr)
+}
+
+// LookupIP resolves host's A and AAAA records at the exit of a managed
+// circuit; the name never reaches the local resolver
+func (d *Dialer) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if circuit.IsOnionAddress(host) {
+		return nil, &net.DNSError{Err: "onion addresses have no IP", Name: host}
+	}
+
+	c, err := d.CircuitManager.GetOrCreateCircuitContext(withHost(ctx, host))
+	if err != nil {
+		return nil, err
+	}
+
+	answers, err := c.Resolve(ctx, host, "")
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(answers))
+	for _, answer := range answers {
+		if ip := net.ParseIP(answer.Value); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// LookupAddr performs a reverse (PTR) lookup of addr at the exit of a
+// managed circuit
+func (d *Dialer) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	c, err := d.CircuitManager.GetOrCreateCircuitContext(withHost(ctx, addr))
+	if err != nil {
+		return nil, err
+	}
+
+	answers, err := c.Resolve(ctx, addr, message.RecordPTR)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(answers))
+	for _, answer := range answers {
+		names = append(names, answer.Value)
+	}
+	return names, nil
+}
+
+// withHost adds the host a lookup is for to ctx's isolation key
+func withHost(ctx context.Context, host string) context.Context {
+	key := circuit.IsolationFrom(ctx)
+	key.Host = host
+	return circuit.WithIsolation(ctx, key)
+}
+
+// RoundTripper returns an http.RoundTripper that sends every request through
+// the onion network. TLS is negotiated end to end with the destination; the
+// exit only relays the encrypted stream. Connections are not kept alive,
+// since http.Transport would reuse one for a request with another
+// isolation key, on a circuit that key must not share.
+func (d *Dialer) RoundTripper() http.RoundTripper {
+	return &http.Transport{
+		DialContext:         d.Dial,
+		DisableKeepAlives:   true,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"onion-network/pkg/circuit"
+)
+
+func TestRoundTripperIsolatesTokens(t *testing.T) {
+	directoryURL := startNetwork(t)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer target.Close()
+
+	dialer := NewDialer(directoryURL)
+	defer destroyCircuits(dialer.CircuitManager)
+	client := &http.Client{Transport: dialer.RoundTripper()}
+
+	for _, token := range []string{"alice", "bob"} {
+		ctx := circuit.WithIsolationToken(context.Background(), token)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request for %s: %v", token, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "ok" {
+			t.Fatalf("request for %s got %q", token, body)
+		}
+	}
+
+	circuits := make(map[string]*circuit.Circuit)
+	for _, c := range dialer.CircuitManager.ListCircuits() {
+		if token := c.Isolation().Token; token != "" {
+			if other, ok := circuits[token]; ok && other != c {
+				t.Errorf("token %s used two circuits", token)
+			}
+			circuits[token] = c
+		}
+	}
+	if circuits["alice"] == nil || circuits["bob"] == nil {
+		t.Fatalf("want a circuit for each token, got %d", len(circuits))
+	}
+	if circuits["alice"] == circuits["bob"] {
+		t.Fatal("requests with different tokens shared a circuit")
+	}
+}
+
+func TestConcurrentBuildsGetTheirOwnCircuits(t *testing.T) {
+	directoryURL := startNetwork(t)
+	cm := circuit.NewCircuitManager(directoryURL)
+	defer destroyCircuits(cm)
+
+	tokens := []string{"alice", "bob", "carol", "dave"}
+	got := make([]*circuit.Circuit, len(tokens))
+	errs := make(chan error, len(tokens))
+	for i, token := range tokens {
+		go func(i int, token string) {
+			ctx, cancel := context.WithTimeout(circuit.WithIsolationToken(context.Background(), token), 30*time.Second)
+			defer cancel()
+			var err error
+			got[i], err = cm.GetOrCreateCircuitContext(ctx)
+			errs <- err
+		}(i, token)
+	}
+	for range tokens {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, c := range got {
+		if token := c.Isolation().Token; token != tokens[i] {
+			t.Errorf("%s was handed a circuit claimed for %q", tokens[i], token)
+		}
+	}
+	// Every build went to the caller that started it
+	if n := len(cm.ListCircuits()); n != len(tokens) {
+		t.Errorf("%d circuits built for %d callers", n, len(tokens))
+	}
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"onion-network/pkg/circuit"
+	"onion-network/pkg/message"
+)
+
+// Hop-by-hop headers are meaningful only between the client and this
+// proxy and must not be forwarded (RFC 7230 section 6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type httpProxy struct {
+	client    *OnionClient
+	transport *http.Transport
+	listener  string // Isolates this listener's streams from other listeners'
+}
+
+// ServeHTTPProxy accepts HTTP proxy requests on addr. Absolute-URI requests
+// are forwarded and CONNECT requests become tunnels, each carried as a
+// stream on a managed circuit.
+func (oc *OnionClient) ServeHTTPProxy(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	proxy := &httpProxy{
+		client:   oc,
+		listener: "http:" + listener.Addr().String(),
+		// Not kept alive, so one proxy client's request never reuses a
+		// connection on a circuit isolated to another
+		transport: &http.Transport{
+			DialContext:       oc.Dialer.Dial,
+			DisableKeepAlives: true,
+		},
+	}
+
+	fmt.Printf("HTTP proxy listening on %s\n", listener.Addr())
+	server := &http.Server{
+		Handler:           proxy,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	return server.Serve(listener)
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.handleConnect(w, r)
+		return
+	}
+
+	if !r.URL.IsAbs() {
+		http.Error(w, "This is an onion proxy; requests must use an absolute URI", http.StatusBadRequest)
+		return
+	}
+
+	p.handleForward(w, r)
+}
+
+// isolate attaches this listener to the isolation key of a request's streams
+func (p *httpProxy) isolate(ctx context.Context) context.Context {
+	return circuit.WithIsolation(ctx, circuit.IsolationKey{Listener: p.listener})
+}
+
+// handleForward relays an absolute-URI request through a circuit
+func (p *httpProxy) handleForward(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("HTTP proxy: %s %s\n", r.Method, r.URL)
+
+	outReq := r.Clone(p.isolate(r.Context()))
+	outReq.RequestURI = ""
+	removeHopHeaders(outReq.Header)
+
+	resp, err := p.transport.RoundTrip(outReq)
+	if err != nil {
+		fmt.Printf("HTTP proxy: request to %s failed: %v\n", r.URL.Host, err)
+		http.Error(w, err.Error(), httpStatusFor(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// handleConnect opens a tunnel to host:port and splices the client's
+// connection onto it
+func (p *httpProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("HTTP proxy: CONNECT %s\n", r.Host)
+
+	stream, err := p.client.Dialer.Dial(p.isolate(r.Context()), "tcp", r.Host)
+	if err != nil {
+		fmt.Printf("HTTP proxy: tunnel to %s failed: %v\n", r.Host, err)
+		http.Error(w, err.Error(), httpStatusFor(err))
+		return
+	}
+	defer stream.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Tunneling not supported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+
+	// The client may have sent tunnel data along with its CONNECT request
+	if pending := buffered.Reader.Buffered(); pending > 0 {
+		data, _ := buffered.Reader.Peek(pending)
+		if _, err := stream.Write(data); err != nil {
+			return
+		}
+	}
+
+	circuit.Splice(conn, stream)
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// httpStatusFor maps why a stream could not be opened to a proxy status
+func httpStatusFor(err error) int {
+	var streamErr *circuit.StreamError
+	if !errors.As(err, &streamErr) {
+		return http.StatusBadGateway
+	}
+
+	switch streamErr.Reason {
+	case message.EndReasonExitPolicy:
+		return http.StatusForbidden
+	case message.EndReasonTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"onion-network/pkg/circuit"
+	"onion-network/pkg/directory"
+	"onion-network/pkg/node"
+)
+
+// startNetwork runs a directory with a guard, a middle and an exit on
+// loopback until the test ends, and returns the directory's URL
+func startNetwork(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("starts a network of nodes")
+	}
+
+	dir := httptest.NewServer(directory.NewDirectoryServer(0).Handler())
+	t.Cleanup(dir.Close)
+
+	// No roles makes a middle only
+	for _, roles := range []node.Role{node.Guard, 0, node.Exit} {
+		startNode(t, dir.URL, roles, nil)
+	}
+	return dir.URL
+}
+
+// startNode runs a node with roles on loopback until the test ends,
+// letting configure change it before it starts
+func startNode(t *testing.T, directoryURL string, roles node.Role, configure func(*node.Node)) *node.Node {
+	t.Helper()
+	port := freePort(t)
+	n, err := node.NewNode(roles, "127.0.0.1", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.DirectoryURL = directoryURL
+	n.ListenAddress = "127.0.0.1"
+	n.ShutdownDrain = 0
+	if configure != nil {
+		configure(n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitListening(t, port)
+	return n
+}
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func waitListening(t *testing.T, port int) {
+	addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(port))
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("node on port %d did not start", port)
+}
+
+func destroyCircuits(cm *circuit.CircuitManager) {
+	for _, c := range cm.ListCircuits() {
+		cm.DestroyCircuit(c.ID)
+	}
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"onion-network/pkg/circuit"
+	"onion-network/pkg/service"
+)
+
+// startService runs an onion service on the network forwarding to a local
+// web server, letting only authorized keys in if any are given, and
+// returns its address once its descriptor is published
+func startService(t *testing.T, directoryURL string, authorized ...*rsa.PublicKey) string {
+	t.Helper()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello from the service")
+	}))
+	t.Cleanup(target.Close)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := service.NewOnionService(directoryURL, key, strings.TrimPrefix(target.URL, "http://"))
+	svc.NumIntroPoints = 2
+	svc.AuthorizedClients = authorized
+	go svc.Start()
+
+	cm := circuit.NewCircuitManager(directoryURL)
+	for deadline := time.Now().Add(60 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+		if _, err := cm.FetchDescriptor(context.Background(), svc.Address); err == nil {
+			return svc.Address
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("service descriptor not published")
+		}
+	}
+}
+
+// getOnion fetches the service's page through dialer
+func getOnion(dialer *Dialer, address string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+address+"/", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := (&http.Client{Transport: dialer.RoundTripper()}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestOnionServiceRoundTrip(t *testing.T) {
+	directoryURL := startNetwork(t)
+	address := startService(t, directoryURL)
+
+	dialer := NewDialer(directoryURL)
+	defer destroyCircuits(dialer.CircuitManager)
+	body, err := getOnion(dialer, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "hello from the service" {
+		t.Fatalf("got %q", body)
+	}
+}
+
+func TestOnionServiceClientAuthorization(t *testing.T) {
+	directoryURL := startNetwork(t)
+	authorized, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := startService(t, directoryURL, &authorized.PublicKey)
+
+	tests := []struct {
+		name    string
+		key     *rsa.PrivateKey
+		reaches bool
+	}{
+		{"authorized client", authorized, true},
+		{"client without a key", nil, false},
+		{"client with another key", other, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dialer := NewDialer(directoryURL)
+			defer destroyCircuits(dialer.CircuitManager)
+			dialer.CircuitManager.ClientAuthKey = test.key
+
+			body, err := getOnion(dialer, address)
+			if test.reaches && (err != nil || body != "hello from the service") {
+				t.Fatalf("got %q, %v", body, err)
+			}
+			if !test.reaches && err == nil {
+				t.Fatalf("unauthorized client got %q", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"onion-network/pkg/circuit"
+	"onion-network/pkg/message"
+)
+
+// SOCKS5 protocol constants (RFC 1928)
+const (
+	socksVersion = 0x05
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xFF
+
+	// Username/password subnegotiation (RFC 1929)
+	socksPasswordVersion = 0x01
+	socksPasswordSuccess = 0x00
+
+	socksCmdConnect = 0x01
+
+	// Tor's extensions for resolving names through the proxy
+	socksCmdResolve    = 0xF0
+	socksCmdResolvePTR = 0xF1
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksGeneralFailure      = 0x01
+	socksNotAllowed          = 0x02
+	socksHostUnreachable     = 0x04
+	socksConnectionRefused   = 0x05
+	socksTTLExpired          = 0x06
+	socksCmdNotSupported     = 0x07
+	socksAddrTypeUnsupported = 0x08
+)
+
+// socksHandshakeTimeout bounds how long a SOCKS client may take to send
+// its greeting and request
+const socksHandshakeTimeout = 30 * time.Second
+
+// ServeSOCKS accepts SOCKS5 connections on addr and carries each one as a
+// stream on a managed circuit. Hostnames are passed to the exit unresolved.
+func (oc *OnionClient) ServeSOCKS(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	fmt.Printf("SOCKS5 proxy listening on %s\n", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go oc.handleSOCKS(conn, "socks:"+listener.Addr().String())
+	}
+}
+
+func (oc *OnionClient) handleSOCKS(conn net.Conn, listener string) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	auth, err := socksNegotiateAuth(conn)
+	if err != nil {
+		fmt.Printf("SOCKS: handshake failed: %v\n", err)
+		return
+	}
+	ctx := circuit.WithIsolation(context.Background(), circuit.IsolationKey{Auth: auth, Listener: listener})
+
+	command, target, err := socksReadRequest(conn)
+	if err != nil {
+		fmt.Printf("SOCKS: invalid request: %v\n", err)
+		if errors.Is(err, errSOCKSAddrType) {
+			socksReply(conn, socksAddrTypeUnsupported)
+		}
+		return
+	}
+
+	switch command {
+	case socksCmdConnect:
+	case socksCmdResolve, socksCmdResolvePTR:
+		oc.handleSOCKSResolve(ctx, conn, command, target)
+		return
+	default:
+		socksReply(conn, socksCmdNotSupported)
+		return
+	}
+
+	fmt.Printf("SOCKS: connecting to %s\n", target)
+	stream, err := oc.Dialer.Dial(ctx, "tcp", target)
+	if err != nil {
+		fmt.Printf("SOCKS: stream to %s failed: %v\n", target, err)
+		socksReply(conn, socksReplyFor(err))
+		return
+	}
+	defer stream.Close()
+
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	circuit.Splice(conn, stream)
+}
+
+// handleSOCKSResolve answers Tor's RESOLVE and RESOLVE_PTR commands using
+// the exit's resolver
+func (oc *OnionClient) handleSOCKSResolve(ctx context.Context, conn net.Conn, command byte, target string) {
+	host, _, _ := net.SplitHostPort(target)
+	ctx, cancel := context.WithTimeout(ctx, socksHandshakeTimeout)
+	defer cancel()
+
+	if command == socksCmdResolvePTR {
+		names, err := oc.Dialer.LookupAddr(ctx, host)
+		if err != nil || len(names) == 0 || len(names[0]) > 255 {
+			fmt.Printf("SOCKS: reverse lookup of %s failed: %v\n", host, err)
+			socksReply(conn, socksHostUnreachable)
+			return
+		}
+		addr := append([]byte{byte(len(names[0]))}, names[0]...)
+		socksReplyAddr(conn, socksSucceeded, socksAtypDomain, addr)
+		return
+	}
+
+	ips, err := oc.Dialer.LookupIP(ctx, host)
+	if err != nil || len(ips) == 0 {
+		fmt.Printf("SOCKS: lookup of %s failed: %v\n", host, err)
+		socksReply(conn, socksHostUnreachable)
+		return
+	}
+	if ip4 := ips[0].To4(); ip4 != nil {
+		socksReplyAddr(conn, socksSucceeded, socksAtypIPv4, ip4)
+	} else {
+		socksReplyAddr(conn, socksSucceeded, socksAtypIPv6, ips[0].To16())
+	}
+}
+
+// socksNegotiateAuth reads the method greeting and returns the client's
+// credentials. Username/password is preferred when offered; any
+// credentials are accepted, since they only isolate streams.
+func socksNegotiateAuth(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("%w %d", errSOCKSVersion, header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	for _, method := range methods {
+		if method == socksAuthPassword {
+			if _, err := conn.Write([]byte{socksVersion, socksAuthPassword}); err != nil {
+				return "", err
+			}
+			return socksReadPassword(conn)
+		}
+	}
+	for _, method := range methods {
+		if method == socksAuthNone {
+			_, err := conn.Write([]byte{socksVersion, socksAuthNone})
+			return "", err
+		}
+	}
+
+	conn.Write([]byte{socksVersion, socksAuthNoAcceptable})
+	return "", errors.New("no acceptable authentication method")
+}
+
+// socksReadPassword reads a username/password subnegotiation and accepts it
+func socksReadPassword(conn net.Conn) (string, error) {
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return "", err
+	}
+	if version[0] != socksPasswordVersion {
+		return "", fmt.Errorf("unsupported password auth version %d", version[0])
+	}
+
+	var fields [2][]byte
+	for i := range fields {
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		fields[i] = make([]byte, length[0])
+		if _, err := io.ReadFull(conn, fields[i]); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := conn.Write([]byte{socksPasswordVersion, socksPasswordSuccess}); err != nil {
+		return "", err
+	}
+	return string(fields[0]) + ":" + string(fields[1]), nil
+}
+
+var (
+	errSOCKSVersion  = errors.New("unsupported SOCKS version")
+	errSOCKSAddrType = errors.New("unsupported address type")
+)
+
+// socksReadRequest returns the command and its "host:port" target
+func socksReadRequest(conn net.Conn) (byte, string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != socksVersion {
+		return 0, "", fmt.Errorf("%w %d", errSOCKSVersion, header[0])
+	}
+
+	var host string
+	switch header[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if header[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return 0, "", err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return 0, "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return 0, "", err
+		}
+		host = string(domain)
+	default:
+		return 0, "", errSOCKSAddrType
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return 0, "", err
+	}
+
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	return header[1], target, nil
+}
+
+// socksReply answers a request; the bound address is never meaningful
+// for a stream carried by the exit, so it is always zero
+func socksReply(conn net.Conn, code byte) error {
+	return socksReplyAddr(conn, code, socksAtypIPv4, net.IPv4zero.To4())
+}
+
+// socksReplyAddr answers a request with a bound address, which carries the
+// answer for the resolve commands
+func socksReplyAddr(conn net.Conn, code, atyp byte, addr []byte) error {
+	reply := append([]byte{socksVersion, code, 0x00, atyp}, addr...)
+	_, err := conn.Write(append(reply, 0, 0))
+	return err
+}
+
+// socksReplyFor maps why the exit refused a stream to a SOCKS reply code
+func socksReplyFor(err error) byte {
+	var streamErr *circuit.StreamError
+	if !errors.As(err, &streamErr) {
+		return socksGeneralFailure
+	}
+
+	switch streamErr.Reason {
+	case message.EndReasonResolveFailed:
+		return socksHostUnreachable
+	case message.EndReasonConnectRefused:
+		return socksConnectionRefused
+	case message.EndReasonExitPolicy:
+		return socksNotAllowed
+	case message.EndReasonTimeout:
+		return socksTTLExpired
+	default:
+		return socksGeneralFailure
+	}
+}
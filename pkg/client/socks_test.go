@@ -0,0 +1,76 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSocksReadRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		command byte
+		target  string
+		err     error // Wanted error, checked with errors.Is
+	}{
+		{
+			name:    "ipv4 connect",
+			request: []byte{socksVersion, socksCmdConnect, 0, socksAtypIPv4, 93, 184, 216, 34, 0, 80},
+			command: socksCmdConnect,
+			target:  "93.184.216.34:80",
+		},
+		{
+			name:    "ipv6 connect",
+			request: append(append([]byte{socksVersion, socksCmdConnect, 0, socksAtypIPv6}, net.ParseIP("2001:db8::1")...), 1, 187),
+			command: socksCmdConnect,
+			target:  "[2001:db8::1]:443",
+		},
+		{
+			name:    "domain resolve",
+			request: append(append([]byte{socksVersion, socksCmdResolve, 0, socksAtypDomain, 11}, "example.com"...), 0, 0),
+			command: socksCmdResolve,
+			target:  "example.com:0",
+		},
+		{
+			name:    "unknown address type",
+			request: []byte{socksVersion, socksCmdConnect, 0, 0x02},
+			err:     errSOCKSAddrType,
+		},
+		{
+			name:    "wrong version",
+			request: []byte{0x04, socksCmdConnect, 0, socksAtypIPv4},
+			err:     errSOCKSVersion,
+		},
+		{
+			name:    "truncated domain",
+			request: append([]byte{socksVersion, socksCmdConnect, 0, socksAtypDomain, 11}, "exam"...),
+			err:     io.ErrUnexpectedEOF,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer local.Close()
+			go func() {
+				remote.Write(test.request)
+				remote.Close()
+			}()
+
+			command, target, err := socksReadRequest(local)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("err = %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if command != test.command || target != test.target {
+				t.Errorf("got command %#x target %q, want %#x %q", command, target, test.command, test.target)
+			}
+		})
+	}
+}
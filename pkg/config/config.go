@@ -0,0 +1,104 @@
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// DefaultDirectoryURL is the directory used when neither the command line
+// nor a config file names one
+const DefaultDirectoryURL = "http://localhost:9000"
+
+// Setting is one "Key value" line of a config file
+type Setting struct {
+	Key   string
+	Value string
+	Line  int
+}
+
+// aliases maps torrc names to the flags they set, for keys whose flag is
+// named differently
+var aliases = map[string]string{
+	"orport":        "port",
+	"directoryurl":  "directory",
+	"datadirectory": "data-dir",
+	"nodetype":      "type",
+	"listenaddress": "listen",
+}
+
+// Load reads a torrc-style config file: one setting per line, a key and
+// its value separated by whitespace, with blank lines and # comments
+// ignored. A key may appear more than once for repeatable settings.
+func Load(path string) ([]Setting, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var settings []Setting
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		key, value := text, ""
+		if i := strings.IndexAny(text, " \t"); i >= 0 {
+			key, value = text[:i], text[i+1:]
+		}
+		settings = append(settings, Setting{Key: key, Value: strings.TrimSpace(value), Line: line})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// Apply sets the flags named by settings, except those already given on
+// the command line, which take precedence over the file. Keys match flag
+// names ignoring case and dashes, so "BandwidthRate 1 MB" sets
+// -bandwidth-rate, and a few torrc names such as ORPort are understood.
+// A boolean key on its own turns its flag on.
+func Apply(settings []Setting, flags *flag.FlagSet) error {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	names := make(map[string]string)
+	flags.VisitAll(func(f *flag.Flag) { names[normalize(f.Name)] = f.Name })
+	for alias, name := range aliases {
+		if flags.Lookup(name) != nil {
+			names[alias] = name
+		}
+	}
+
+	for _, setting := range settings {
+		name, known := names[normalize(setting.Key)]
+		if !known {
+			return fmt.Errorf("line %d: unknown setting %q", setting.Line, setting.Key)
+		}
+		if given[name] {
+			continue
+		}
+		value := setting.Value
+		if b, ok := flags.Lookup(name).Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() && value == "" {
+			value = "true"
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("line %d: %s: %w", setting.Line, setting.Key, err)
+		}
+	}
+	return nil
+}
+
+func normalize(key string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", "_", "").Replace(key))
+}
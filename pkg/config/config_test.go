@@ -0,0 +1,84 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// nodeFlags defines a few of the node's flags the way main does
+func nodeFlags(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	flags := flag.NewFlagSet("node", flag.ContinueOnError)
+	flags.Int("port", 0, "")
+	flags.String("directory", DefaultDirectoryURL, "")
+	flags.String("data-dir", "", "")
+	flags.String("bandwidth-rate", "", "")
+	flags.String("exit-policy", "", "")
+	flags.Bool("kist", false, "")
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return flags
+}
+
+func writeTorrc(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "torrc")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTorrcSetsFlags(t *testing.T) {
+	path := writeTorrc(t, `# an exit
+ORPort 9001
+DirectoryURL	http://dir:9000   # tab separated
+DataDirectory state
+
+Bandwidth_Rate 1 MB
+BandwidthRate 2 MB
+ExitPolicy reject *:25, accept *:*
+KIST
+`)
+	settings, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := nodeFlags(t, "-port", "8080")
+	if err := Apply(settings, flags); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"port":           "8080", // The command line wins
+		"directory":      "http://dir:9000",
+		"data-dir":       "state",
+		"bandwidth-rate": "2 MB", // Later lines override earlier ones
+		"exit-policy":    "reject *:25, accept *:*",
+		"kist":           "true",
+	} {
+		if got := flags.Lookup(name).Value.String(); got != want {
+			t.Errorf("-%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestTorrcErrorsNameTheLine(t *testing.T) {
+	for contents, line := range map[string]string{
+		"ORPort 9001\nSocksPolicy accept *\n": "line 2",
+		"\n\nORPort ninety\n":                 "line 3",
+	} {
+		settings, err := Load(writeTorrc(t, contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Apply(settings, nodeFlags(t))
+		if err == nil || !strings.HasPrefix(err.Error(), line) {
+			t.Errorf("Apply(%q) = %v, want an error on %s", contents, err, line)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package congestion
+
+import (
+	"fmt"
+	"time"
+)
+
+// Vegas estimates how many DATA cells a circuit may have unacknowledged,
+// after Tor's TOR_VEGAS (proposal 324). The receiver acknowledges every
+// Increment cells with a SENDME; the time from sending the cell that
+// completes an increment to its SENDME is one RTT sample. Comparing the
+// smoothed RTT with the smallest seen estimates how many of the cells in
+// flight sit in queues rather than on the wire, and the window grows while
+// that queue is short and shrinks while it is long.
+//
+// Vegas is not safe for concurrent use; callers serialize access.
+type Vegas struct {
+	Increment int // Cells per SENDME
+	MaxWindow int // Largest window, the most the receiver accepts
+
+	window    int
+	inflight  int
+	sent      int
+	slowStart bool
+	rtt       time.Duration // Smoothed
+	minRTT    time.Duration
+	sendTimes []time.Time // When each unacknowledged increment completed
+}
+
+// Queue thresholds, in increments of cells. Below alpha the window grows,
+// above beta it shrinks, and above delta it drops straight to the estimated
+// bandwidth-delay product. Slow start ends once the queue passes gamma.
+const (
+	alpha = 2
+	beta  = 4
+	gamma = 3
+	delta = 6
+
+	initialIncrements = 4 // As Tor's cc_cwnd_init
+	minIncrements     = 2
+)
+
+// minRTTSample is the shortest RTT sample taken, since a coarse clock or a
+// loopback link can measure none at all
+const minRTTSample = time.Microsecond
+
+// NewVegas returns an estimator in slow start
+func NewVegas(increment, maxWindow int) *Vegas {
+	return &Vegas{
+		Increment: increment,
+		MaxWindow: maxWindow,
+		window:    clamp(initialIncrements*increment, minIncrements*increment, maxWindow),
+		slowStart: true,
+	}
+}
+
+// Reserve takes room for one cell, reporting false while the window is full
+func (v *Vegas) Reserve() bool {
+	if v.inflight >= v.window {
+		return false
+	}
+	v.inflight++
+	return true
+}
+
+// Release returns room reserved for a cell that was never sent
+func (v *Vegas) Release() {
+	v.inflight--
+}
+
+// Sent records that a reserved cell is about to be sent. It must be called
+// before the cell can reach the receiver, so its SENDME cannot arrive first.
+func (v *Vegas) Sent(now time.Time) {
+	v.sent++
+	if v.sent%v.Increment == 0 {
+		v.sendTimes = append(v.sendTimes, now)
+	}
+}
+
+// Acked handles a SENDME, freeing an increment and adjusting the window to
+// the new RTT sample. It reports false for a SENDME that acknowledges
+// nothing, which the receiver can only send in violation of the protocol.
+func (v *Vegas) Acked(now time.Time) bool {
+	if len(v.sendTimes) == 0 {
+		return false
+	}
+	sample := now.Sub(v.sendTimes[0])
+	if sample < minRTTSample {
+		sample = minRTTSample
+	}
+	v.sendTimes = v.sendTimes[1:]
+	v.inflight -= v.Increment
+
+	// Smooth over about half a window's worth of SENDMEs, as Tor does
+	n := int64(v.window / v.Increment / 2)
+	if n < 1 {
+		n = 1
+	}
+	if v.rtt == 0 {
+		v.rtt = sample
+	} else {
+		v.rtt = time.Duration((2*int64(sample) + (n-1)*int64(v.rtt)) / (n + 1))
+	}
+	if v.minRTT == 0 || v.rtt < v.minRTT {
+		v.minRTT = v.rtt
+	}
+
+	bdp := int(int64(v.window) * int64(v.minRTT) / int64(v.rtt))
+	queue := v.window - bdp
+
+	if v.slowStart {
+		if queue < gamma*v.Increment {
+			v.window += v.Increment
+		} else {
+			v.slowStart = false
+			v.window = bdp + gamma*v.Increment
+		}
+	} else {
+		switch {
+		case queue > delta*v.Increment:
+			v.window = bdp + delta*v.Increment - v.Increment
+		case queue > beta*v.Increment:
+			v.window -= v.Increment
+		case queue < alpha*v.Increment:
+			v.window += v.Increment
+		}
+	}
+
+	v.window = clamp(v.window, minIncrements*v.Increment, v.MaxWindow)
+	if v.window == v.MaxWindow {
+		v.slowStart = false
+	}
+	return true
+}
+
+// Window is the current congestion window in cells
+func (v *Vegas) Window() int {
+	return v.window
+}
+
+// InFlight is how many cells are sent or reserved but not yet acknowledged
+func (v *Vegas) InFlight() int {
+	return v.inflight
+}
+
+// RTT returns the smoothed and the smallest round trip time seen, zero
+// until the first SENDME
+func (v *Vegas) RTT() (smoothed, min time.Duration) {
+	return v.rtt, v.minRTT
+}
+
+// SlowStart reports whether the window is still growing exponentially
+func (v *Vegas) SlowStart() bool {
+	return v.slowStart
+}
+
+func (v *Vegas) String() string {
+	phase := "steady"
+	if v.slowStart {
+		phase = "slow start"
+	}
+	return fmt.Sprintf("cwnd %d, inflight %d, rtt %v (min %v), %s",
+		v.window, v.inflight, v.rtt.Round(time.Millisecond), v.minRTT.Round(time.Millisecond), phase)
+}
+
+func clamp(value, min, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
@@ -0,0 +1,84 @@
+package congestion
+
+import (
+	"testing"
+	"time"
+)
+
+// simulate sends a full window every round and has each increment
+// acknowledged one round trip later, as rtt says for that round
+func simulate(v *Vegas, now time.Time, rounds int, rtt func(round int) time.Duration) time.Time {
+	for round := 0; round < rounds; round++ {
+		for v.Reserve() {
+			v.Sent(now)
+		}
+		now = now.Add(rtt(round))
+		for len(v.sendTimes) > 0 {
+			v.Acked(now)
+		}
+	}
+	return now
+}
+
+func constant(d time.Duration) func(int) time.Duration {
+	return func(int) time.Duration { return d }
+}
+
+func TestVegasWindow(t *testing.T) {
+	const increment, maxWindow = 50, 2000
+	start := time.Unix(0, 0)
+
+	tests := []struct {
+		name string
+		run  func(v *Vegas) time.Time
+		want func(t *testing.T, before, after int)
+	}{
+		{
+			name: "grows on an uncongested path",
+			run: func(v *Vegas) time.Time {
+				return simulate(v, start, 30, constant(50*time.Millisecond))
+			},
+			want: func(t *testing.T, before, after int) {
+				if after != maxWindow {
+					t.Errorf("window %d after steady RTTs, want %d", after, maxWindow)
+				}
+			},
+		},
+		{
+			name: "shrinks when queues build",
+			run: func(v *Vegas) time.Time {
+				now := simulate(v, start, 30, constant(50*time.Millisecond))
+				return simulate(v, now, 10, constant(200*time.Millisecond))
+			},
+			want: func(t *testing.T, before, after int) {
+				if after >= maxWindow/2 {
+					t.Errorf("window %d after RTT quadrupled, want under %d", after, maxWindow/2)
+				}
+			},
+		},
+		{
+			name: "survives zero RTT samples",
+			run: func(v *Vegas) time.Time {
+				return simulate(v, start, 10, constant(0))
+			},
+			want: func(t *testing.T, before, after int) {
+				if after < before {
+					t.Errorf("window shrank from %d to %d without delay", before, after)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := NewVegas(increment, maxWindow)
+			before := v.Window()
+			test.run(v)
+			test.want(t, before, v.Window())
+			// Only a partial increment, which no SENDME covers, is left
+			if v.InFlight() >= increment {
+				t.Errorf("%d cells still in flight", v.InFlight())
+			}
+		})
+	}
+}
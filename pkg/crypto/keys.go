@@ -0,0 +1,119 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"strings"
+)
+
+// OnionAddress derives a service's ".onion" name from its public key, so a
+// descriptor can be checked against the address a client asked for
+func OnionAddress(publicKey *rsa.PublicKey) string {
+	digest := sha256.Sum256(x509.MarshalPKCS1PublicKey(publicKey))
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(digest[:20])
+	return strings.ToLower(encoded) + ".onion"
+}
+
+// Sign produces an RSA-PSS signature over data
+func Sign(privateKey *rsa.PrivateKey, data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	return rsa.SignPSS(rand.Reader, privateKey, crypto.SHA256, digest[:], nil)
+}
+
+// Verify checks an RSA-PSS signature made by Sign
+func Verify(publicKey *rsa.PublicKey, data, signature []byte) error {
+	if publicKey == nil {
+		return errors.New("missing public key")
+	}
+	digest := sha256.Sum256(data)
+	return rsa.VerifyPSS(publicKey, crypto.SHA256, digest[:], signature, nil)
+}
+
+// EncryptForKey wraps data in a one-off layer that only the holder of
+// publicKey can remove with DecryptOnionLayer
+func EncryptForKey(data []byte, publicKey *rsa.PublicKey) ([]byte, error) {
+	layers, err := CreateOnionLayers([]*rsa.PublicKey{publicKey}, []string{""})
+	if err != nil {
+		return nil, err
+	}
+	return EncryptOnionLayer(data, layers[0])
+}
+
+// DecryptForKey removes a layer added by EncryptForKey
+func DecryptForKey(data []byte, privateKey *rsa.PrivateKey) ([]byte, error) {
+	plaintext, _, err := DecryptOnionLayer(data, privateKey)
+	return plaintext, err
+}
+
+// KeyID is a short fingerprint naming a public key without revealing it
+func KeyID(publicKey *rsa.PublicKey) string {
+	digest := sha256.Sum256(x509.MarshalPKCS1PublicKey(publicKey))
+	return hex.EncodeToString(digest[:8])
+}
+
+// LoadOrCreatePrivateKey reads a PEM-encoded RSA key from path, generating
+// and saving a new one if the file does not exist yet
+func LoadOrCreatePrivateKey(path string) (*rsa.PrivateKey, error) {
+	key, err := LoadPrivateKey(path)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return key, err
+	}
+
+	key, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	if err := SavePrivateKey(path, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// LoadPrivateKey reads a PEM-encoded RSA private key
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, errors.New("no RSA private key in " + path)
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// SavePrivateKey writes key to path as PEM, readable only by its owner
+func SavePrivateKey(path string, key *rsa.PrivateKey) error {
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	return os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+}
+
+// LoadPublicKey reads a PEM-encoded RSA public key, as written by
+// SavePublicKey
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "RSA PUBLIC KEY" {
+		return nil, errors.New("no RSA public key in " + path)
+	}
+	return x509.ParsePKCS1PublicKey(block.Bytes)
+}
+
+// SavePublicKey writes key to path as PEM
+func SavePublicKey(path string, key *rsa.PublicKey) error {
+	block := &pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(key)}
+	return os.WriteFile(path, pem.EncodeToMemory(block), 0644)
+}
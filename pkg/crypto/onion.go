@@ -34,12 +34,7 @@ func CreateOnionLayers(nodeKeys []*rsa.PublicKey, nodeIDs []string) ([]OnionLaye
 			return nil, err
 		}
 
-		block, err := aes.NewCipher(aesKey)
-		if err != nil {
-			return nil, err
-		}
-
-		gcm, err := cipher.NewGCM(block)
+		gcm, err := NewLayerCipher(aesKey)
 		if err != nil {
 			return nil, err
 		}
@@ -59,26 +54,32 @@ func EncryptOnion(data []byte, layers []OnionLayer) (*OnionPacket, error) {
 	payload := data
 	
 	for i := len(layers) - 1; i >= 0; i-- {
-		layer := layers[i]
-		
-		nonce := make([]byte, layer.GCM.NonceSize())
-		if _, err := rand.Read(nonce); err != nil {
-			return nil, err
-		}
-
-		encrypted := layer.GCM.Seal(nonce, nonce, payload, nil)
-		
-		encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, layer.PublicKey, layer.AESKey, nil)
+		encrypted, err := EncryptOnionLayer(payload, layers[i])
 		if err != nil {
 			return nil, err
 		}
-
-		payload = append(encryptedKey, encrypted...)
+		payload = encrypted
 	}
 
 	return &OnionPacket{Data: payload}, nil
 }
 
+// EncryptOnionLayer wraps data in a single layer that only the holder of
+// the layer's private key can remove
+func EncryptOnionLayer(data []byte, layer OnionLayer) ([]byte, error) {
+	encrypted, err := SealLayer(layer.GCM, data)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, layer.PublicKey, layer.AESKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(encryptedKey, encrypted...), nil
+}
+
 func DecryptOnionLayer(packet []byte, privateKey *rsa.PrivateKey) ([]byte, []byte, error) {
 	keySize := privateKey.Size()
 	if len(packet) < keySize {
@@ -93,28 +94,42 @@ func DecryptOnionLayer(packet []byte, privateKey *rsa.PrivateKey) ([]byte, []byt
 		return nil, nil, err
 	}
 
-	block, err := aes.NewCipher(aesKey)
+	gcm, err := NewLayerCipher(aesKey)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	plaintext, err := OpenLayer(gcm, encryptedData)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	nonceSize := gcm.NonceSize()
-	if len(encryptedData) < nonceSize {
-		return nil, nil, errors.New("encrypted data too small")
-	}
-
-	nonce := encryptedData[:nonceSize]
-	ciphertext := encryptedData[nonceSize:]
+	return plaintext, aesKey, nil
+}
 
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+// NewLayerCipher builds the AES-GCM cipher for a hop's layer key
+func NewLayerCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	return cipher.NewGCM(block)
+}
 
-	return plaintext, aesKey, nil
-}
\ No newline at end of file
+// SealLayer adds one symmetric layer, prefixing a fresh nonce
+func SealLayer(gcm cipher.AEAD, data []byte) ([]byte, error) {
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// OpenLayer removes one symmetric layer added by SealLayer
+func OpenLayer(gcm cipher.AEAD, data []byte) ([]byte, error) {
+	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("encrypted data too small")
+	}
+	return gcm.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+}
@@ -0,0 +1,103 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding"
+	"hash"
+)
+
+// RelayDigestSize is the length of the digest carried in a relay cell
+const RelayDigestSize = 4
+
+// RelayDirection is one hop's state for relay cells travelling one way:
+// an AES-CTR keystream and a running SHA-256 digest of every cell the hop
+// originated or recognized. Both persist for the life of the circuit, so
+// cells must be processed in the order they were sent.
+type RelayDirection struct {
+	stream cipher.Stream
+	digest hash.Hash
+}
+
+// RelayCrypto holds a hop's relay cell state in both directions. Forward
+// runs from the circuit's origin towards the hop.
+type RelayCrypto struct {
+	Forward  *RelayDirection
+	Backward *RelayDirection
+}
+
+// NewRelayCrypto derives a hop's relay keys from the key agreed when the
+// circuit was created. The responder of an end-to-end layer, such as an
+// onion service, sees the directions the other way round.
+func NewRelayCrypto(key []byte, responder bool) (*RelayCrypto, error) {
+	forward, err := newRelayDirection(key, "forward")
+	if err != nil {
+		return nil, err
+	}
+	backward, err := newRelayDirection(key, "backward")
+	if err != nil {
+		return nil, err
+	}
+
+	if responder {
+		return &RelayCrypto{Forward: backward, Backward: forward}, nil
+	}
+	return &RelayCrypto{Forward: forward, Backward: backward}, nil
+}
+
+func newRelayDirection(key []byte, label string) (*RelayDirection, error) {
+	block, err := aes.NewCipher(deriveKey(key, "relay "+label+" key"))
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.New()
+	digest.Write(deriveKey(key, "relay "+label+" digest"))
+
+	return &RelayDirection{
+		stream: cipher.NewCTR(block, make([]byte, aes.BlockSize)),
+		digest: digest,
+	}, nil
+}
+
+func deriveKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// Crypt encrypts or decrypts a cell in place with the next part of the
+// keystream
+func (d *RelayDirection) Crypt(cell []byte) {
+	d.stream.XORKeyStream(cell, cell)
+}
+
+// Digest adds a cell, with its digest field zeroed, to the running digest
+// and returns the value to put in the field
+func (d *RelayDirection) Digest(cell []byte) []byte {
+	d.digest.Write(cell)
+	return d.digest.Sum(nil)[:RelayDigestSize]
+}
+
+// Matches reports whether expected is the running digest with cell added.
+// The running digest only advances on a match, since a cell meant for
+// another hop must not disturb this one's state.
+func (d *RelayDirection) Matches(cell, expected []byte) bool {
+	state, err := d.digest.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return false
+	}
+	trial := sha256.New()
+	if err := trial.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return false
+	}
+
+	trial.Write(cell)
+	if !hmac.Equal(trial.Sum(nil)[:RelayDigestSize], expected) {
+		return false
+	}
+	d.digest = trial
+	return true
+}
@@ -1,43 +1,86 @@
 package directory
 
 import (
-	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"onion-network/pkg/crypto"
+	"onion-network/pkg/message"
+	"onion-network/pkg/policy"
 )
 
+// NodeInfo is a registered node's descriptor as the directory lists it,
+// with the address filled in for nodes that did not know their own
 type NodeInfo struct {
-	ID        string           `json:"id"`
-	Type      string           `json:"type"`
-	Address   string           `json:"address"`
-	Port      int              `json:"port"`
-	PublicKey *rsa.PublicKey   `json:"public_key"`
-	LastSeen  time.Time        `json:"last_seen"`
+	message.NodeDescriptor
+	LastSeen time.Time `json:"last_seen"`
+	
+	// Circuit positions clients may choose the node for, see assignFlags
+	Flags []string `json:"flags"`
+	
+	// Declared family members that declare this node back, listed in
+	// place of the descriptor's one-sided declarations
+	Family []string `json:"family,omitempty"`
+	
+	signed message.NodeDescriptor // As the node signed it
 }
 
+// Flags the directory lists nodes with
+const (
+	FlagGuard  = "guard"
+	FlagMiddle = "middle"
+	FlagExit   = "exit"
+)
+
+// MaxClockSkew bounds how far a descriptor's or request's time may be
+// from the directory's, so old signed messages cannot be replayed
+const MaxClockSkew = time.Hour
+
+// BridgesPerRequest is how many bridge lines one requester is given, so
+// no single address can enumerate every bridge
+const BridgesPerRequest = 2
+
 type DirectoryServer struct {
-	Port  int
-	Nodes map[string]*NodeInfo
-	mutex sync.RWMutex
+	Port        int
+	Nodes       map[string]*NodeInfo
+	Bridges     map[string]*NodeInfo // Never listed in /nodes
+	Descriptors map[string]*message.ServiceDescriptor
+	mutex       sync.RWMutex
 }
 
 func NewDirectoryServer(port int) *DirectoryServer {
 	return &DirectoryServer{
-		Port:  port,
-		Nodes: make(map[string]*NodeInfo),
+		Port:        port,
+		Nodes:       make(map[string]*NodeInfo),
+		Bridges:     make(map[string]*NodeInfo),
+		Descriptors: make(map[string]*message.ServiceDescriptor),
 	}
 }
 
 func (ds *DirectoryServer) Start() error {
-	http.HandleFunc("/register", ds.handleRegister)
-	http.HandleFunc("/nodes", ds.handleGetNodes)
-	http.HandleFunc("/nodes/", ds.handleGetNodesByType)
-	
 	fmt.Printf("Directory server listening on port %d\n", ds.Port)
-	return http.ListenAndServe(fmt.Sprintf(":%d", ds.Port), nil)
+	return http.ListenAndServe(fmt.Sprintf(":%d", ds.Port), ds.Handler())
+}
+
+// Handler serves the directory's endpoints
+func (ds *DirectoryServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", ds.handleRegister)
+	mux.HandleFunc("/unregister", ds.handleUnregister)
+	mux.HandleFunc("/nodes", ds.handleGetNodes)
+	mux.HandleFunc("/nodes/", ds.handleGetNodesByType)
+	mux.HandleFunc("/bridges", ds.handleGetBridges)
+	mux.HandleFunc("/bridges/", ds.handleGetBridgeDescriptor)
+	mux.HandleFunc("/hs/publish", ds.handlePublishDescriptor)
+	mux.HandleFunc("/hs/descriptors/", ds.handleGetDescriptor)
+	return mux
 }
 
 func (ds *DirectoryServer) handleRegister(w http.ResponseWriter, r *http.Request) {
@@ -46,24 +89,117 @@ func (ds *DirectoryServer) handleRegister(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	var node NodeInfo
-	if err := json.NewDecoder(r.Body).Decode(&node); err != nil {
+	var desc message.NodeDescriptor
+	if err := json.NewDecoder(r.Body).Decode(&desc); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	if err := desc.Verify(); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if skew := time.Since(desc.Published); skew > MaxClockSkew || skew < -MaxClockSkew {
+		http.Error(w, "Descriptor publication time is off", http.StatusBadRequest)
+		return
+	}
 
-	node.LastSeen = time.Now()
+	node := NodeInfo{NodeDescriptor: desc, LastSeen: time.Now(), Flags: assignFlags(&desc), signed: desc}
+	
+	// Nodes listening on all interfaces are reached at the address they registered from
+	if ip := net.ParseIP(node.Address); node.Address == "" || (ip != nil && ip.IsUnspecified()) {
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			node.Address = host
+		}
+	}
 
+	// Compared and stored under one lock, so of two registrations racing
+	// the newer descriptor is the one kept
 	ds.mutex.Lock()
-	ds.Nodes[node.ID] = &node
+	existing, exists := ds.Nodes[desc.ID]
+	if !exists {
+		existing, exists = ds.Bridges[desc.ID]
+	}
+	if exists && !desc.Published.After(existing.Published) {
+		ds.mutex.Unlock()
+		http.Error(w, "Descriptor is older than the registered one", http.StatusConflict)
+		return
+	}
+	newKey := exists && existing.PublicKey.N.Cmp(desc.PublicKey.N) != 0
+	// A node that changed between bridge and relay is only kept as what it
+	// is now, so it is compared against its latest descriptor next time
+	if node.Offers("bridge") {
+		ds.Bridges[node.ID] = &node
+		delete(ds.Nodes, node.ID)
+	} else {
+		ds.Nodes[node.ID] = &node
+		delete(ds.Bridges, node.ID)
+	}
 	ds.mutex.Unlock()
 
-	fmt.Printf("Registered %s node: %s at %s:%d\n", node.Type, node.ID, node.Address, node.Port)
+	if newKey {
+		fmt.Printf("Node %s published a new onion key\n", desc.ID)
+	}
+
+	if node.Offers("bridge") {
+		fmt.Printf("Registered bridge: %s at %s:%d\n", node.ID, node.Address, node.Port)
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "registered", "bridge_line": node.bridgeLine().String()})
+		return
+	}
+
+	if node.Hibernating {
+		fmt.Printf("Node %s is hibernating, no longer listed\n", node.ID)
+	} else {
+		fmt.Printf("Registered %s node: %s at %s:%d\n", strings.Join(node.Flags, "+"), node.ID, node.Address, node.Port)
+	}
 	
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "registered"})
 }
 
+// handleUnregister forgets a node that is shutting down, if the request
+// is signed with its identity key
+func (ds *DirectoryServer) handleUnregister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req message.Unregister
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if skew := time.Since(time.Unix(req.Timestamp, 0)); skew > MaxClockSkew || skew < -MaxClockSkew {
+		http.Error(w, "Request time is off", http.StatusBadRequest)
+		return
+	}
+
+	ds.mutex.Lock()
+	node, exists := ds.Nodes[req.ID]
+	if !exists {
+		node, exists = ds.Bridges[req.ID]
+	}
+	if !exists {
+		ds.mutex.Unlock()
+		http.Error(w, "Node not registered", http.StatusNotFound)
+		return
+	}
+	if err := crypto.Verify(node.IdentityKey, req.SignedData(), req.Signature); err != nil {
+		ds.mutex.Unlock()
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+	delete(ds.Nodes, req.ID)
+	delete(ds.Bridges, req.ID)
+	ds.mutex.Unlock()
+
+	fmt.Printf("Node %s left the network\n", req.ID)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "unregistered"})
+}
+
 func (ds *DirectoryServer) handleGetNodes(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -71,10 +207,10 @@ func (ds *DirectoryServer) handleGetNodes(w http.ResponseWriter, r *http.Request
 	}
 
 	ds.mutex.RLock()
-	nodes := make([]*NodeInfo, 0, len(ds.Nodes))
+	nodes := make([]NodeInfo, 0, len(ds.Nodes))
 	for _, node := range ds.Nodes {
-		if time.Since(node.LastSeen) < 5*time.Minute {
-			nodes = append(nodes, node)
+		if node.available() {
+			nodes = append(nodes, ds.listing(node))
 		}
 	}
 	ds.mutex.RUnlock()
@@ -89,21 +225,215 @@ func (ds *DirectoryServer) handleGetNodesByType(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	nodeType := r.URL.Path[len("/nodes/"):]
-	if nodeType == "" {
-		http.Error(w, "Node type required", http.StatusBadRequest)
+	flag := r.URL.Path[len("/nodes/"):]
+	if flag == "" {
+		http.Error(w, "Flag required", http.StatusBadRequest)
 		return
 	}
 
 	ds.mutex.RLock()
-	var nodes []*NodeInfo
+	var nodes []NodeInfo
 	for _, node := range ds.Nodes {
-		if node.Type == nodeType && time.Since(node.LastSeen) < 5*time.Minute {
-			nodes = append(nodes, node)
+		if node.hasFlag(flag) && node.available() {
+			nodes = append(nodes, ds.listing(node))
 		}
 	}
 	ds.mutex.RUnlock()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(nodes)
-}
\ No newline at end of file
+}
+
+// listing is the node as handed out to clients, with only the family
+// members it and they agree on, since anyone can claim to be in a family.
+// Call it with the mutex held.
+func (ds *DirectoryServer) listing(node *NodeInfo) NodeInfo {
+	listed := *node
+	listed.Family = nil
+	for _, id := range node.NodeDescriptor.Family {
+		member, exists := ds.Nodes[id]
+		if !exists {
+			member, exists = ds.Bridges[id]
+		}
+		if exists && id != node.ID && contains(member.NodeDescriptor.Family, node.ID) {
+			listed.Family = append(listed.Family, id)
+		}
+	}
+	return listed
+}
+
+func contains(ids []string, id string) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+// assignFlags decides which circuit positions a node is listed for. Every
+// node can be a middle; guards and exits are those offering to be, and an
+// exit must also have a policy that lets some stream out.
+func assignFlags(desc *message.NodeDescriptor) []string {
+	flags := []string{FlagMiddle}
+	if desc.Offers("guard") {
+		flags = append(flags, FlagGuard)
+	}
+	if desc.Offers("exit") {
+		if exitPolicy, err := policy.Parse(desc.ExitPolicy); err == nil && exitPolicy.AcceptsAny() {
+			flags = append(flags, FlagExit)
+		}
+	}
+	return flags
+}
+
+func (node *NodeInfo) hasFlag(flag string) bool {
+	return contains(node.Flags, flag)
+}
+
+// available reports whether the node should be handed out to clients
+func (node *NodeInfo) available() bool {
+	return !node.Hibernating && time.Since(node.LastSeen) < 5*time.Minute
+}
+
+func (node *NodeInfo) bridgeLine() *message.BridgeLine {
+	return &message.BridgeLine{
+		Transport:     node.Transport,
+		Address:       node.Address,
+		Port:          node.Port,
+		ID:            node.ID,
+		IdentityKey:   node.IdentityKey,
+		TransportArgs: node.TransportArgs,
+	}
+}
+
+// handleGetBridgeDescriptor serves a bridge's signed descriptor to clients
+// that already have its bridge line, so they can learn its current onion
+// key. Only a known ID is answered, which reveals nothing the line did not.
+// The address the bridge is reached at, which the descriptor may leave to
+// the directory, goes in the X-Node-Address header.
+func (ds *DirectoryServer) handleGetBridgeDescriptor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/bridges/")
+	ds.mutex.RLock()
+	node, exists := ds.Bridges[id]
+	ds.mutex.RUnlock()
+	if !exists || !node.available() {
+		http.Error(w, "Bridge not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Node-Address", node.Address)
+	json.NewEncoder(w).Encode(&node.signed)
+}
+
+// handleGetBridges hands out a few bridge lines as plain text, one per
+// line. Each requesting address always gets the same bridges, so asking
+// repeatedly does not reveal more of them. "?transport=obfs" asks only for
+// bridges speaking a transport the client supports.
+func (ds *DirectoryServer) handleGetBridges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requester, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		requester = r.RemoteAddr
+	}
+
+	transport := r.URL.Query().Get("transport")
+	if transport == "plain" {
+		transport = ""
+	}
+
+	ds.mutex.RLock()
+	var bridges []*NodeInfo
+	for _, node := range ds.Bridges {
+		if r.URL.Query().Has("transport") && node.Transport != transport {
+			continue
+		}
+		if node.available() {
+			bridges = append(bridges, node)
+		}
+	}
+	ds.mutex.RUnlock()
+
+	rank := func(node *NodeInfo) string {
+		digest := sha256.Sum256([]byte(requester + "/" + node.ID))
+		return string(digest[:])
+	}
+	sort.Slice(bridges, func(i, j int) bool { return rank(bridges[i]) < rank(bridges[j]) })
+	if len(bridges) > BridgesPerRequest {
+		bridges = bridges[:BridgesPerRequest]
+	}
+
+	lines := make([]string, len(bridges))
+	for i, node := range bridges {
+		lines[i] = node.bridgeLine().String()
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, strings.Join(lines, "\n"))
+	if len(lines) > 0 {
+		fmt.Fprintln(w)
+	}
+}
+
+// handlePublishDescriptor stores an onion service descriptor. Only the
+// service's own key can sign it, so the directory just checks the signature.
+func (ds *DirectoryServer) handlePublishDescriptor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var desc message.ServiceDescriptor
+	if err := json.NewDecoder(r.Body).Decode(&desc); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := desc.Verify(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ds.mutex.Lock()
+	if current, exists := ds.Descriptors[desc.Address]; exists && desc.Published.Before(current.Published) {
+		ds.mutex.Unlock()
+		http.Error(w, "Descriptor is older than the published one", http.StatusConflict)
+		return
+	}
+	ds.Descriptors[desc.Address] = &desc
+	ds.mutex.Unlock()
+
+	fmt.Printf("Published descriptor for %s with %d intro points\n", desc.Address, len(desc.IntroPoints))
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "published"})
+}
+
+func (ds *DirectoryServer) handleGetDescriptor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	address := r.URL.Path[len("/hs/descriptors/"):]
+
+	ds.mutex.RLock()
+	desc, exists := ds.Descriptors[address]
+	ds.mutex.RUnlock()
+	if !exists || time.Since(desc.Published) > message.DescriptorLifetime {
+		http.Error(w, "Descriptor not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(desc)
+}
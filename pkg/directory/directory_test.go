@@ -0,0 +1,128 @@
+package directory
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"onion-network/pkg/message"
+)
+
+// descriptor is a node's descriptor signed as published at published
+func descriptor(t *testing.T, identity, onion *rsa.PrivateKey, roles []string, published time.Time) []byte {
+	t.Helper()
+	desc := message.NodeDescriptor{
+		ID:          message.NodeID(&identity.PublicKey),
+		Roles:       roles,
+		Address:     "192.0.2.1",
+		Port:        9001,
+		PublicKey:   &onion.PublicKey,
+		IdentityKey: &identity.PublicKey,
+		Published:   published,
+	}
+	if err := desc.Sign(identity); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(&desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func register(t *testing.T, url string, data []byte) int {
+	resp, err := http.Post(url+"/register", "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRegister(t *testing.T) {
+	identity, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		published time.Time
+		roles     []string
+		status    int
+	}{
+		{"first", now.Add(-time.Minute), []string{"guard"}, http.StatusOK},
+		{"same time", now.Add(-time.Minute), []string{"guard"}, http.StatusConflict},
+		{"older", now.Add(-2 * time.Minute), []string{"guard"}, http.StatusConflict},
+		{"newer", now, []string{"guard", "exit"}, http.StatusOK},
+		{"far future", now.Add(MaxClockSkew + time.Hour), []string{"guard"}, http.StatusBadRequest},
+	}
+	ds := NewDirectoryServer(0)
+	server := httptest.NewServer(ds.Handler())
+	defer server.Close()
+	for _, test := range tests {
+		if status := register(t, server.URL, descriptor(t, identity, onion, test.roles, test.published)); status != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, status, test.status)
+		}
+	}
+
+	node := ds.Nodes[message.NodeID(&identity.PublicKey)]
+	if node == nil || !node.Published.Equal(now) {
+		t.Fatalf("registered descriptor is %+v, want the newest", node)
+	}
+}
+
+func TestConcurrentRegistrationsKeepNewest(t *testing.T) {
+	identity, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	ds := NewDirectoryServer(0)
+	server := httptest.NewServer(ds.Handler())
+	defer server.Close()
+
+	for _, roles := range [][]string{{"guard"}, {"bridge"}} {
+		const registrations = 16
+		descriptors := make([][]byte, registrations)
+		for i := range descriptors {
+			descriptors[i] = descriptor(t, identity, identity, roles, now.Add(-time.Duration(i)*time.Second))
+		}
+
+		var wg sync.WaitGroup
+		for _, data := range descriptors {
+			wg.Add(1)
+			go func(data []byte) {
+				defer wg.Done()
+				register(t, server.URL, data)
+			}(data)
+		}
+		wg.Wait()
+
+		nodes := ds.Nodes
+		if roles[0] == "bridge" {
+			nodes = ds.Bridges
+		}
+		node := nodes[message.NodeID(&identity.PublicKey)]
+		if node == nil || !node.Published.Equal(now) {
+			t.Errorf("%s: registered descriptor is %+v, want the newest", roles[0], node)
+		}
+		if len(ds.Nodes)+len(ds.Bridges) != 1 {
+			t.Errorf("%s: node kept %d times", roles[0], len(ds.Nodes)+len(ds.Bridges))
+		}
+		now = now.Add(time.Minute)
+	}
+}
@@ -0,0 +1,138 @@
+package dos
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds a node's denial-of-service limits. The per-address limits
+// apply only to clients: links from listed relays carry many users'
+// circuits and are exempt, as in Tor.
+type Config struct {
+	MaxConnectionsPerIP int     // Concurrent links from one client address, 0 for no limit
+	CircuitRate         float64 // Circuits per second one client address may create, 0 for no limit
+	CircuitBurst        int     // Circuits a client address may create at once
+	MaxPendingCreates   int     // Create onions awaiting decryption before more are refused, 0 for no limit
+	PowThreshold        int     // Pending create onions at which clients must solve a puzzle, negative for never
+	PowBits             int     // Difficulty of the puzzle, in leading zero bits
+	MaxQueuedBytes      int64   // Cell bytes queued on all links before the largest queues are killed, 0 for no limit
+}
+
+// DefaultConfig follows Tor's DoS defaults where it has them
+func DefaultConfig() Config {
+	return Config{
+		MaxConnectionsPerIP: 100,
+		CircuitRate:         3,
+		CircuitBurst:        90,
+		MaxPendingCreates:   256,
+		PowThreshold:        16,
+		PowBits:             18,
+		MaxQueuedBytes:      256 << 20,
+	}
+}
+
+type Stats struct {
+	RefusedConnections atomic.Uint64
+	RefusedCircuits    atomic.Uint64
+	Puzzles            atomic.Uint64
+	Proofs             atomic.Uint64
+	OOMKilled          atomic.Uint64
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf("%d connections refused, %d circuits refused, %d puzzles sent, %d proofs accepted, %d circuits killed for memory",
+		s.RefusedConnections.Load(), s.RefusedCircuits.Load(), s.Puzzles.Load(), s.Proofs.Load(), s.OOMKilled.Load())
+}
+
+// ConnectionLimiter counts the open links from each address
+type ConnectionLimiter struct {
+	max    int
+	counts map[string]int
+	mutex  sync.Mutex
+}
+
+func NewConnectionLimiter(max int) *ConnectionLimiter {
+	return &ConnectionLimiter{max: max, counts: make(map[string]int)}
+}
+
+// Acquire counts a new link from ip, or reports false if ip already has
+// as many as allowed. Every successful Acquire needs a Release.
+func (l *ConnectionLimiter) Acquire(ip string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.max > 0 && l.counts[ip] >= l.max {
+		return false
+	}
+	l.counts[ip]++
+	return true
+}
+
+func (l *ConnectionLimiter) Release(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.counts[ip]--; l.counts[ip] <= 0 {
+		delete(l.counts, ip)
+	}
+}
+
+// CircuitLimiter gives each address a token bucket of circuit creations
+type CircuitLimiter struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	pruned  time.Time
+	mutex   sync.Mutex
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// pruneInterval is how often buckets that have refilled are forgotten
+const pruneInterval = time.Minute
+
+func NewCircuitLimiter(rate float64, burst int) *CircuitLimiter {
+	return &CircuitLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// Allow takes a token from ip's bucket, reporting false when it is empty
+func (l *CircuitLimiter) Allow(ip string, now time.Time) bool {
+	if l.rate <= 0 {
+		return true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.pruned) > pruneInterval {
+		for addr, b := range l.buckets {
+			if b.refill(now, l.rate, l.burst) >= l.burst {
+				delete(l.buckets, addr)
+			}
+		}
+		l.pruned = now
+	}
+
+	b, exists := l.buckets[ip]
+	if !exists {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[ip] = b
+	}
+	if b.refill(now, l.rate, l.burst) < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *bucket) refill(now time.Time, rate, burst float64) float64 {
+	b.tokens += now.Sub(b.updated).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.updated = now
+	return b.tokens
+}
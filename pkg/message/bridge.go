@@ -0,0 +1,100 @@
+package message
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BridgeLine describes an unlisted bridge node well enough to use it as
+// the first hop of a circuit. Its text form is
+//
+//	[transport] <address>:<port> <node id> key=<base64 PKCS#1 public key> [arg=value ...]
+//
+// where the transport and its arguments say how to reach the bridge's
+// listener. Without a transport the link is plain. The key is the bridge's
+// identity key; its current onion key is in its signed descriptor.
+type BridgeLine struct {
+	Transport     string
+	Address       string
+	Port          int
+	ID            string
+	IdentityKey   *rsa.PublicKey
+	TransportArgs map[string]string
+}
+
+func (b *BridgeLine) String() string {
+	fields := []string{}
+	if b.Transport != "" && b.Transport != "plain" {
+		fields = append(fields, b.Transport)
+	}
+	key := base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(b.IdentityKey))
+	fields = append(fields, net.JoinHostPort(b.Address, strconv.Itoa(b.Port)), b.ID, "key="+key)
+
+	names := make([]string, 0, len(b.TransportArgs))
+	for name := range b.TransportArgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fields = append(fields, name+"="+b.TransportArgs[name])
+	}
+	return strings.Join(fields, " ")
+}
+
+// ParseBridgeLine parses a line in the form produced by BridgeLine.String.
+// A leading "Bridge" keyword, as in torrc files, is allowed.
+func ParseBridgeLine(line string) (*BridgeLine, error) {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && strings.EqualFold(fields[0], "bridge") {
+		fields = fields[1:]
+	}
+
+	bridge := &BridgeLine{}
+	if len(fields) > 0 && !strings.Contains(fields[0], ":") {
+		bridge.Transport = strings.ToLower(fields[0])
+		fields = fields[1:]
+	}
+	if len(fields) < 3 || !strings.HasPrefix(fields[2], "key=") {
+		return nil, errors.New("bridge line must be \"[transport] <address>:<port> <id> key=<key> [arg=value ...]\"")
+	}
+
+	host, portStr, err := net.SplitHostPort(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid bridge address: %w", err)
+	}
+	if bridge.Port, err = strconv.Atoi(portStr); err != nil {
+		return nil, fmt.Errorf("invalid bridge port: %w", err)
+	}
+	bridge.Address = host
+	bridge.ID = fields[1]
+
+	der, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(fields[2], "key="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid bridge key: %w", err)
+	}
+	if bridge.IdentityKey, err = x509.ParsePKCS1PublicKey(der); err != nil {
+		return nil, fmt.Errorf("invalid bridge key: %w", err)
+	}
+	if NodeID(bridge.IdentityKey) != bridge.ID {
+		return nil, fmt.Errorf("bridge key does not match %s", bridge.ID)
+	}
+
+	for _, field := range fields[3:] {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid bridge argument %q", field)
+		}
+		if bridge.TransportArgs == nil {
+			bridge.TransportArgs = make(map[string]string)
+		}
+		bridge.TransportArgs[name] = value
+	}
+	return bridge, nil
+}
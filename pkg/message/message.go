@@ -1,7 +1,10 @@
 package message
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"io"
 )
 
 type MessageType int
@@ -11,8 +14,31 @@ const (
 	CircuitRelay
 	CircuitDestroy
 	HTTPRequest
+	CircuitCreated
+	LinkPaddingNegotiate // Payload is a LinkPaddingParams
+	CircuitPuzzle        // Payload is a Puzzle to solve before the create is taken
+	LinkAuthenticate     // Payload is a LinkAuth, answering a LinkChallenge
+	LinkChallenge        // Payload is a nonce, first on a link a node accepts
 )
 
+// Reasons carried in the one-byte payload of a CircuitDestroy message
+const (
+	DestroyNone          byte = iota
+	DestroyProtocol           // A hop received something it could not accept
+	DestroyInternal           // A hop failed on its own
+	DestroyRequested          // The client closed the circuit
+	DestroyHibernating        // A hop is shutting down or out of bandwidth
+	DestroyResourceLimit      // A hop is refusing the load
+	DestroyConnectFailed      // A hop could not reach the next one
+	DestroyChannelClosed      // A link the circuit used went away
+	DestroyFinished           // The circuit is no longer needed
+	DestroyTimeout            // The circuit took too long to build or answer
+	DestroyDestroyed          // The other half of a joined circuit closed
+)
+
+// MaxMessageSize bounds a single framed message on a link
+const MaxMessageSize = 1 << 20
+
 type OnionMessage struct {
 	Type        MessageType `json:"type"`
 	CircuitID   string      `json:"circuit_id"`
@@ -20,6 +46,67 @@ type OnionMessage struct {
 	Payload     []byte      `json:"payload"`
 	IsLastHop   bool        `json:"is_last_hop"`
 	Destination string      `json:"destination,omitempty"`
+	Timestamp   int64       `json:"timestamp,omitempty"` // Set in create layers so old ones can be refused
+	Proof       []byte      `json:"proof,omitempty"`     // Solves the node's Puzzle for a create onion
+}
+
+// LinkPaddingParams asks the other side of a link to send padding when the
+// link is idle for between MinMillis and MaxMillis. Ack marks the answer.
+type LinkPaddingParams struct {
+	Enabled   bool `json:"enabled"`
+	MinMillis int  `json:"min_ms"`
+	MaxMillis int  `json:"max_ms"`
+	Ack       bool `json:"ack,omitempty"`
+}
+
+// Puzzle asks a client for proof of work before a loaded node decrypts its
+// create onion: a proof such that SHA-256 of Seed, the digest of the onion
+// and the proof starts with Bits zero bits
+type Puzzle struct {
+	Seed []byte `json:"seed"`
+	Bits int    `json:"bits"`
+}
+
+// DestroyMessage tears down circuitID on the link it is sent over
+func DestroyMessage(circuitID string, reason byte) *OnionMessage {
+	return &OnionMessage{Type: CircuitDestroy, CircuitID: circuitID, Payload: []byte{reason}}
+}
+
+// DestroyReason reads the reason from a CircuitDestroy message
+func (m *OnionMessage) DestroyReason() byte {
+	if len(m.Payload) == 0 {
+		return DestroyNone
+	}
+	return m.Payload[0]
+}
+
+// DestroyReasonString describes a CircuitDestroy reason for log and error
+// messages
+func DestroyReasonString(reason byte) string {
+	switch reason {
+	case DestroyProtocol:
+		return "protocol violation"
+	case DestroyInternal:
+		return "internal error"
+	case DestroyRequested:
+		return "requested"
+	case DestroyHibernating:
+		return "hibernating"
+	case DestroyResourceLimit:
+		return "resource limit"
+	case DestroyConnectFailed:
+		return "connect failed"
+	case DestroyChannelClosed:
+		return "link closed"
+	case DestroyFinished:
+		return "finished"
+	case DestroyTimeout:
+		return "timeout"
+	case DestroyDestroyed:
+		return "joined circuit destroyed"
+	default:
+		return "none"
+	}
 }
 
 func (m *OnionMessage) ToJSON() ([]byte, error) {
@@ -30,4 +117,46 @@ func FromJSON(data []byte) (*OnionMessage, error) {
 	var msg OnionMessage
 	err := json.Unmarshal(data, &msg)
 	return &msg, err
-}
\ No newline at end of file
+}
+
+// WriteMessage sends a length-prefixed message over a link
+func WriteMessage(w io.Writer, m *OnionMessage) error {
+	_, err := WriteFrame(w, m)
+	return err
+}
+
+// WriteFrame is WriteMessage, also returning the bytes the frame took,
+// which the JSON encoding makes larger than the payload
+func WriteFrame(w io.Writer, m *OnionMessage) (int, error) {
+	data, err := m.ToJSON()
+	if err != nil {
+		return 0, err
+	}
+	if len(data) > MaxMessageSize {
+		return 0, errors.New("message too large")
+	}
+
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	return w.Write(frame)
+}
+
+// ReadMessage reads the next length-prefixed message from a link
+func ReadMessage(r io.Reader) (*OnionMessage, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MaxMessageSize {
+		return nil, errors.New("message too large")
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return FromJSON(data)
+}
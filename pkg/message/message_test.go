@@ -0,0 +1,31 @@
+package message
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"sync"
+	"testing"
+)
+
+var (
+	testKeys     []*rsa.PrivateKey
+	testKeysOnce sync.Once
+)
+
+// keys returns three RSA keys shared by the tests, which are slow to make
+func keys(t *testing.T) []*rsa.PrivateKey {
+	t.Helper()
+	testKeysOnce.Do(func() {
+		for i := 0; i < 3; i++ {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testKeys = append(testKeys, key)
+		}
+	})
+	if len(testKeys) < 3 {
+		t.Fatal("no test keys")
+	}
+	return testKeys
+}
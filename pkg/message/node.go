@@ -0,0 +1,133 @@
+package message
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"onion-network/pkg/crypto"
+)
+
+// NodeDescriptor is what a node registers with the directory. It is
+// signed with the node's long-term identity key, whose fingerprint is the
+// node's ID. PublicKey is the medium-term onion key create onions are
+// encrypted to; the node rotates it and registers a new descriptor. The
+// directory lists the node with flags chosen from the roles it offers.
+type NodeDescriptor struct {
+	ID            string            `json:"id"`
+	Roles         []string          `json:"roles,omitempty"` // Positions offered besides the middle: guard, exit or bridge
+	Address       string            `json:"address"`
+	Port          int               `json:"port"`
+	PublicKey     *rsa.PublicKey    `json:"public_key"`
+	IdentityKey   *rsa.PublicKey    `json:"identity_key"`
+	Hibernating   bool              `json:"hibernating,omitempty"` // Refusing circuits for now
+	Family        []string          `json:"family,omitempty"`      // IDs of nodes with the same operator
+	ExitPolicy    string            `json:"exit_policy,omitempty"` // Rules of an exit, see policy.Parse
+	Transport     string            `json:"transport,omitempty"`   // Pluggable transport of the listener, empty for plain
+	TransportArgs map[string]string `json:"transport_args,omitempty"`
+	Published     time.Time         `json:"published"`
+	Signature     []byte            `json:"signature,omitempty"`
+}
+
+// NodeID names the node holding an identity key
+func NodeID(identityKey *rsa.PublicKey) string {
+	return "node_" + crypto.KeyID(identityKey)
+}
+
+// Offers reports whether the node offers a role
+func (d *NodeDescriptor) Offers(role string) bool {
+	for _, r := range d.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *NodeDescriptor) signedData() ([]byte, error) {
+	unsigned := *d
+	unsigned.Signature = nil
+	return json.Marshal(&unsigned)
+}
+
+// Sign signs the descriptor with the node's identity key
+func (d *NodeDescriptor) Sign(identityKey *rsa.PrivateKey) error {
+	data, err := d.signedData()
+	if err != nil {
+		return err
+	}
+	d.Signature, err = crypto.Sign(identityKey, data)
+	return err
+}
+
+// Verify checks that the descriptor was signed by the identity key its ID
+// is derived from and names an onion key
+func (d *NodeDescriptor) Verify() error {
+	if d.IdentityKey == nil || d.PublicKey == nil {
+		return errors.New("descriptor is missing a key")
+	}
+	if NodeID(d.IdentityKey) != d.ID {
+		return fmt.Errorf("identity key does not match %s", d.ID)
+	}
+
+	data, err := d.signedData()
+	if err != nil {
+		return err
+	}
+	if err := crypto.Verify(d.IdentityKey, data, d.Signature); err != nil {
+		return errors.New("invalid descriptor signature")
+	}
+	return nil
+}
+
+// Unregister asks the directory to forget a node that is leaving. The
+// signature covers the ID and time, so only the node itself can ask.
+type Unregister struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Signature []byte `json:"signature"`
+}
+
+func (u *Unregister) SignedData() []byte {
+	return []byte(fmt.Sprintf("unregister:%s:%d", u.ID, u.Timestamp))
+}
+
+// LinkAuth proves that a link was dialed by a node holding an identity
+// key, so the other end can tell relayed circuits from a client's. The
+// signature covers the address dialed and the challenge the other end sent
+// on this link, so it cannot be replayed on another link.
+type LinkAuth struct {
+	ID          string         `json:"id"`
+	IdentityKey *rsa.PublicKey `json:"identity_key"`
+	Address     string         `json:"address"` // As dialed, host:port
+	Challenge   []byte         `json:"challenge"`
+	Signature   []byte         `json:"signature"`
+}
+
+func (a *LinkAuth) SignedData() []byte {
+	return []byte(fmt.Sprintf("link:%s:%s:%x", a.ID, a.Address, a.Challenge))
+}
+
+// Sign signs the link authentication with the node's identity key
+func (a *LinkAuth) Sign(identityKey *rsa.PrivateKey) error {
+	var err error
+	a.Signature, err = crypto.Sign(identityKey, a.SignedData())
+	return err
+}
+
+// Verify checks that the link authentication was signed by the identity
+// key its ID is derived from
+func (a *LinkAuth) Verify() error {
+	if a.IdentityKey == nil {
+		return errors.New("link authentication is missing a key")
+	}
+	if NodeID(a.IdentityKey) != a.ID {
+		return fmt.Errorf("identity key does not match %s", a.ID)
+	}
+	if err := crypto.Verify(a.IdentityKey, a.SignedData(), a.Signature); err != nil {
+		return errors.New("invalid link authentication signature")
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package message
+
+import (
+	"crypto/rsa"
+	"testing"
+	"time"
+)
+
+func TestLinkAuthVerify(t *testing.T) {
+	k := keys(t)
+	signed := func() *LinkAuth {
+		a := &LinkAuth{ID: NodeID(&k[0].PublicKey), IdentityKey: &k[0].PublicKey, Address: "192.0.2.1:9001", Challenge: []byte("challenge")}
+		if err := a.Sign(k[0]); err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	if err := signed().Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	a := signed()
+	a.Address = "192.0.2.2:9001"
+	if a.Verify() == nil {
+		t.Error("authentication moved to another address")
+	}
+
+	a = signed()
+	a.Challenge = []byte("another link")
+	if a.Verify() == nil {
+		t.Error("authentication moved to another link")
+	}
+
+	a = signed()
+	a.IdentityKey, a.ID = &k[1].PublicKey, NodeID(&k[1].PublicKey)
+	if a.Verify() == nil {
+		t.Error("authentication claimed for another node")
+	}
+}
+
+func TestNodeDescriptorSignVerify(t *testing.T) {
+	k := keys(t)
+	tests := []struct {
+		name   string
+		change func(d *NodeDescriptor)
+		signer *rsa.PrivateKey
+		valid  bool
+	}{
+		{"signed", func(d *NodeDescriptor) {}, k[0], true},
+		{"address changed after signing", func(d *NodeDescriptor) { d.Address = "203.0.113.5" }, k[0], false},
+		{"roles changed after signing", func(d *NodeDescriptor) { d.Roles = append(d.Roles, "exit") }, k[0], false},
+		{"signed by another key", func(d *NodeDescriptor) {}, k[1], false},
+		{"ID of another key", func(d *NodeDescriptor) { d.ID = NodeID(&k[1].PublicKey) }, k[0], false},
+		{"no onion key", func(d *NodeDescriptor) { d.PublicKey = nil }, k[0], false},
+		{"no signature", func(d *NodeDescriptor) { d.Signature = nil }, k[0], false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &NodeDescriptor{
+				ID:          NodeID(&k[0].PublicKey),
+				Roles:       []string{"guard"},
+				Address:     "192.0.2.1",
+				Port:        9001,
+				PublicKey:   &k[2].PublicKey,
+				IdentityKey: &k[0].PublicKey,
+				Published:   time.Now(),
+			}
+			if err := d.Sign(test.signer); err != nil {
+				t.Fatal(err)
+			}
+			test.change(d)
+			if err := d.Verify(); (err == nil) != test.valid {
+				t.Errorf("Verify() = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package message
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"onion-network/pkg/crypto"
+)
+
+type RelayCommand int
+
+const (
+	RelayBegin RelayCommand = iota + 1
+	RelayData
+	RelayEnd
+	RelayConnected
+	RelayResolve
+	RelayResolved
+	RelayEstablishIntro
+	RelayIntroEstablished
+	RelayIntroduce1
+	RelayIntroduce2
+	RelayIntroduceAck
+	RelayEstablishRendezvous
+	RelayRendezvousEstablished
+	RelayRendezvous1
+	RelayRendezvous2
+	RelayDrop              // Circuit padding, discarded by the receiver
+	RelayPaddingNegotiate  // Data is the name of a padding machine
+	RelayPaddingNegotiated // Data is one status byte
+	RelaySendme            // Opens the sender's window; stream 0 for the circuit's
+)
+
+// Status carried in the first byte of a RelayPaddingNegotiated cell
+const (
+	PaddingNegotiateOK byte = iota
+	PaddingNegotiateRefused
+)
+
+// Status carried in the first byte of a RelayIntroduceAck cell
+const (
+	IntroduceAckSuccess byte = iota
+	IntroduceAckServiceUnknown
+	IntroduceAckBadMessage
+)
+
+// End reasons carried in the first byte of a RelayEnd cell
+const (
+	EndReasonMisc byte = iota + 1
+	EndReasonResolveFailed
+	EndReasonConnectRefused
+	EndReasonExitPolicy
+	EndReasonDestroy
+	EndReasonDone
+	EndReasonTimeout
+)
+
+// Flow control windows, counted in DATA cells as in Tor. Each side may
+// package a window's worth of cells before the other acknowledges them
+// with a SENDME, which opens the window by one increment. On circuits,
+// congestion control keeps the sender's window at or below CircuitWindow.
+const (
+	CircuitWindow          = 2000
+	CircuitSendmeIncrement = 100
+	StreamWindow           = 500
+	StreamSendmeIncrement  = 50
+)
+
+// MaxRelayData is the largest stream payload carried by one relay cell
+const MaxRelayData = 4096
+
+// RelayCellSize is the fixed size of every relay cell, so a cell's length
+// says nothing about its contents. It fits a full DATA cell and the larger
+// service control cells.
+const RelayCellSize = 6144
+
+// Relay cell layout: command(1) recognized(2) stream(2) digest(4)
+// length(2) data, then random padding up to RelayCellSize. Recognized is
+// zero and the digest matches the hop's running digest only once the hop
+// the cell is meant for has removed its layer.
+const (
+	relayRecognized = 1
+	relayStream     = 3
+	relayDigest     = 5
+	relayLength     = 9
+	relayHeaderSize = 11
+)
+
+// MaxCellData is the most data any one relay cell can carry
+const MaxCellData = RelayCellSize - relayHeaderSize
+
+// DNS record types understood by RelayResolve
+const (
+	RecordA     = "A"
+	RecordAAAA  = "AAAA"
+	RecordPTR   = "PTR"
+	RecordError = "ERROR"
+)
+
+// ResolvedTTL is the TTL exits report for every answer. Go's resolver does
+// not expose record TTLs, and a single clipped value also keeps clients'
+// cache timing from revealing what the exit had cached.
+const ResolvedTTL = 300
+
+// ResolveRequest asks the exit for the records of one name. An empty Type
+// means both A and AAAA; PTR takes an IP address as the name.
+type ResolveRequest struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+}
+
+// ResolvedAnswer is one record in a RelayResolved cell. A failed lookup is
+// a single answer of type RecordError whose value describes the failure.
+type ResolvedAnswer struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	TTL   uint32 `json:"ttl"`
+}
+
+// RelayCell is the plaintext inside a circuit's onion layers once the
+// endpoint has removed all of them
+type RelayCell struct {
+	Command  RelayCommand `json:"command"`
+	StreamID uint16       `json:"stream_id"`
+	Data     []byte       `json:"data,omitempty"`
+}
+
+// Encode lays the cell out in RelayCellSize bytes with its digest unset
+func (c *RelayCell) Encode() ([]byte, error) {
+	if len(c.Data) > MaxCellData {
+		return nil, fmt.Errorf("relay cell data too large: %d bytes", len(c.Data))
+	}
+
+	cell := make([]byte, RelayCellSize)
+	cell[0] = byte(c.Command)
+	binary.BigEndian.PutUint16(cell[relayStream:], c.StreamID)
+	binary.BigEndian.PutUint16(cell[relayLength:], uint16(len(c.Data)))
+	copy(cell[relayHeaderSize:], c.Data)
+	rand.Read(cell[relayHeaderSize+len(c.Data):])
+	return cell, nil
+}
+
+// DecodeRelayCell reads a cell once every layer has been removed
+func DecodeRelayCell(cell []byte) (*RelayCell, error) {
+	if len(cell) != RelayCellSize {
+		return nil, fmt.Errorf("relay cell is %d bytes, want %d", len(cell), RelayCellSize)
+	}
+	length := int(binary.BigEndian.Uint16(cell[relayLength:]))
+	if length > MaxCellData {
+		return nil, errors.New("relay cell length out of range")
+	}
+
+	return &RelayCell{
+		Command:  RelayCommand(cell[0]),
+		StreamID: binary.BigEndian.Uint16(cell[relayStream:]),
+		Data:     append([]byte(nil), cell[relayHeaderSize:relayHeaderSize+length]...),
+	}, nil
+}
+
+// SealRelayCell sets an encoded cell's digest from the running digest of
+// the hop it is meant for, before any layer is added
+func SealRelayCell(cell []byte, direction *crypto.RelayDirection) {
+	digest := cell[relayDigest : relayDigest+crypto.RelayDigestSize]
+	for i := range digest {
+		digest[i] = 0
+	}
+	copy(digest, direction.Digest(cell))
+}
+
+// RecognizeRelayCell reports whether a cell with one layer just removed is
+// meant for the hop owning direction, advancing its running digest if so
+func RecognizeRelayCell(cell []byte, direction *crypto.RelayDirection) bool {
+	if len(cell) != RelayCellSize || cell[relayRecognized] != 0 || cell[relayRecognized+1] != 0 {
+		return false
+	}
+
+	field := cell[relayDigest : relayDigest+crypto.RelayDigestSize]
+	expected := append([]byte(nil), field...)
+	for i := range field {
+		field[i] = 0
+	}
+	matched := direction.Matches(cell, expected)
+	copy(field, expected)
+	return matched
+}
+
+// EndReasonString describes a RelayEnd reason for log and error messages
+func EndReasonString(reason byte) string {
+	switch reason {
+	case EndReasonResolveFailed:
+		return "resolve failed"
+	case EndReasonConnectRefused:
+		return "connection refused"
+	case EndReasonExitPolicy:
+		return "exit policy"
+	case EndReasonDestroy:
+		return "circuit destroyed"
+	case EndReasonDone:
+		return "done"
+	case EndReasonTimeout:
+		return "timeout"
+	default:
+		return "misc"
+	}
+}
@@ -0,0 +1,201 @@
+package message
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"onion-network/pkg/crypto"
+)
+
+// DescriptorLifetime is how long a published descriptor stays valid
+const DescriptorLifetime = time.Hour
+
+// CookieSize is the length of a rendezvous cookie
+const CookieSize = 20
+
+// ServiceNode names a node inside onion service messages
+type ServiceNode struct {
+	ID        string         `json:"id"`
+	Address   string         `json:"address"`
+	Port      int            `json:"port"`
+	PublicKey *rsa.PublicKey `json:"public_key"`
+}
+
+// ServiceDescriptor is what an onion service publishes to the directory:
+// its key and the introduction points where it can be reached. A service
+// with client authorization publishes its introduction points encrypted
+// so only the listed clients can find them.
+type ServiceDescriptor struct {
+	Address              string             `json:"address"`
+	PublicKey            *rsa.PublicKey     `json:"public_key"`
+	IntroPoints          []ServiceNode      `json:"intro_points"`
+	EncryptedIntroPoints []byte             `json:"encrypted_intro_points,omitempty"`
+	AuthClients          []AuthorizedClient `json:"auth_clients,omitempty"`
+	Published            time.Time          `json:"published"`
+	Signature            []byte             `json:"signature,omitempty"`
+}
+
+// AuthorizedClient carries the key to a descriptor's introduction points,
+// encrypted to one client's authorization key
+type AuthorizedClient struct {
+	ID  string `json:"id"` // crypto.KeyID of the client's key
+	Key []byte `json:"key"`
+}
+
+// RequiresAuth reports whether the introduction points are encrypted
+func (d *ServiceDescriptor) RequiresAuth() bool {
+	return len(d.EncryptedIntroPoints) > 0
+}
+
+// EncryptIntroPoints replaces the descriptor's introduction points with a
+// copy only the given clients can decrypt. Call it before Sign.
+func (d *ServiceDescriptor) EncryptIntroPoints(clients []*rsa.PublicKey) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	plaintext, err := json.Marshal(d.IntroPoints)
+	if err != nil {
+		return err
+	}
+	gcm, err := crypto.NewLayerCipher(key)
+	if err != nil {
+		return err
+	}
+	if d.EncryptedIntroPoints, err = crypto.SealLayer(gcm, plaintext); err != nil {
+		return err
+	}
+
+	d.AuthClients = nil
+	for _, client := range clients {
+		encrypted, err := crypto.EncryptForKey(key, client)
+		if err != nil {
+			return err
+		}
+		d.AuthClients = append(d.AuthClients, AuthorizedClient{ID: crypto.KeyID(client), Key: encrypted})
+	}
+	d.IntroPoints = nil
+	return nil
+}
+
+// DecryptIntroPoints recovers the introduction points using a client's
+// authorization key
+func (d *ServiceDescriptor) DecryptIntroPoints(clientKey *rsa.PrivateKey) ([]ServiceNode, error) {
+	id := crypto.KeyID(&clientKey.PublicKey)
+	for _, client := range d.AuthClients {
+		if client.ID != id {
+			continue
+		}
+
+		key, err := crypto.DecryptForKey(client.Key, clientKey)
+		if err != nil {
+			return nil, err
+		}
+		gcm, err := crypto.NewLayerCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := crypto.OpenLayer(gcm, d.EncryptedIntroPoints)
+		if err != nil {
+			return nil, err
+		}
+
+		var introPoints []ServiceNode
+		if err := json.Unmarshal(plaintext, &introPoints); err != nil {
+			return nil, err
+		}
+		return introPoints, nil
+	}
+	return nil, fmt.Errorf("not authorized for %s", d.Address)
+}
+
+func (d *ServiceDescriptor) signedData() ([]byte, error) {
+	unsigned := *d
+	unsigned.Signature = nil
+	return json.Marshal(&unsigned)
+}
+
+// Sign signs the descriptor with the service's private key
+func (d *ServiceDescriptor) Sign(privateKey *rsa.PrivateKey) error {
+	data, err := d.signedData()
+	if err != nil {
+		return err
+	}
+	d.Signature, err = crypto.Sign(privateKey, data)
+	return err
+}
+
+// Verify checks that the descriptor was signed by the key its address is
+// derived from and has not expired
+func (d *ServiceDescriptor) Verify() error {
+	if d.PublicKey == nil {
+		return errors.New("descriptor has no public key")
+	}
+	if crypto.OnionAddress(d.PublicKey) != d.Address {
+		return fmt.Errorf("descriptor key does not match %s", d.Address)
+	}
+	if time.Since(d.Published) > DescriptorLifetime {
+		return errors.New("descriptor expired")
+	}
+
+	data, err := d.signedData()
+	if err != nil {
+		return err
+	}
+	if err := crypto.Verify(d.PublicKey, data, d.Signature); err != nil {
+		return errors.New("invalid descriptor signature")
+	}
+	return nil
+}
+
+// EstablishIntro registers a service circuit at an introduction point.
+// The signature covers the address and timestamp so only the key holder
+// can claim an address.
+type EstablishIntro struct {
+	PublicKey *rsa.PublicKey `json:"public_key"`
+	Timestamp int64          `json:"timestamp"`
+	Signature []byte         `json:"signature"`
+}
+
+// SignedData is the message covered by an EstablishIntro signature
+func (e *EstablishIntro) SignedData() []byte {
+	return []byte(fmt.Sprintf("establish-intro:%s:%d", crypto.OnionAddress(e.PublicKey), e.Timestamp))
+}
+
+// Introduce1 is sent by a client to an introduction point. Encrypted holds
+// an IntroduceData only the service can read.
+type Introduce1 struct {
+	ServiceAddress string `json:"service_address"`
+	Encrypted      []byte `json:"encrypted"`
+}
+
+// IntroduceData tells the service where to meet the client and which key
+// protects the joined circuit end to end. Services with client
+// authorization also need the client's key and its signature over
+// IntroduceAuthData.
+type IntroduceData struct {
+	RendezvousPoint ServiceNode    `json:"rendezvous_point"`
+	Cookie          []byte         `json:"cookie"`
+	Key             []byte         `json:"key"`
+	ClientKey       *rsa.PublicKey `json:"client_key,omitempty"`
+	ClientSignature []byte         `json:"client_signature,omitempty"`
+}
+
+// IntroduceAuthData is the message an authorized client signs, binding its
+// key to this service and rendezvous
+func IntroduceAuthData(address string, cookie []byte) []byte {
+	return []byte(fmt.Sprintf("introduce:%s:%x", address, cookie))
+}
+
+// Rendezvous1 is sent by the service to the rendezvous point. Handshake is
+// sealed with the end-to-end key and passed on to the client, proving the
+// service read the introduction.
+type Rendezvous1 struct {
+	Cookie    []byte `json:"cookie"`
+	Handshake []byte `json:"handshake"`
+}
@@ -0,0 +1,111 @@
+package message
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"onion-network/pkg/crypto"
+)
+
+// publish signs a service descriptor and sends it through JSON, as the
+// directory stores and serves it
+func publish(t *testing.T, d *ServiceDescriptor, sign func(*ServiceDescriptor) error) *ServiceDescriptor {
+	t.Helper()
+	if err := sign(d); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetched ServiceDescriptor
+	if err := json.Unmarshal(data, &fetched); err != nil {
+		t.Fatal(err)
+	}
+	return &fetched
+}
+
+func TestServiceDescriptorVerify(t *testing.T) {
+	k := keys(t)
+	service := func(published time.Time) *ServiceDescriptor {
+		return &ServiceDescriptor{
+			Address:     crypto.OnionAddress(&k[0].PublicKey),
+			PublicKey:   &k[0].PublicKey,
+			IntroPoints: []ServiceNode{{ID: "node_intro", Address: "192.0.2.1", Port: 9001, PublicKey: &k[2].PublicKey}},
+			Published:   published,
+		}
+	}
+	bySelf := func(d *ServiceDescriptor) error { return d.Sign(k[0]) }
+
+	d := publish(t, service(time.Now()), bySelf)
+	if err := d.Verify(); err != nil {
+		t.Fatalf("fetched descriptor does not verify: %v", err)
+	}
+
+	d.IntroPoints[0].Address = "203.0.113.5"
+	if d.Verify() == nil {
+		t.Error("introduction point redirected after signing")
+	}
+
+	d = publish(t, service(time.Now()), func(d *ServiceDescriptor) error { return d.Sign(k[1]) })
+	if d.Verify() == nil {
+		t.Error("descriptor signed by a key other than the address's")
+	}
+
+	d = publish(t, service(time.Now()), bySelf)
+	d.Address = crypto.OnionAddress(&k[1].PublicKey)
+	if d.Verify() == nil {
+		t.Error("descriptor served under another onion address")
+	}
+
+	d = publish(t, service(time.Now().Add(-DescriptorLifetime-time.Minute)), bySelf)
+	if d.Verify() == nil {
+		t.Error("expired descriptor verifies")
+	}
+}
+
+func TestIntroPointsOnlyForAuthorizedClients(t *testing.T) {
+	k := keys(t)
+	introPoints := []ServiceNode{
+		{ID: "node_a", Address: "192.0.2.1", Port: 9001, PublicKey: &k[2].PublicKey},
+		{ID: "node_b", Address: "192.0.2.2", Port: 9002, PublicKey: &k[2].PublicKey},
+	}
+	d := publish(t, &ServiceDescriptor{
+		Address:     crypto.OnionAddress(&k[2].PublicKey),
+		PublicKey:   &k[2].PublicKey,
+		IntroPoints: introPoints,
+		Published:   time.Now(),
+	}, func(d *ServiceDescriptor) error {
+		if err := d.EncryptIntroPoints([]*rsa.PublicKey{&k[0].PublicKey, &k[1].PublicKey}); err != nil {
+			return err
+		}
+		return d.Sign(k[2])
+	})
+	if err := d.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if !d.RequiresAuth() || d.IntroPoints != nil {
+		t.Fatal("introduction points published in the clear")
+	}
+
+	for i, client := range k[:2] {
+		got, err := d.DecryptIntroPoints(client)
+		if err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, introPoints) {
+			t.Errorf("client %d decrypted %+v, want %+v", i, got, introPoints)
+		}
+	}
+	if _, err := d.DecryptIntroPoints(k[2]); err == nil {
+		t.Error("unauthorized key decrypted the introduction points")
+	}
+
+	d.EncryptedIntroPoints[len(d.EncryptedIntroPoints)-1] ^= 1
+	if _, err := d.DecryptIntroPoints(k[0]); err == nil {
+		t.Error("tampered introduction points decrypted")
+	}
+}
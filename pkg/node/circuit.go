@@ -0,0 +1,397 @@
+package node
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"onion-network/pkg/bandwidth"
+	"onion-network/pkg/congestion"
+	"onion-network/pkg/crypto"
+	"onion-network/pkg/message"
+	"onion-network/pkg/padding"
+	"onion-network/pkg/transport"
+)
+
+var errCircuitDestroyed = errors.New("circuit destroyed")
+
+// relayCircuit is this node's state for one circuit passing through it
+type relayCircuit struct {
+	ID     string      // Circuit ID on the link from the previous hop
+	Prev   *Connection // Link towards the client
+	Next   *Connection // Link towards the exit, nil if the circuit ends here
+	NextID string      // Circuit ID on the link to the next hop
+	gcm    cipher.AEAD // Seals the create confirmation
+	relay  *crypto.RelayCrypto
+
+	streams   map[uint16]*exitStream
+	opening   map[uint16]bool // Streams whose BEGIN is still connecting
+	joined    *relayCircuit // Other half of a rendezvous, spliced at this node
+	padder    *padding.Padder
+	destroyed bool
+	mutex     sync.Mutex
+
+	// Flow control for the streams ending here, guarded by mutex
+	congestion    *congestion.Vegas // Circuit package window
+	deliverWindow int
+	consumed      int // DATA cells written or dropped since the last SENDME
+	windowSignal  chan struct{}
+
+	sendMutex sync.Mutex // Keeps backward cells in keystream order
+}
+
+func circuitKey(conn *Connection, circuitID string) string {
+	return conn.ID + "/" + circuitID
+}
+
+func (n *Node) lookupCircuit(conn *Connection, circuitID string) (*relayCircuit, bool) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	circ, exists := n.circuits[circuitKey(conn, circuitID)]
+	return circ, exists
+}
+
+// handleCreate removes this node's layer of a create onion, keeps the layer
+// key for the circuit and passes the rest of the onion to the next hop
+func (n *Node) handleCreate(conn *Connection, msg *message.OnionMessage) {
+	if n.refusesCircuits() {
+		conn.Send(message.DestroyMessage(msg.CircuitID, message.DestroyHibernating))
+		return
+	}
+	done, ok := n.admitCreate(conn, msg)
+	if !ok {
+		return
+	}
+	if n.Replay.Seen(msg.Payload) {
+		done()
+		n.logReplay("create layer")
+		return
+	}
+
+	decrypted, key, err := n.decryptCreate(msg.Payload)
+	done()
+	if err != nil {
+		fmt.Printf("[%s %s] ❌ Failed to decrypt create layer: %v\n", n.getTypeString(), n.ID, err)
+		return
+	}
+
+	info, err := message.FromJSON(decrypted)
+	if err != nil {
+		fmt.Printf("[%s %s] ❌ Invalid create layer: %v\n", n.getTypeString(), n.ID, err)
+		return
+	}
+	if !n.Replay.FreshTimestamp(info.Timestamp) {
+		fmt.Printf("[%s %s] ❌ Create layer timestamp outside replay window\n", n.getTypeString(), n.ID)
+		return
+	}
+
+	gcm, err := crypto.NewLayerCipher(key)
+	if err != nil {
+		fmt.Printf("[%s %s] ❌ Invalid layer key: %v\n", n.getTypeString(), n.ID, err)
+		return
+	}
+	relay, err := crypto.NewRelayCrypto(key, false)
+	if err != nil {
+		fmt.Printf("[%s %s] ❌ Invalid layer key: %v\n", n.getTypeString(), n.ID, err)
+		return
+	}
+
+	circ := &relayCircuit{
+		ID:      msg.CircuitID,
+		Prev:    conn,
+		gcm:     gcm,
+		relay:   relay,
+		streams: make(map[uint16]*exitStream),
+		opening: make(map[uint16]bool),
+
+		congestion:    congestion.NewVegas(message.CircuitSendmeIncrement, message.CircuitWindow),
+		deliverWindow: message.CircuitWindow,
+		windowSignal:  make(chan struct{}),
+	}
+
+	// The ID is checked and claimed under one lock, so of two creates with
+	// the same ID only one is taken. A circuit being extended keeps its
+	// claim while the next hop is dialed.
+	prevKey := circuitKey(conn, circ.ID)
+	n.mutex.Lock()
+	if _, exists := n.circuits[prevKey]; exists || n.extending[prevKey] {
+		n.mutex.Unlock()
+		fmt.Printf("[%s %s] ❌ Duplicate circuit %s\n", n.getTypeString(), n.ID, msg.CircuitID)
+		return
+	}
+	if info.IsLastHop {
+		n.circuits[prevKey] = circ
+	} else {
+		n.extending[prevKey] = true
+	}
+	n.mutex.Unlock()
+
+	if info.IsLastHop {
+		created, err := crypto.SealLayer(gcm, nil)
+		if err != nil {
+			return
+		}
+		fmt.Printf("[%s %s] 🔓 Circuit ends here, confirming to client\n", n.getTypeString(), n.ID)
+		conn.Send(&message.OnionMessage{Type: message.CircuitCreated, CircuitID: circ.ID, Payload: created})
+		return
+	}
+
+	next, err := n.getLink(info.NextHop)
+	if err != nil {
+		n.mutex.Lock()
+		delete(n.extending, prevKey)
+		n.mutex.Unlock()
+		fmt.Printf("[%s %s] ❌ Failed to connect to %s: %v\n", n.getTypeString(), n.ID, info.NextHop, err)
+		conn.Send(message.DestroyMessage(msg.CircuitID, message.DestroyConnectFailed))
+		return
+	}
+	circ.Next = next
+	circ.NextID = generateCircuitID()
+
+	n.mutex.Lock()
+	delete(n.extending, prevKey)
+	n.circuits[prevKey] = circ
+	n.circuits[circuitKey(next, circ.NextID)] = circ
+	n.mutex.Unlock()
+
+	fmt.Printf("[%s %s] 🔓 Decrypted create layer, extending circuit to %s\n", n.getTypeString(), n.ID, info.NextHop)
+	if err := next.Send(&message.OnionMessage{Type: message.CircuitCreate, CircuitID: circ.NextID, Payload: info.Payload}); err != nil {
+		fmt.Printf("[%s %s] ❌ Failed to forward create: %v\n", n.getTypeString(), n.ID, err)
+		n.destroyCircuit(circ, message.DestroyConnectFailed, next)
+	}
+}
+
+// handleCreated passes the next hop's confirmation back towards the client
+func (n *Node) handleCreated(conn *Connection, msg *message.OnionMessage) {
+	circ, exists := n.lookupCircuit(conn, msg.CircuitID)
+	if !exists || conn != circ.Next {
+		return
+	}
+
+	payload, err := crypto.SealLayer(circ.gcm, msg.Payload)
+	if err != nil {
+		return
+	}
+	fmt.Printf("[%s %s] ✅ Circuit extended, confirming to previous hop\n", n.getTypeString(), n.ID)
+	circ.Prev.Send(&message.OnionMessage{Type: message.CircuitCreated, CircuitID: circ.ID, Payload: payload})
+}
+
+// handleRelay removes this node's layer going forward and adds it going
+// back, so no single hop sees both the client and the cell contents. A
+// forward cell is handled here if it is recognized as meant for this hop.
+func (n *Node) handleRelay(conn *Connection, msg *message.OnionMessage) {
+	circ, exists := n.lookupCircuit(conn, msg.CircuitID)
+	if !exists {
+		return
+	}
+	// No replay check here: a replayed cell fails the running digest, and
+	// a filter false positive would drop a cell and desync the keystream
+	if len(msg.Payload) != message.RelayCellSize {
+		fmt.Printf("[%s %s] ❌ Relay cell of %d bytes\n", n.getTypeString(), n.ID, len(msg.Payload))
+		n.destroyCircuit(circ, message.DestroyProtocol, nil)
+		return
+	}
+
+	if conn == circ.Prev && msg.CircuitID == circ.ID {
+		payload := msg.Payload
+		circ.relay.Forward.Crypt(payload)
+
+		if message.RecognizeRelayCell(payload, circ.relay.Forward) {
+			cell, err := message.DecodeRelayCell(payload)
+			if err != nil {
+				fmt.Printf("[%s %s] ❌ Invalid relay cell: %v\n", n.getTypeString(), n.ID, err)
+				n.destroyCircuit(circ, message.DestroyProtocol, nil)
+				return
+			}
+			n.handleRelayCell(circ, cell)
+			return
+		}
+
+		if circ.Next != nil {
+			n.overfilled(circ, circ.Next.SendCell(&message.OnionMessage{Type: message.CircuitRelay, CircuitID: circ.NextID, Payload: payload}))
+			return
+		}
+
+		// Joined rendezvous circuits carry end-to-end encrypted cells this
+		// node cannot read; they go back down the other circuit
+		if joined := circ.joinedCircuit(); joined != nil {
+			n.relayBack(joined, payload)
+			return
+		}
+
+		// Nobody further on could recognize the cell, so it was modified
+		// on the way
+		fmt.Printf("[%s %s] ❌ Relay cell digest mismatch\n", n.getTypeString(), n.ID)
+		n.destroyCircuit(circ, message.DestroyProtocol, nil)
+		return
+	}
+
+	n.relayBack(circ, msg.Payload)
+}
+
+// relayBack adds this node's layer to a cell and sends it towards the client
+func (n *Node) relayBack(circ *relayCircuit, data []byte) error {
+	return n.sendBack(circ, data, false)
+}
+
+// sendBack encrypts a cell for the previous hop, first setting its digest
+// when this node originated it. Both the keystream and the digest are
+// sequential, so sealing, encrypting and sending happen under one lock.
+func (n *Node) sendBack(circ *relayCircuit, cell []byte, originated bool) error {
+	if circ.isDestroyed() {
+		return errCircuitDestroyed
+	}
+
+	circ.sendMutex.Lock()
+	if originated {
+		message.SealRelayCell(cell, circ.relay.Backward)
+	}
+	circ.relay.Backward.Crypt(cell)
+	err := circ.Prev.SendCell(&message.OnionMessage{Type: message.CircuitRelay, CircuitID: circ.ID, Payload: cell})
+	circ.sendMutex.Unlock()
+
+	return n.overfilled(circ, err)
+}
+
+// sendToClient encrypts a cell from this node back to the client
+func (n *Node) sendToClient(circ *relayCircuit, cell *message.RelayCell) error {
+	data, err := cell.Encode()
+	if err != nil {
+		return err
+	}
+	if err := n.sendBack(circ, data, true); err != nil {
+		return err
+	}
+
+	if cell.Command == message.RelayDrop {
+		n.CircuitPadding.PaddingSent.Add(1)
+	} else {
+		n.CircuitPadding.RealSent.Add(1)
+		circ.mutex.Lock()
+		padder := circ.padder
+		circ.mutex.Unlock()
+		padder.Activity()
+	}
+	return nil
+}
+
+// getLink returns an open link to addr, dialing one if needed
+func (n *Node) getLink(addr string) (*Connection, error) {
+	n.mutex.RLock()
+	link, exists := n.links[addr]
+	n.mutex.RUnlock()
+	if exists {
+		return link, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	socket := conn
+	conn = transport.Delay(bandwidth.Conn(conn, n.Bandwidth, n.Accounting), n.LinkDelay)
+
+	link = &Connection{
+		ID:         generateConnectionID(),
+		Conn:       conn,
+		Addr:       addr,
+		stats:      &n.LinkPadding,
+		challenges: make(chan []byte, 1),
+	}
+
+	n.mutex.Lock()
+	if existing, exists := n.links[addr]; exists {
+		n.mutex.Unlock()
+		conn.Close()
+		return existing, nil
+	}
+	n.startScheduler(link, socket)
+	n.links[addr] = link
+	n.Connections[link.ID] = link
+	n.mutex.Unlock()
+
+	go n.serveLink(link)
+	n.authenticateLink(link)
+	n.negotiateLinkPadding(link)
+	return link, nil
+}
+
+// handleDestroy tears down a circuit one of its neighbours destroyed and
+// passes the reason on to the other, so it reaches both ends
+func (n *Node) handleDestroy(conn *Connection, msg *message.OnionMessage) {
+	circ, exists := n.lookupCircuit(conn, msg.CircuitID)
+	if !exists {
+		return
+	}
+	n.destroyCircuit(circ, msg.DestroyReason(), conn)
+}
+
+// closeCircuitsOn destroys every circuit that used a link which has gone away
+func (n *Node) closeCircuitsOn(conn *Connection) {
+	var closed []*relayCircuit
+
+	n.mutex.RLock()
+	for _, circ := range n.circuits {
+		if circ.Prev == conn || circ.Next == conn {
+			closed = append(closed, circ)
+		}
+	}
+	n.mutex.RUnlock()
+
+	for _, circ := range closed {
+		n.destroyCircuit(circ, message.DestroyChannelClosed, conn)
+	}
+}
+
+// destroyCircuit frees a circuit and sends DESTROY with reason over each
+// link it used except from, the one the teardown arrived on. The other
+// half of a joined rendezvous circuit goes with it.
+func (n *Node) destroyCircuit(circ *relayCircuit, reason byte, from *Connection) {
+	n.mutex.Lock()
+	key := circuitKey(circ.Prev, circ.ID)
+	if n.circuits[key] != circ {
+		n.mutex.Unlock()
+		return
+	}
+	delete(n.circuits, key)
+	if circ.Next != nil {
+		delete(n.circuits, circuitKey(circ.Next, circ.NextID))
+	}
+	n.mutex.Unlock()
+
+	fmt.Printf("[%s %s] 💥 Destroying circuit %s: %s\n", n.getTypeString(), n.ID, circ.ID, message.DestroyReasonString(reason))
+
+	circ.Prev.dropCells(circ.ID)
+	if circ.Next != nil {
+		circ.Next.dropCells(circ.NextID)
+	}
+
+	if circ.Prev != from {
+		circ.Prev.Send(message.DestroyMessage(circ.ID, reason))
+	}
+	if circ.Next != nil && circ.Next != from {
+		circ.Next.Send(message.DestroyMessage(circ.NextID, reason))
+	}
+
+	joined := circ.joinedCircuit()
+	circ.stopPadding()
+	circ.closeStreams()
+	n.forgetServiceState(circ)
+	if joined != nil {
+		n.destroyCircuit(joined, message.DestroyDestroyed, nil)
+	}
+}
+
+func (circ *relayCircuit) isDestroyed() bool {
+	circ.mutex.Lock()
+	defer circ.mutex.Unlock()
+	return circ.destroyed
+}
+
+func (n *Node) logReplay(what string) {
+	fmt.Printf("[%s %s] 🔁 Dropped replayed %s (%s)\n", n.getTypeString(), n.ID, what, &n.Replay.Stats)
+}
@@ -0,0 +1,285 @@
+package node
+
+import (
+	"crypto/rsa"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"onion-network/pkg/crypto"
+	"onion-network/pkg/message"
+)
+
+// createOnion builds a one-layer create onion for n
+func createOnion(t *testing.T, n *Node, nextHop string) []byte {
+	t.Helper()
+	layers, err := crypto.CreateOnionLayers([]*rsa.PublicKey{n.OnionKey()}, []string{n.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &message.OnionMessage{Type: message.CircuitCreate, NextHop: nextHop, IsLastHop: nextHop == "", Timestamp: time.Now().Unix()}
+	data, err := info.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion, err := crypto.EncryptOnionLayer(data, layers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return onion
+}
+
+// clientLink is an inbound link to n whose messages are counted by type
+// until the test closes it
+func clientLink(t *testing.T, n *Node) (*Connection, func() map[message.MessageType]int) {
+	local, remote := net.Pipe()
+	counts := make(map[message.MessageType]int)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			msg, err := message.ReadMessage(remote)
+			if err != nil {
+				return
+			}
+			counts[msg.Type]++
+		}
+	}()
+	return &Connection{ID: "link", Conn: local, stats: &n.LinkPadding}, func() map[message.MessageType]int {
+		local.Close()
+		<-done
+		return counts
+	}
+}
+
+// nextHop listens for a node extending circuits to it and counts the
+// messages it receives by type, until the test ends
+func nextHop(t *testing.T) (string, func(message.MessageType) int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mutex sync.Mutex
+	var conns []net.Conn
+	counts := make(map[message.MessageType]int)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			conns = append(conns, conn)
+			mutex.Unlock()
+			go func() {
+				for {
+					msg, err := message.ReadMessage(conn)
+					if err != nil {
+						return
+					}
+					mutex.Lock()
+					counts[msg.Type]++
+					mutex.Unlock()
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return listener.Addr().String(), func(msgType message.MessageType) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return counts[msgType]
+	}
+}
+
+func TestDuplicateCreate(t *testing.T) {
+	n, err := NewNode(0, "127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _ := clientLink(t, n)
+	addr, forwarded := nextHop(t)
+
+	// Different onions, so the replay filter lets them all through. They
+	// are extended, so the first is still dialing when the others arrive.
+	const creates = 8
+	onions := make([][]byte, creates)
+	for i := range onions {
+		onions[i] = createOnion(t, n, addr)
+	}
+	var wg sync.WaitGroup
+	for _, onion := range onions {
+		wg.Add(1)
+		go func(onion []byte) {
+			defer wg.Done()
+			n.handleCreate(conn, &message.OnionMessage{Type: message.CircuitCreate, CircuitID: "circuit_same", Payload: onion})
+		}(onion)
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for forwarded(message.CircuitCreate) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if creates := forwarded(message.CircuitCreate); creates != 1 {
+		t.Errorf("%d creates with one circuit ID extended, want 1", creates)
+	}
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	if len(n.circuits) != 2 {
+		t.Errorf("%d circuit keys registered, want 2 for one circuit", len(n.circuits))
+	}
+}
+
+func TestFailedExtendReleasesCircuitID(t *testing.T) {
+	n, err := NewNode(0, "127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, received := clientLink(t, n)
+
+	// Nothing listens on a port just closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := listener.Addr().String()
+	listener.Close()
+
+	n.handleCreate(conn, &message.OnionMessage{Type: message.CircuitCreate, CircuitID: "circuit_extend", Payload: createOnion(t, n, unreachable)})
+	if counts := received(); counts[message.CircuitDestroy] != 1 {
+		t.Errorf("failed extend answered with %v, want one DESTROY", counts)
+	}
+	if len(n.circuits) != 0 || len(n.extending) != 0 {
+		t.Errorf("%d circuits and %d claims left", len(n.circuits), len(n.extending))
+	}
+}
+
+func TestTamperedCellDestroysCircuit(t *testing.T) {
+	n, err := NewNode(Exit, "127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	circ, cells := exitCircuit(t, n)
+	client, err := crypto.NewRelayCrypto(make([]byte, 32), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(tamper bool) {
+		cell, err := (&message.RelayCell{Command: message.RelayDrop}).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		message.SealRelayCell(cell, client.Forward)
+		client.Forward.Crypt(cell)
+		if tamper {
+			cell[len(cell)-1] ^= 1
+		}
+		n.handleRelay(circ.Prev, &message.OnionMessage{Type: message.CircuitRelay, CircuitID: circ.ID, Payload: cell})
+	}
+
+	send(false)
+	if got := n.CircuitPadding.PaddingReceived.Load(); got != 1 || circ.isDestroyed() {
+		t.Fatalf("untouched cell: %d received, destroyed %v", got, circ.isDestroyed())
+	}
+
+	send(true)
+	if got := n.CircuitPadding.PaddingReceived.Load(); got != 1 {
+		t.Error("tampered cell was acted on")
+	}
+	if !circ.isDestroyed() {
+		t.Fatal("circuit kept after a digest mismatch")
+	}
+	// The client is told, which closes its cells
+	for range cells {
+	}
+}
+
+// recordedLink is a link whose far end records the messages sent on it
+func recordedLink(t *testing.T, n *Node, id string) (*Connection, <-chan *message.OnionMessage) {
+	t.Helper()
+	local, remote := net.Pipe()
+	t.Cleanup(func() { local.Close() })
+	received := make(chan *message.OnionMessage, 16)
+	go func() {
+		for {
+			msg, err := message.ReadMessage(remote)
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+	return &Connection{ID: id, Conn: local, stats: &n.LinkPadding}, received
+}
+
+func TestDestroyReachesBothEnds(t *testing.T) {
+	tests := []struct {
+		name     string
+		fromNext bool
+		reason   byte
+	}{
+		{"from the client", false, message.DestroyRequested},
+		{"from the exit", true, message.DestroyResourceLimit},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n, err := NewNode(0, "127.0.0.1", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prev, towardsClient := recordedLink(t, n, "prev")
+			next, towardsExit := recordedLink(t, n, "next")
+			circ := &relayCircuit{ID: generateCircuitID(), NextID: generateCircuitID(), Prev: prev, Next: next, windowSignal: make(chan struct{})}
+			n.mutex.Lock()
+			n.circuits[circuitKey(prev, circ.ID)] = circ
+			n.circuits[circuitKey(next, circ.NextID)] = circ
+			n.mutex.Unlock()
+
+			from, fromID, to, toID, passed := prev, circ.ID, next, circ.NextID, towardsExit
+			if test.fromNext {
+				from, fromID, to, toID, passed = next, circ.NextID, prev, circ.ID, towardsClient
+			}
+			n.handleDestroy(from, message.DestroyMessage(fromID, test.reason))
+
+			select {
+			case msg := <-passed:
+				if msg.Type != message.CircuitDestroy || msg.CircuitID != toID || msg.DestroyReason() != test.reason {
+					t.Fatalf("passed on type %d for %s with reason %d", msg.Type, msg.CircuitID, msg.DestroyReason())
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("DESTROY not passed on")
+			}
+			if _, exists := n.lookupCircuit(to, toID); exists {
+				t.Error("circuit state kept")
+			}
+			if _, exists := n.lookupCircuit(from, fromID); exists {
+				t.Error("circuit state kept")
+			}
+		})
+	}
+}
+
+func TestDestroyClosesExitStreams(t *testing.T) {
+	n, err := NewNode(Exit, "127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	circ, _ := exitCircuit(t, n)
+	destination := pipeStream(t, n, circ, 1)
+
+	n.handleDestroy(circ.Prev, message.DestroyMessage(circ.ID, message.DestroyRequested))
+	destination.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := destination.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("stream's destination still open: %v", err)
+	}
+}
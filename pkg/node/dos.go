@@ -0,0 +1,264 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"onion-network/pkg/bandwidth"
+	"onion-network/pkg/dos"
+	"onion-network/pkg/message"
+	"onion-network/pkg/pow"
+)
+
+// RelayRefreshInterval is how often a node relearns from the directory
+// which addresses belong to relays, whose links the client limits exempt
+const RelayRefreshInterval = 10 * time.Minute
+
+// RelayRefetchInterval is how soon a link authenticated by a relay the
+// node does not know yet may make it relearn the relays
+const RelayRefetchInterval = 30 * time.Second
+
+// directoryClient asks the directory about relays, bounded so a slow
+// directory only delays the exemption of their links
+var directoryClient = &http.Client{Timeout: 10 * time.Second}
+
+// queueMemory counts the cell bytes queued on all of a node's links and
+// signals pressure once they pass the limit
+type queueMemory struct {
+	bytes    atomic.Int64
+	limit    int64
+	pressure chan struct{}
+}
+
+func (m *queueMemory) add(bytes int) {
+	if m.bytes.Add(int64(bytes)) > m.limit && m.limit > 0 {
+		select {
+		case m.pressure <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// startDoS sets up the limits in n.DoS before the node accepts links
+func (n *Node) startDoS(ctx context.Context) {
+	n.connLimit = dos.NewConnectionLimiter(n.DoS.MaxConnectionsPerIP)
+	n.circuitLimit = dos.NewCircuitLimiter(n.DoS.CircuitRate, n.DoS.CircuitBurst)
+	n.seeds = pow.NewSeeds()
+	n.queued.limit = n.DoS.MaxQueuedBytes
+	n.queued.pressure = make(chan struct{}, 1)
+
+	go n.refreshRelays(ctx)
+	go n.handleMemoryPressure(ctx)
+}
+
+// admitConnection counts a new inbound link against its address's limit.
+// The returned release must be called once the link closes.
+func (n *Node) admitConnection(conn net.Conn) (func(), bool) {
+	ip := remoteIP(conn)
+	if n.isRelay(ip) {
+		return func() {}, true
+	}
+	if !n.connLimit.Acquire(ip) {
+		n.DoSStats.RefusedConnections.Add(1)
+		return nil, false
+	}
+	return func() { n.connLimit.Release(ip) }, true
+}
+
+// admitCreate decides whether a create onion is worth decrypting. Every
+// admitted create counts as pending until the returned done is called
+// once it is decrypted.
+// Clients are held to their address's circuit rate, and must solve a
+// puzzle first while too many creates are waiting.
+func (n *Node) admitCreate(conn *Connection, msg *message.OnionMessage) (func(), bool) {
+	pending := n.pendingCreates.Add(1)
+	done := func() { n.pendingCreates.Add(-1) }
+
+	if n.DoS.MaxPendingCreates > 0 && pending > int64(n.DoS.MaxPendingCreates) {
+		done()
+		n.DoSStats.RefusedCircuits.Add(1)
+		conn.Send(message.DestroyMessage(msg.CircuitID, message.DestroyResourceLimit))
+		return nil, false
+	}
+	if conn.clientIP == "" || conn.relay.Load() || n.isRelay(conn.clientIP) {
+		return done, true
+	}
+
+	if n.DoS.PowThreshold >= 0 && pending > int64(n.DoS.PowThreshold) {
+		if !n.seeds.Verify(msg.Payload, msg.Proof, n.DoS.PowBits) {
+			done()
+			n.sendPuzzle(conn, msg.CircuitID)
+			return nil, false
+		}
+		n.DoSStats.Proofs.Add(1)
+	}
+
+	if !n.circuitLimit.Allow(conn.clientIP, time.Now()) {
+		done()
+		n.DoSStats.RefusedCircuits.Add(1)
+		conn.Send(message.DestroyMessage(msg.CircuitID, message.DestroyResourceLimit))
+		return nil, false
+	}
+	return done, true
+}
+
+func (n *Node) sendPuzzle(conn *Connection, circuitID string) {
+	puzzle, err := n.seeds.Puzzle(n.DoS.PowBits)
+	if err != nil {
+		conn.Send(message.DestroyMessage(circuitID, message.DestroyResourceLimit))
+		return
+	}
+	payload, err := json.Marshal(puzzle)
+	if err != nil {
+		return
+	}
+	n.DoSStats.Puzzles.Add(1)
+	conn.Send(&message.OnionMessage{Type: message.CircuitPuzzle, CircuitID: circuitID, Payload: payload})
+}
+
+// refreshRelays keeps the set of relay addresses current
+func (n *Node) refreshRelays(ctx context.Context) {
+	ticker := time.NewTicker(RelayRefreshInterval)
+	defer ticker.Stop()
+	for {
+		if err := n.fetchRelays(); err != nil {
+			fmt.Printf("[%s %s] ❌ Failed to fetch relay addresses: %v\n", n.getTypeString(), n.ID, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (n *Node) fetchRelays() error {
+	n.mutex.Lock()
+	n.relaysFetched = time.Now()
+	n.mutex.Unlock()
+
+	resp, err := directoryClient.Get(n.DirectoryURL + "/nodes")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("directory answered %s", resp.Status)
+	}
+
+	var nodes []struct {
+		ID      string `json:"id"`
+		Address string `json:"address"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+		return fmt.Errorf("invalid node list: %w", err)
+	}
+
+	relays := make(map[string]bool)
+	ids := make(map[string][]string)
+	for _, node := range nodes {
+		ids[node.ID] = resolveIPs(node.Address)
+		for _, ip := range ids[node.ID] {
+			relays[ip] = true
+		}
+	}
+
+	n.mutex.Lock()
+	n.relayIPs = relays
+	n.relayIDs = ids
+	n.mutex.Unlock()
+	return nil
+}
+
+// resolveIPs is the addresses a listed host stands for
+func resolveIPs(host string) []string {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{ip.String()}
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return nil
+	}
+	for i, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			addrs[i] = ip.String()
+		}
+	}
+	return addrs
+}
+
+func (n *Node) isRelay(ip string) bool {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.relayIPs[ip]
+}
+
+// remoteIP is the address a link comes from, without its port
+func remoteIP(conn net.Conn) string {
+	return addrIP(conn.RemoteAddr())
+}
+
+// addrIP is a link's address without its port
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// handleMemoryPressure is the node's out-of-memory handler: whenever the
+// queued cells pass the limit, circuits are destroyed largest queue first
+// until they are back under 90% of it, as Tor does at MaxMemInQueues
+func (n *Node) handleMemoryPressure(ctx context.Context) {
+	for {
+		select {
+		case <-n.queued.pressure:
+		case <-ctx.Done():
+			return
+		}
+
+		target := n.queued.limit * 9 / 10
+		if n.queued.bytes.Load() <= target {
+			continue
+		}
+
+		type queue struct {
+			circ  *relayCircuit
+			bytes int
+		}
+		var queues []queue
+		for _, circ := range n.circuitList() {
+			bytes := circ.Prev.queuedBytes(circ.ID)
+			if circ.Next != nil {
+				bytes += circ.Next.queuedBytes(circ.NextID)
+			}
+			if bytes > 0 {
+				queues = append(queues, queue{circ, bytes})
+			}
+		}
+		sort.Slice(queues, func(i, j int) bool { return queues[i].bytes > queues[j].bytes })
+
+		killed := 0
+		for _, q := range queues {
+			if n.queued.bytes.Load() <= target {
+				break
+			}
+			n.destroyCircuit(q.circ, message.DestroyResourceLimit, nil)
+			n.DoSStats.OOMKilled.Add(1)
+			killed++
+		}
+		fmt.Printf("[%s %s] 🧹 Out of queue memory, destroyed %d circuits (%s queued)\n",
+			n.getTypeString(), n.ID, killed, bandwidth.FormatBytes(n.queued.bytes.Load()))
+	}
+}
@@ -0,0 +1,252 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"onion-network/pkg/message"
+)
+
+// handleRelayCell acts on a cell addressed to this node as the circuit's end
+func (n *Node) handleRelayCell(circ *relayCircuit, cell *message.RelayCell) {
+	if cell.Command == message.RelayDrop {
+		n.CircuitPadding.PaddingReceived.Add(1)
+		return
+	}
+	n.CircuitPadding.RealReceived.Add(1)
+
+	switch cell.Command {
+	case message.RelayPaddingNegotiate:
+		n.handlePaddingNegotiate(circ, cell)
+	case message.RelayBegin:
+		if !n.Roles.Has(Exit) {
+			fmt.Printf("[%s %s] ❌ Refusing stream: not an exit node\n", n.getTypeString(), n.ID)
+			n.sendEnd(circ, cell.StreamID, message.EndReasonExitPolicy)
+			return
+		}
+		if !circ.openStream(cell.StreamID) {
+			// Reusing an ID would leave the first stream's connection
+			// open with nothing referring to it, so both are ended
+			fmt.Printf("[EXIT %s] ❌ Duplicate BEGIN for stream %d\n", n.ID, cell.StreamID)
+			circ.closeStream(cell.StreamID)
+			n.sendEnd(circ, cell.StreamID, message.EndReasonMisc)
+			return
+		}
+		go n.connectStream(circ, cell.StreamID, string(cell.Data))
+
+	case message.RelayData:
+		n.receiveData(circ, cell)
+
+	case message.RelaySendme:
+		n.handleSendme(circ, cell)
+
+	case message.RelayEnd:
+		circ.closeStream(cell.StreamID)
+
+	case message.RelayResolve:
+		go n.resolve(circ, cell)
+
+	case message.RelayEstablishIntro:
+		n.handleEstablishIntro(circ, cell)
+
+	case message.RelayIntroduce1:
+		n.handleIntroduce1(circ, cell)
+
+	case message.RelayEstablishRendezvous:
+		n.handleEstablishRendezvous(circ, cell)
+
+	case message.RelayRendezvous1:
+		n.handleRendezvous1(circ, cell)
+	}
+}
+
+// connectStream opens the exit's TCP connection for a stream and pumps the
+// destination's data back to the client
+func (n *Node) connectStream(circ *relayCircuit, streamID uint16, target string) {
+	fmt.Printf("[EXIT %s] 🌐 Opening stream %d to %s\n", n.ID, streamID, target)
+
+	addr, err := n.exitAddress(target)
+	if errors.Is(err, errExitPolicy) {
+		fmt.Printf("[EXIT %s] 🚫 Stream %d to %s refused by exit policy\n", n.ID, streamID, target)
+		if circ.stopOpening(streamID) {
+			n.sendEnd(circ, streamID, message.EndReasonExitPolicy)
+		}
+		return
+	}
+	if err != nil {
+		fmt.Printf("[EXIT %s] ❌ Stream %d to %s failed: %v\n", n.ID, streamID, target, err)
+		if circ.stopOpening(streamID) {
+			n.sendEnd(circ, streamID, endReasonFor(err))
+		}
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		fmt.Printf("[EXIT %s] ❌ Stream %d to %s failed: %v\n", n.ID, streamID, target, err)
+		if circ.stopOpening(streamID) {
+			n.sendEnd(circ, streamID, endReasonFor(err))
+		}
+		return
+	}
+
+	// The client may have ended the stream, or reused its ID, meanwhile
+	circ.mutex.Lock()
+	if circ.destroyed || !circ.opening[streamID] {
+		circ.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	delete(circ.opening, streamID)
+	stream := newExitStream(conn)
+	circ.streams[streamID] = stream
+	circ.mutex.Unlock()
+	go n.writeStream(circ, streamID, stream)
+
+	if err := n.sendToClient(circ, &message.RelayCell{Command: message.RelayConnected, StreamID: streamID}); err != nil {
+		circ.closeStream(streamID)
+		return
+	}
+
+	// Nothing is read from the destination while the client has not
+	// acknowledged enough of what it was sent
+	buffer := make([]byte, message.MaxRelayData)
+	for {
+		if circ.reservePackage(streamID) != nil {
+			return
+		}
+		bytesRead, err := conn.Read(buffer)
+		if bytesRead == 0 {
+			circ.releasePackage(streamID)
+		} else {
+			data := make([]byte, bytesRead)
+			copy(data, buffer[:bytesRead])
+			circ.packaged()
+			if n.sendToClient(circ, &message.RelayCell{Command: message.RelayData, StreamID: streamID, Data: data}) != nil {
+				circ.closeStream(streamID)
+				return
+			}
+		}
+		if err != nil {
+			// A stream the client already ended has been removed
+			if circ.closeStream(streamID) {
+				n.sendEnd(circ, streamID, message.EndReasonDone)
+			}
+			return
+		}
+	}
+}
+
+var errExitPolicy = errors.New("rejected by exit policy")
+
+// exitAddress checks target against the exit policy and returns the
+// address to dial. Unless the policy accepts everything, a host name is
+// resolved and its first address the policy accepts is dialed.
+func (n *Node) exitAddress(target string) (string, error) {
+	if n.ExitPolicy.AcceptsAll() {
+		return target, nil
+	}
+
+	host, portString, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	port, err := net.LookupPort("tcp", portString)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if n.ExitPolicy.Allows(addr.IP, port) {
+			return net.JoinHostPort(addr.IP.String(), strconv.Itoa(port)), nil
+		}
+	}
+	return "", errExitPolicy
+}
+
+func (n *Node) sendEnd(circ *relayCircuit, streamID uint16, reason byte) {
+	n.sendToClient(circ, &message.RelayCell{Command: message.RelayEnd, StreamID: streamID, Data: []byte{reason}})
+}
+
+// openStream claims a stream ID for a BEGIN, unless a stream already open
+// or still connecting has it
+func (circ *relayCircuit) openStream(streamID uint16) bool {
+	circ.mutex.Lock()
+	defer circ.mutex.Unlock()
+	if _, exists := circ.streams[streamID]; exists || circ.opening[streamID] {
+		return false
+	}
+	circ.opening[streamID] = true
+	return true
+}
+
+// stopOpening gives up a stream that failed to connect, reporting whether
+// it was still wanted
+func (circ *relayCircuit) stopOpening(streamID uint16) bool {
+	circ.mutex.Lock()
+	defer circ.mutex.Unlock()
+	wanted := circ.opening[streamID]
+	delete(circ.opening, streamID)
+	return wanted
+}
+
+// closeStream ends a stream, reporting whether it was open. Its writer
+// closes the connection after the data the client already sent. A stream
+// still connecting is closed once it connects.
+func (circ *relayCircuit) closeStream(streamID uint16) bool {
+	circ.mutex.Lock()
+	defer circ.mutex.Unlock()
+	stream, exists := circ.streams[streamID]
+	if exists {
+		close(stream.writes)
+	}
+	delete(circ.streams, streamID)
+	delete(circ.opening, streamID)
+	circ.windowChanged()
+	return exists
+}
+
+// closeStreams closes every stream when the circuit is destroyed
+func (circ *relayCircuit) closeStreams() {
+	circ.mutex.Lock()
+	circ.destroyed = true
+	streams := circ.streams
+	circ.streams = make(map[uint16]*exitStream)
+	circ.opening = make(map[uint16]bool)
+	for _, stream := range streams {
+		close(stream.writes)
+	}
+	circ.windowChanged()
+	circ.mutex.Unlock()
+
+	for _, stream := range streams {
+		stream.conn.Close()
+	}
+}
+
+// endReasonFor maps a dial error to the reason reported to the client
+func endReasonFor(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return message.EndReasonResolveFailed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return message.EndReasonConnectRefused
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return message.EndReasonTimeout
+	default:
+		return message.EndReasonMisc
+	}
+}
@@ -0,0 +1,134 @@
+package node
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"onion-network/pkg/congestion"
+	"onion-network/pkg/crypto"
+	"onion-network/pkg/message"
+)
+
+// exitCircuit is a circuit ending at n, with the client's relay keys and
+// the cells the client receives on it, which close when the circuit is
+// destroyed
+func exitCircuit(t *testing.T, n *Node) (*relayCircuit, <-chan *message.RelayCell) {
+	t.Helper()
+	key := make([]byte, 32)
+	relay, err := crypto.NewRelayCrypto(key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := crypto.NewRelayCrypto(key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() { local.Close() })
+	circ := &relayCircuit{
+		ID:            generateCircuitID(),
+		Prev:          &Connection{ID: "link", Conn: local, stats: &n.LinkPadding},
+		relay:         relay,
+		streams:       make(map[uint16]*exitStream),
+		opening:       make(map[uint16]bool),
+		congestion:    congestion.NewVegas(message.CircuitSendmeIncrement, message.CircuitWindow),
+		deliverWindow: message.CircuitWindow,
+		windowSignal:  make(chan struct{}),
+	}
+	n.mutex.Lock()
+	n.circuits[circuitKey(circ.Prev, circ.ID)] = circ
+	n.mutex.Unlock()
+
+	cells := make(chan *message.RelayCell, 16)
+	go func() {
+		defer close(cells)
+		for {
+			msg, err := message.ReadMessage(remote)
+			if err != nil || msg.Type == message.CircuitDestroy {
+				return
+			}
+			client.Backward.Crypt(msg.Payload)
+			cell, err := message.DecodeRelayCell(msg.Payload)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			cells <- cell
+		}
+	}()
+	return circ, cells
+}
+
+func nextCell(t *testing.T, cells <-chan *message.RelayCell) *message.RelayCell {
+	t.Helper()
+	select {
+	case cell := <-cells:
+		return cell
+	case <-time.After(5 * time.Second):
+		t.Fatal("no cell from the exit")
+		return nil
+	}
+}
+
+func TestDuplicateBegin(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	n, err := NewNode(Exit, "127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	circ, cells := exitCircuit(t, n)
+	begin := &message.RelayCell{Command: message.RelayBegin, StreamID: 1, Data: []byte(listener.Addr().String())}
+
+	n.handleRelayCell(circ, begin)
+	if cell := nextCell(t, cells); cell.Command != message.RelayConnected || cell.StreamID != 1 {
+		t.Fatalf("first BEGIN answered with command %d on stream %d", cell.Command, cell.StreamID)
+	}
+	first := <-accepted
+	defer first.Close()
+
+	n.handleRelayCell(circ, begin)
+	if cell := nextCell(t, cells); cell.Command != message.RelayEnd || cell.StreamID != 1 {
+		t.Fatalf("duplicate BEGIN answered with command %d on stream %d", cell.Command, cell.StreamID)
+	}
+
+	// The first stream's connection is closed rather than leaked, and the
+	// duplicate is not dialed
+	first.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := first.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("first stream's connection still open: %v", err)
+	}
+	select {
+	case conn := <-accepted:
+		conn.Close()
+		t.Error("duplicate BEGIN was dialed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	circ.mutex.Lock()
+	defer circ.mutex.Unlock()
+	if len(circ.streams) != 0 || len(circ.opening) != 0 {
+		t.Errorf("%d streams and %d connecting left", len(circ.streams), len(circ.opening))
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
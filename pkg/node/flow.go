@@ -0,0 +1,184 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"onion-network/pkg/message"
+)
+
+var errStreamClosed = errors.New("stream closed")
+
+// exitStream is a stream's destination connection, the client's data
+// waiting to be written to it and its flow control windows, guarded by the
+// circuit's mutex
+type exitStream struct {
+	conn          net.Conn
+	writes        chan []byte // Closed when the stream ends
+	packageWindow int
+	deliverWindow int
+	consumed      int // DATA cells written or dropped since the last SENDME
+}
+
+func newExitStream(conn net.Conn) *exitStream {
+	return &exitStream{
+		conn: conn,
+		// The stream window bounds the cells the client may have unwritten
+		writes:        make(chan []byte, message.StreamWindow),
+		packageWindow: message.StreamWindow,
+		deliverWindow: message.StreamWindow,
+	}
+}
+
+// windowChanged wakes everything waiting for a package window. The caller
+// holds circ.mutex.
+func (circ *relayCircuit) windowChanged() {
+	close(circ.windowSignal)
+	circ.windowSignal = make(chan struct{})
+}
+
+// reservePackage takes one DATA cell from the stream's package window and
+// the circuit's congestion window, waiting for the client's SENDMEs while
+// either is full. It fails once the stream or circuit is closed.
+func (circ *relayCircuit) reservePackage(streamID uint16) error {
+	for {
+		circ.mutex.Lock()
+		stream, exists := circ.streams[streamID]
+		if !exists || circ.destroyed {
+			circ.mutex.Unlock()
+			return errStreamClosed
+		}
+		if stream.packageWindow > 0 && circ.congestion.Reserve() {
+			stream.packageWindow--
+			circ.mutex.Unlock()
+			return nil
+		}
+		signal := circ.windowSignal
+		circ.mutex.Unlock()
+		<-signal
+	}
+}
+
+// releasePackage returns a reserved cell that was never sent
+func (circ *relayCircuit) releasePackage(streamID uint16) {
+	circ.mutex.Lock()
+	defer circ.mutex.Unlock()
+
+	circ.congestion.Release()
+	if stream, exists := circ.streams[streamID]; exists {
+		stream.packageWindow++
+	}
+	circ.windowChanged()
+}
+
+// packaged records that a reserved cell is about to be sent, for timing
+// its SENDME
+func (circ *relayCircuit) packaged() {
+	circ.mutex.Lock()
+	circ.congestion.Sent(time.Now())
+	circ.mutex.Unlock()
+}
+
+// handleSendme opens a package window. A SENDME beyond the full window
+// means the client is not following the protocol. Circuit SENDMEs also
+// time the round trip for congestion control.
+func (n *Node) handleSendme(circ *relayCircuit, cell *message.RelayCell) {
+	circ.mutex.Lock()
+	violation := false
+	if cell.StreamID == 0 {
+		violation = !circ.congestion.Acked(time.Now())
+	} else if stream, exists := circ.streams[cell.StreamID]; exists {
+		stream.packageWindow += message.StreamSendmeIncrement
+		violation = stream.packageWindow > message.StreamWindow
+	}
+	circ.windowChanged()
+	circ.mutex.Unlock()
+
+	if violation {
+		fmt.Printf("[%s %s] ❌ Unexpected SENDME on stream %d\n", n.getTypeString(), n.ID, cell.StreamID)
+		n.destroyCircuit(circ, message.DestroyProtocol, nil)
+	}
+}
+
+// receiveData counts a DATA cell from the client against the circuit's and
+// the stream's deliver windows and queues it for the stream's writer. The
+// windows reopen only as cells are written, so a client sending past them
+// is caught here and its circuit destroyed. A cell for a stream that is
+// gone is dropped and acknowledged at once.
+func (n *Node) receiveData(circ *relayCircuit, cell *message.RelayCell) {
+	circ.mutex.Lock()
+	circ.deliverWindow--
+	overran := circ.deliverWindow < 0
+	stream, exists := circ.streams[cell.StreamID]
+	if exists && !overran {
+		stream.deliverWindow--
+		overran = stream.deliverWindow < 0
+		if !overran {
+			stream.writes <- cell.Data
+		}
+	}
+	circ.mutex.Unlock()
+
+	if overran {
+		fmt.Printf("[%s %s] ❌ Client overran the window of stream %d\n", n.getTypeString(), n.ID, cell.StreamID)
+		n.destroyCircuit(circ, message.DestroyProtocol, nil)
+		return
+	}
+	if !exists {
+		n.consumed(circ, cell.StreamID, nil)
+	}
+}
+
+// consumed gives back the windows of a DATA cell that was written to the
+// destination or dropped, acknowledging every increment. stream is nil
+// once the stream is gone.
+func (n *Node) consumed(circ *relayCircuit, streamID uint16, stream *exitStream) {
+	circ.mutex.Lock()
+	circSendme, streamSendme := false, false
+	if circ.consumed++; circ.consumed >= message.CircuitSendmeIncrement {
+		circ.consumed -= message.CircuitSendmeIncrement
+		circ.deliverWindow += message.CircuitSendmeIncrement
+		circSendme = true
+	}
+	if stream != nil && circ.streams[streamID] == stream {
+		if stream.consumed++; stream.consumed >= message.StreamSendmeIncrement {
+			stream.consumed -= message.StreamSendmeIncrement
+			stream.deliverWindow += message.StreamSendmeIncrement
+			streamSendme = true
+		}
+	}
+	destroyed := circ.destroyed
+	circ.mutex.Unlock()
+
+	if destroyed {
+		return
+	}
+	if circSendme {
+		n.sendToClient(circ, &message.RelayCell{Command: message.RelaySendme})
+	}
+	if streamSendme {
+		n.sendToClient(circ, &message.RelayCell{Command: message.RelaySendme, StreamID: streamID})
+	}
+}
+
+// writeStream writes the client's data to the destination in order, off
+// the link's reader, so a slow destination holds up only its own stream.
+// Once the writes are closed and drained the connection is closed, which
+// keeps data the client sent before its END.
+func (n *Node) writeStream(circ *relayCircuit, streamID uint16, stream *exitStream) {
+	failed := false
+	for data := range stream.writes {
+		if !failed {
+			if _, err := stream.conn.Write(data); err != nil {
+				failed = true
+				if circ.closeStream(streamID) {
+					n.sendEnd(circ, streamID, message.EndReasonMisc)
+				}
+			}
+		}
+		n.consumed(circ, streamID, stream)
+	}
+	stream.conn.Close()
+}
@@ -0,0 +1,127 @@
+package node
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"onion-network/pkg/message"
+)
+
+// pipeStream opens a stream on circ whose destination is the returned end
+// of a pipe, which nothing reads until the test does
+func pipeStream(t *testing.T, n *Node, circ *relayCircuit, streamID uint16) net.Conn {
+	t.Helper()
+	local, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+	stream := newExitStream(local)
+	circ.mutex.Lock()
+	circ.streams[streamID] = stream
+	circ.mutex.Unlock()
+	go n.writeStream(circ, streamID, stream)
+	return remote
+}
+
+// sendData hands DATA cells to the exit as its link reader would, failing
+// if that blocks
+func sendData(t *testing.T, n *Node, circ *relayCircuit, streamID uint16, cells int) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < cells; i++ {
+			n.handleRelayCell(circ, &message.RelayCell{Command: message.RelayData, StreamID: streamID, Data: []byte{byte(i)}})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("link reader blocked on a stream's destination")
+	}
+}
+
+func TestSlowDestinationHoldsOnlyItsStream(t *testing.T) {
+	n, err := NewNode(Exit, "127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	circ, _ := exitCircuit(t, n)
+	pipeStream(t, n, circ, 1)
+	fast := pipeStream(t, n, circ, 2)
+
+	sendData(t, n, circ, 1, 10)
+	sendData(t, n, circ, 2, 1)
+
+	fast.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fast.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("other stream's data not written: %v", err)
+	}
+}
+
+func TestStreamSendmeFollowsWrites(t *testing.T) {
+	n, err := NewNode(Exit, "127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	circ, cells := exitCircuit(t, n)
+	destination := pipeStream(t, n, circ, 1)
+
+	sendData(t, n, circ, 1, message.StreamSendmeIncrement)
+	select {
+	case cell := <-cells:
+		t.Fatalf("command %d sent before the data was written", cell.Command)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := io.ReadFull(destination, make([]byte, message.StreamSendmeIncrement)); err != nil {
+		t.Fatal(err)
+	}
+	if cell := nextCell(t, cells); cell.Command != message.RelaySendme || cell.StreamID != 1 {
+		t.Fatalf("got command %d on stream %d, want the stream SENDME", cell.Command, cell.StreamID)
+	}
+}
+
+func TestClientOverrunningStreamWindowIsDestroyed(t *testing.T) {
+	n, err := NewNode(Exit, "127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	circ, cells := exitCircuit(t, n)
+	pipeStream(t, n, circ, 1)
+
+	// A full window is accepted while the destination stalls
+	sendData(t, n, circ, 1, message.StreamWindow)
+	if circ.isDestroyed() {
+		t.Fatal("circuit destroyed within the window")
+	}
+
+	sendData(t, n, circ, 1, 1)
+	if !circ.isDestroyed() {
+		t.Fatal("circuit kept after the client overran the stream window")
+	}
+	for range cells {
+	}
+}
+
+func TestClientOverrunningCircuitWindowIsDestroyed(t *testing.T) {
+	n, err := NewNode(Exit, "127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	circ, _ := exitCircuit(t, n)
+	streams := message.CircuitWindow / message.StreamWindow
+	for id := 1; id <= streams; id++ {
+		pipeStream(t, n, circ, uint16(id))
+		sendData(t, n, circ, uint16(id), message.StreamWindow)
+	}
+	if circ.isDestroyed() {
+		t.Fatal("circuit destroyed within the window")
+	}
+
+	pipeStream(t, n, circ, uint16(streams+1))
+	sendData(t, n, circ, uint16(streams+1), 1)
+	if !circ.isDestroyed() {
+		t.Fatal("circuit kept after the client overran the circuit window")
+	}
+}
@@ -0,0 +1,119 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"onion-network/pkg/message"
+)
+
+// AccountingInterval is how often a node with an accounting limit checks
+// whether to hibernate or wake
+const AccountingInterval = 10 * time.Second
+
+// IsHibernating reports whether the node is refusing new circuits, either
+// because it has used up its accounting allowance or because its operator
+// asked it to
+func (n *Node) IsHibernating() bool {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.hibernating || n.operatorHibernating
+}
+
+// refusesCircuits reports whether new circuits get DESTROY straight away
+func (n *Node) refusesCircuits() bool {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.hibernating || n.operatorHibernating || n.leaving
+}
+
+// Hibernate stops the node taking new circuits. Unlike running out of
+// allowance, it keeps serving the circuits it has, and it stays registered
+// so the directory knows it is coming back.
+func (n *Node) Hibernate() {
+	n.mutex.Lock()
+	n.operatorHibernating = true
+	n.mutex.Unlock()
+
+	fmt.Printf("[%s %s] 💤 Hibernating, refusing new circuits\n", n.getTypeString(), n.ID)
+	if err := n.registerWithDirectory(n.DirectoryURL); err != nil {
+		fmt.Printf("Warning: Failed to tell directory about hibernation: %v\n", err)
+	}
+}
+
+// Wake ends a hibernation started with Hibernate
+func (n *Node) Wake() {
+	n.mutex.Lock()
+	n.operatorHibernating = false
+	n.mutex.Unlock()
+
+	if n.IsHibernating() {
+		fmt.Printf("[%s %s] 💤 Still hibernating until the accounting period ends\n", n.getTypeString(), n.ID)
+		return
+	}
+	fmt.Printf("[%s %s] ☀️ Accepting circuits again\n", n.getTypeString(), n.ID)
+	if err := n.registerWithDirectory(n.DirectoryURL); err != nil {
+		fmt.Printf("Warning: Failed to register with directory: %v\n", err)
+	}
+}
+
+// runAccounting hibernates the node once its allowance is used up and wakes
+// it when a new accounting period starts
+func (n *Node) runAccounting(ctx context.Context) {
+	ticker := time.NewTicker(AccountingInterval)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		n.mutex.RLock()
+		hibernating := n.hibernating
+		n.mutex.RUnlock()
+		if n.Accounting.Rollover(now) && hibernating {
+			n.wake()
+		}
+		if n.Accounting.Exhausted() && !hibernating {
+			n.hibernate()
+		}
+	}
+}
+
+// hibernate tells the directory the node is unavailable and tears down its
+// circuits, so no more traffic counts against the spent allowance
+func (n *Node) hibernate() {
+	n.mutex.Lock()
+	n.hibernating = true
+	n.mutex.Unlock()
+	circuits := n.circuitList()
+
+	fmt.Printf("[%s %s] 💤 Accounting limit reached, hibernating: %s\n", n.getTypeString(), n.ID, n.Accounting)
+	if err := n.registerWithDirectory(n.DirectoryURL); err != nil {
+		fmt.Printf("Warning: Failed to tell directory about hibernation: %v\n", err)
+	}
+
+	for _, circ := range circuits {
+		n.destroyCircuit(circ, message.DestroyHibernating, nil)
+	}
+}
+
+// wake lists the node in the directory again at the start of a new period
+func (n *Node) wake() {
+	n.mutex.Lock()
+	n.hibernating = false
+	n.mutex.Unlock()
+
+	if n.IsHibernating() {
+		fmt.Printf("[%s %s] ☀️ New accounting period, still hibernating at operator's request\n", n.getTypeString(), n.ID)
+		return
+	}
+	fmt.Printf("[%s %s] ☀️ New accounting period, accepting circuits again\n", n.getTypeString(), n.ID)
+	if err := n.registerWithDirectory(n.DirectoryURL); err != nil {
+		fmt.Printf("Warning: Failed to register with directory: %v\n", err)
+	}
+}
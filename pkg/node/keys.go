@@ -0,0 +1,167 @@
+package node
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"onion-network/pkg/crypto"
+)
+
+// DefaultOnionKeyLifetime is how long a node uses an onion key before
+// rotating to a new one
+const DefaultOnionKeyLifetime = 7 * 24 * time.Hour
+
+// OnionKeyGrace is how long create onions encrypted to the previous onion
+// key are still accepted after a rotation, for clients that fetched the
+// node's descriptor before it
+const OnionKeyGrace = 24 * time.Hour
+
+// onionKeyCheckInterval is how often a node checks whether to rotate
+const onionKeyCheckInterval = time.Hour
+
+// Onion key files in the data directory
+const (
+	onionKeyFile    = "onion_key"
+	oldOnionKeyFile = "onion_key.old"
+)
+
+// onionKeys are the node's medium-term decryption keys
+type onionKeys struct {
+	current  *rsa.PrivateKey
+	created  time.Time       // When current was generated
+	previous *rsa.PrivateKey // Accepted until OnionKeyGrace after created
+}
+
+// OnionKey is the public half of the current onion key, which clients
+// encrypt create onions to
+func (n *Node) OnionKey() *rsa.PublicKey {
+	n.keyMutex.RLock()
+	defer n.keyMutex.RUnlock()
+	return &n.onionKeys.current.PublicKey
+}
+
+// decryptCreate removes this node's layer of a create onion with the
+// current onion key, or the previous one during its grace period
+func (n *Node) decryptCreate(payload []byte) ([]byte, []byte, error) {
+	n.keyMutex.RLock()
+	keys := n.onionKeys
+	n.keyMutex.RUnlock()
+
+	decrypted, key, err := crypto.DecryptOnionLayer(payload, keys.current)
+	if err == nil || keys.previous == nil || time.Since(keys.created) > OnionKeyGrace {
+		return decrypted, key, err
+	}
+	return crypto.DecryptOnionLayer(payload, keys.previous)
+}
+
+// keepOnionKeys rotates the onion key once it is OnionKeyLifetime old,
+// publishing the new one in a fresh descriptor, and forgets the previous
+// key when its grace period ends
+func (n *Node) keepOnionKeys(ctx context.Context) {
+	interval := onionKeyCheckInterval
+	if n.OnionKeyLifetime < interval {
+		interval = n.OnionKeyLifetime
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n.keyMutex.RLock()
+		keys := n.onionKeys
+		n.keyMutex.RUnlock()
+
+		if time.Since(keys.created) >= n.OnionKeyLifetime {
+			if err := n.rotateOnionKey(); err != nil {
+				fmt.Printf("[%s %s] ❌ Failed to rotate onion key: %v\n", n.getTypeString(), n.ID, err)
+			}
+		} else if keys.previous != nil && time.Since(keys.created) > OnionKeyGrace {
+			n.keyMutex.Lock()
+			n.onionKeys.previous = nil
+			n.keyMutex.Unlock()
+			if n.DataDirectory != "" {
+				os.Remove(filepath.Join(n.DataDirectory, oldOnionKeyFile))
+			}
+			fmt.Printf("[%s %s] 🔑 Previous onion key expired\n", n.getTypeString(), n.ID)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// rotateOnionKey replaces the onion key, keeping the old one for its
+// grace period, and registers a descriptor naming the new key
+func (n *Node) rotateOnionKey() error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+
+	n.keyMutex.Lock()
+	n.onionKeys = onionKeys{current: key, created: time.Now(), previous: n.onionKeys.current}
+	keys := n.onionKeys
+	n.keyMutex.Unlock()
+
+	if err := n.saveOnionKeys(keys); err != nil {
+		return err
+	}
+	fmt.Printf("[%s %s] 🔑 Rotated onion key to %s\n", n.getTypeString(), n.ID, crypto.KeyID(&key.PublicKey))
+	if err := n.registerWithDirectory(n.DirectoryURL); err != nil {
+		return fmt.Errorf("failed to publish new onion key: %w", err)
+	}
+	return nil
+}
+
+// loadOnionKeys reads the onion keys kept in the data directory, creating
+// a first one if there is none. created comes from the saved state.
+func (n *Node) loadOnionKeys(dir string, created time.Time) error {
+	current, err := crypto.LoadPrivateKey(filepath.Join(dir, onionKeyFile))
+	if errors.Is(err, os.ErrNotExist) {
+		if current, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			return err
+		}
+		created = time.Now()
+		if err := crypto.SavePrivateKey(filepath.Join(dir, onionKeyFile), current); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if created.IsZero() {
+		created = time.Now()
+	}
+
+	previous, err := crypto.LoadPrivateKey(filepath.Join(dir, oldOnionKeyFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	n.keyMutex.Lock()
+	n.onionKeys = onionKeys{current: current, created: created, previous: previous}
+	n.keyMutex.Unlock()
+	return nil
+}
+
+// saveOnionKeys writes both onion keys and their age to the data directory
+func (n *Node) saveOnionKeys(keys onionKeys) error {
+	if n.DataDirectory == "" {
+		return nil
+	}
+	if keys.previous != nil {
+		if err := crypto.SavePrivateKey(filepath.Join(n.DataDirectory, oldOnionKeyFile), keys.previous); err != nil {
+			return err
+		}
+	}
+	if err := crypto.SavePrivateKey(filepath.Join(n.DataDirectory, onionKeyFile), keys.current); err != nil {
+		return err
+	}
+	return n.saveState()
+}
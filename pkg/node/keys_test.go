@@ -0,0 +1,147 @@
+package node
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"onion-network/pkg/directory"
+)
+
+// listedOnionKey is the onion key the directory lists for a node
+func listedOnionKey(t *testing.T, directoryURL, id string) *rsa.PublicKey {
+	t.Helper()
+	resp, err := http.Get(directoryURL + "/nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var nodes []struct {
+		ID        string         `json:"id"`
+		PublicKey *rsa.PublicKey `json:"public_key"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		if node.ID == id {
+			return node.PublicKey
+		}
+	}
+	t.Fatalf("%s not listed", id)
+	return nil
+}
+
+func TestRotationPublishesKeyAndKeepsPreviousForGrace(t *testing.T) {
+	dir := httptest.NewServer(directory.NewDirectoryServer(0).Handler())
+	defer dir.Close()
+	n, err := NewNode(Guard, "127.0.0.1", 9001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.DirectoryURL = dir.URL
+	if err := n.registerWithDirectory(dir.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	old := n.OnionKey()
+	// Built by a client holding the descriptor from before the rotation
+	beforeRotation := [][]byte{createOnion(t, n, ""), createOnion(t, n, "")}
+	if err := n.rotateOnionKey(); err != nil {
+		t.Fatal(err)
+	}
+	if n.OnionKey().Equal(old) {
+		t.Fatal("onion key not rotated")
+	}
+	if listed := listedOnionKey(t, dir.URL, n.ID); !listed.Equal(n.OnionKey()) {
+		t.Error("directory does not list the new onion key")
+	}
+
+	if _, _, err := n.decryptCreate(createOnion(t, n, "")); err != nil {
+		t.Errorf("create to the new key: %v", err)
+	}
+	if _, _, err := n.decryptCreate(beforeRotation[0]); err != nil {
+		t.Errorf("create to the previous key during its grace period: %v", err)
+	}
+
+	n.keyMutex.Lock()
+	n.onionKeys.created = time.Now().Add(-OnionKeyGrace - time.Minute)
+	n.keyMutex.Unlock()
+	if _, _, err := n.decryptCreate(beforeRotation[1]); err == nil {
+		t.Error("create to the previous key accepted after its grace period")
+	}
+}
+
+func TestKeepOnionKeys(t *testing.T) {
+	dir := httptest.NewServer(directory.NewDirectoryServer(0).Handler())
+	defer dir.Close()
+	n, err := NewNode(Guard, "127.0.0.1", 9001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.DirectoryURL = dir.URL
+	n.DataDirectory = t.TempDir()
+	n.OnionKeyLifetime = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n.keepOnionKeys(ctx)
+	}()
+	stop := func() {
+		cancel()
+		<-done
+	}
+	defer stop()
+
+	old := n.OnionKey()
+	for deadline := time.Now().Add(10 * time.Second); n.OnionKey().Equal(old); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("onion key not rotated once its lifetime passed")
+		}
+	}
+	stop()
+
+	// A restarted node picks up both keys
+	restarted, err := NewNode(Guard, "127.0.0.1", 9001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.LoadDataDirectory(n.DataDirectory); err != nil {
+		t.Fatal(err)
+	}
+	n.keyMutex.RLock()
+	keys := n.onionKeys
+	n.keyMutex.RUnlock()
+	if !restarted.OnionKey().Equal(&keys.current.PublicKey) || restarted.onionKeys.previous == nil ||
+		!restarted.onionKeys.previous.PublicKey.Equal(&keys.previous.PublicKey) {
+		t.Error("restarted node did not load the saved onion keys")
+	}
+}
+
+func TestKeepOnionKeysForgetsExpiredPrevious(t *testing.T) {
+	n, err := NewNode(Guard, "127.0.0.1", 9001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.OnionKeyLifetime = DefaultOnionKeyLifetime
+	n.keyMutex.Lock()
+	n.onionKeys.previous = n.onionKeys.current
+	n.onionKeys.created = time.Now().Add(-OnionKeyGrace - time.Minute)
+	n.keyMutex.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n.keepOnionKeys(ctx)
+
+	n.keyMutex.RLock()
+	defer n.keyMutex.RUnlock()
+	if n.onionKeys.previous != nil {
+		t.Error("previous onion key kept after its grace period")
+	}
+}
@@ -0,0 +1,215 @@
+package node
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"onion-network/pkg/message"
+)
+
+// linkChallengeTimeout bounds how long a node that dialed a link waits for
+// the other end's challenge before extending circuits unauthenticated
+const linkChallengeTimeout = 10 * time.Second
+
+// sendChallenge sends an inbound link the nonce its authentication must
+// sign, so one that was seen on another link proves nothing here
+func (n *Node) sendChallenge(conn *Connection) error {
+	conn.challenge = make([]byte, 32)
+	if _, err := rand.Read(conn.challenge); err != nil {
+		return err
+	}
+	return conn.Send(&message.OnionMessage{Type: message.LinkChallenge, Payload: conn.challenge})
+}
+
+// receiveChallenge passes the first challenge on a dialed link to the
+// authentication waiting for it
+func (c *Connection) receiveChallenge(msg *message.OnionMessage) {
+	if c.challenges == nil {
+		return
+	}
+	select {
+	case c.challenges <- msg.Payload:
+	default:
+	}
+}
+
+// closeChallenges fails an authentication still waiting once the link's
+// reader stops
+func (c *Connection) closeChallenges() {
+	if c.challenges != nil {
+		close(c.challenges)
+	}
+}
+
+// authenticateLink tells the other end of a link this node dialed which
+// node it is, so circuits this node extends are not held to the limits of
+// one client. It waits for the other end's challenge, so the
+// authentication goes out before the creates that follow.
+func (n *Node) authenticateLink(conn *Connection) {
+	var challenge []byte
+	select {
+	case challenge = <-conn.challenges:
+	case <-time.After(linkChallengeTimeout):
+	}
+	if len(challenge) == 0 {
+		fmt.Printf("[%s %s] ❌ No link challenge from %s\n", n.getTypeString(), n.ID, conn.Addr)
+		return
+	}
+
+	auth := message.LinkAuth{
+		ID:          n.ID,
+		IdentityKey: &n.IdentityKey.PublicKey,
+		Address:     conn.Addr,
+		Challenge:   challenge,
+	}
+	if err := auth.Sign(n.IdentityKey); err != nil {
+		return
+	}
+	payload, err := json.Marshal(&auth)
+	if err != nil {
+		return
+	}
+	conn.Send(&message.OnionMessage{Type: message.LinkAuthenticate, Payload: payload})
+}
+
+// handleLinkAuth treats an inbound link as a relay's once it proves to
+// come from a listed relay or a bridge, at the address the directory has
+// for it, so a key registered once cannot exempt links from anywhere.
+// Bridges are not listed, and relays may have joined since the last
+// refresh, so the directory is asked off the link's reader; creates read
+// meanwhile are taken as a client's. Only the first authentication on a
+// link is looked at.
+func (n *Node) handleLinkAuth(conn *Connection, msg *message.OnionMessage) {
+	if conn.clientIP == "" || conn.authenticated {
+		return
+	}
+	conn.authenticated = true
+
+	var auth message.LinkAuth
+	if err := json.Unmarshal(msg.Payload, &auth); err != nil {
+		return
+	}
+	if err := auth.Verify(); err != nil {
+		fmt.Printf("[%s %s] ❌ Link authentication refused: %v\n", n.getTypeString(), n.ID, err)
+		return
+	}
+	if !n.isOwnAddress(conn, auth.Address) {
+		fmt.Printf("[%s %s] ❌ Link authentication for another address: %s\n", n.getTypeString(), n.ID, auth.Address)
+		return
+	}
+	if len(conn.challenge) == 0 || !bytes.Equal(auth.Challenge, conn.challenge) {
+		fmt.Printf("[%s %s] ❌ Link authentication for another link\n", n.getTypeString(), n.ID)
+		return
+	}
+
+	if n.isListedRelay(auth.ID, conn.clientIP) {
+		n.relayLink(conn, auth.ID)
+		return
+	}
+	go func() {
+		if n.refetchListedRelay(auth.ID, conn.clientIP) || n.isBridge(&auth, conn.clientIP) {
+			n.relayLink(conn, auth.ID)
+		}
+	}()
+}
+
+func (n *Node) relayLink(conn *Connection, id string) {
+	conn.relay.Store(true)
+	fmt.Printf("[%s %s] 🔗 Link %s authenticated by %s\n", n.getTypeString(), n.ID, conn.ID, id)
+}
+
+// isOwnAddress reports whether addr, as a link authentication names it,
+// is this node's. A node run without an address is listed at the one the
+// directory saw it register from, which dialers reach it at, so the
+// address the link arrived on stands in for it.
+func (n *Node) isOwnAddress(conn *Connection, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != strconv.Itoa(n.Port) {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	if ip := net.ParseIP(n.Address); n.Address == "" || (ip != nil && ip.IsUnspecified()) {
+		return host == conn.localIP
+	}
+	return host == n.Address
+}
+
+// isListedRelay reports whether the directory lists a node at ip
+func (n *Node) isListedRelay(id, ip string) bool {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	for _, addr := range n.relayIDs[id] {
+		if addr == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// refetchListedRelay relearns the relays, unless they were fetched just
+// now, so a relay that joined since the last refresh is not held to client
+// limits, and reports whether the node is now listed at ip
+func (n *Node) refetchListedRelay(id, ip string) bool {
+	n.mutex.RLock()
+	fetched := n.relaysFetched
+	n.mutex.RUnlock()
+	if time.Since(fetched) < RelayRefetchInterval {
+		return false
+	}
+
+	if err := n.fetchRelays(); err != nil {
+		fmt.Printf("[%s %s] ❌ Failed to fetch relay addresses: %v\n", n.getTypeString(), n.ID, err)
+		return false
+	}
+	return n.isListedRelay(id, ip)
+}
+
+// isBridge reports whether the directory knows the authenticating node as
+// a bridge with the same identity key at ip
+func (n *Node) isBridge(auth *message.LinkAuth, ip string) bool {
+	resp, err := directoryClient.Get(n.DirectoryURL + "/bridges/" + url.PathEscape(auth.ID))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+
+	var desc message.NodeDescriptor
+	if err := json.NewDecoder(resp.Body).Decode(&desc); err != nil {
+		return false
+	}
+	if desc.Verify() != nil || desc.ID != auth.ID || !desc.IdentityKey.Equal(auth.IdentityKey) {
+		return false
+	}
+	for _, addr := range resolveIPs(resp.Header.Get("X-Node-Address")) {
+		if addr == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// handlePuzzle answers a next hop that wants proof of work before taking
+// a create this node passed on. Only the client could solve it for its own
+// onion, and it cannot attach a proof to a layer this node forwards, so
+// the circuit is destroyed and the client builds another instead of
+// waiting for a confirmation that never comes.
+func (n *Node) handlePuzzle(conn *Connection, msg *message.OnionMessage) {
+	circ, exists := n.lookupCircuit(conn, msg.CircuitID)
+	if !exists || conn != circ.Next {
+		return
+	}
+	fmt.Printf("[%s %s] 🧩 Next hop asked circuit %s for proof of work\n", n.getTypeString(), n.ID, circ.ID)
+	n.destroyCircuit(circ, message.DestroyResourceLimit, nil)
+}
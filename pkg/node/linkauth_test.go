@@ -0,0 +1,190 @@
+package node
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"onion-network/pkg/directory"
+	"onion-network/pkg/message"
+)
+
+// link connects peer to middle as if peer dialed it at addr, with both
+// ends reading, and returns middle's and peer's ends of it and a function
+// closing it once middle has read everything sent
+func link(t *testing.T, middle, peer *Node, addr string) (*Connection, *Connection, func()) {
+	t.Helper()
+	local, remote := net.Pipe()
+	conn := &Connection{ID: "link", Conn: local, clientIP: "127.0.0.1", localIP: "127.0.0.1", stats: &middle.LinkPadding}
+	peerConn := &Connection{ID: "peer", Conn: remote, Addr: addr, stats: &peer.LinkPadding, challenges: make(chan []byte, 1)}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer local.Close()
+		if err := middle.sendChallenge(conn); err != nil {
+			t.Error(err)
+			return
+		}
+		middle.processMessages(conn)
+	}()
+	go func() {
+		defer peerConn.closeChallenges()
+		peer.processMessages(peerConn)
+	}()
+	return conn, peerConn, func() {
+		remote.Close()
+		<-done
+	}
+}
+
+// relayed waits for the directory lookups deciding whether a link is a
+// relay's, for a while if it is expected to be
+func relayed(conn *Connection, want bool) bool {
+	wait := 200 * time.Millisecond
+	if want {
+		wait = 5 * time.Second
+	}
+	for deadline := time.Now().Add(wait); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if conn.relay.Load() {
+			return true
+		}
+	}
+	return conn.relay.Load()
+}
+
+func TestLinkAuthentication(t *testing.T) {
+	dir := httptest.NewServer(directory.NewDirectoryServer(0).Handler())
+	defer dir.Close()
+
+	newPeer := func(roles Role, address string, register bool) *Node {
+		peer, err := NewNode(roles, address, 9002)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if register {
+			if err := peer.registerWithDirectory(dir.URL); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return peer
+	}
+
+	tests := []struct {
+		name    string
+		address string // The middle's configured address
+		peer    *Node
+		addr    string // As the peer dialed the middle
+		relay   bool
+	}{
+		{"listed relay", "127.0.0.1", newPeer(Guard, "127.0.0.1", true), "127.0.0.1:9001", true},
+		{"bridge", "127.0.0.1", newPeer(Bridge, "127.0.0.1", true), "127.0.0.1:9001", true},
+		{"unregistered node", "127.0.0.1", newPeer(Guard, "127.0.0.1", false), "127.0.0.1:9001", false},
+		{"other address", "127.0.0.1", newPeer(Exit, "127.0.0.1", true), "127.0.0.1:9003", false},
+		{"relay listed at another address", "127.0.0.1", newPeer(Guard, "192.0.2.9", true), "127.0.0.1:9001", false},
+		{"bridge at another address", "127.0.0.1", newPeer(Bridge, "192.0.2.9", true), "127.0.0.1:9001", false},
+		{"address seen by the directory", "", newPeer(Guard, "127.0.0.1", true), "127.0.0.1:9001", true},
+		{"other host of an unconfigured node", "", newPeer(Guard, "127.0.0.1", true), "192.0.2.7:9001", false},
+		{"other port of an unconfigured node", "", newPeer(Guard, "127.0.0.1", true), "127.0.0.1:9003", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			middle, err := NewNode(0, test.address, 9001)
+			if err != nil {
+				t.Fatal(err)
+			}
+			middle.DirectoryURL = dir.URL
+
+			conn, peerConn, closeLink := link(t, middle, test.peer, test.addr)
+			test.peer.authenticateLink(peerConn)
+			closeLink()
+
+			if relay := relayed(conn, test.relay); relay != test.relay {
+				t.Errorf("link treated as relay = %v, want %v", relay, test.relay)
+			}
+		})
+	}
+}
+
+func TestLinkAuthenticationIsBoundToItsLink(t *testing.T) {
+	dir := httptest.NewServer(directory.NewDirectoryServer(0).Handler())
+	defer dir.Close()
+	middle, err := NewNode(0, "127.0.0.1", 9001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	middle.DirectoryURL = dir.URL
+	peer, err := NewNode(Guard, "127.0.0.1", 9002)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.registerWithDirectory(dir.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// An authentication signed for one link, as an observer of it would
+	// replay it on their own
+	first, peerConn, closeFirst := link(t, middle, peer, "127.0.0.1:9001")
+	challenge := <-peerConn.challenges
+	auth := message.LinkAuth{ID: peer.ID, IdentityKey: &peer.IdentityKey.PublicKey, Address: "127.0.0.1:9001", Challenge: challenge}
+	if err := auth.Sign(peer.IdentityKey); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(&auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &message.OnionMessage{Type: message.LinkAuthenticate, Payload: payload}
+	if err := peerConn.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	closeFirst()
+	if !relayed(first, true) {
+		t.Fatal("authentication refused on its own link")
+	}
+
+	second, otherConn, closeSecond := link(t, middle, peer, "127.0.0.1:9001")
+	<-otherConn.challenges
+	if err := otherConn.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	closeSecond()
+	if relayed(second, false) {
+		t.Error("authentication replayed on another link accepted")
+	}
+}
+
+func TestSlowDirectoryDoesNotHoldLinkReader(t *testing.T) {
+	stalled := make(chan struct{})
+	dir := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stalled
+	}))
+	defer dir.Close()
+	defer close(stalled)
+
+	middle, err := NewNode(0, "127.0.0.1", 9001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	middle.DirectoryURL = dir.URL
+	peer, err := NewNode(Guard, "127.0.0.1", 9002)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, peerConn, closeLink := link(t, middle, peer, "127.0.0.1:9001")
+	peer.authenticateLink(peerConn)
+	closed := make(chan struct{})
+	go func() {
+		closeLink()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("link reader waiting for the directory")
+	}
+}
@@ -2,376 +2,487 @@ package node
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	mathrand "math/rand"
 	"net"
 	"net/http"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	
-	"onion-network/pkg/crypto"
+	"onion-network/pkg/bandwidth"
+	"onion-network/pkg/config"
+	"onion-network/pkg/dos"
+	"onion-network/pkg/message"
+	"onion-network/pkg/padding"
+	"onion-network/pkg/policy"
+	"onion-network/pkg/pow"
+	"onion-network/pkg/replay"
+	"onion-network/pkg/scheduler"
+	"onion-network/pkg/transport"
 )
 
-type NodeType int
+// StatusInterval is how often a running node logs its status
+const StatusInterval = 5 * time.Minute
 
-const (
-	Guard NodeType = iota
-	Relay
-	Exit
-)
+// RegisterInterval is how often a running node registers again, so the
+// directory keeps listing it
+const RegisterInterval = 2 * time.Minute
 
 type Node struct {
-	ID          string
-	Type        NodeType
-	Address     string
-	Port        int
-	PublicKey   *rsa.PublicKey
-	PrivateKey  *rsa.PrivateKey
-	Connections map[string]*Connection
-	mutex       sync.RWMutex
-	listener    net.Listener
+	ID           string
+	Roles        Role // Positions offered besides the middle
+	Address      string // Advertised to the directory, empty for the address it sees
+	ListenAddress string // Interface links are accepted on, empty for all
+	Port         int
+	IdentityKey  *rsa.PrivateKey // Long-term key the node's ID and descriptors come from
+	OnionKeyLifetime time.Duration // How long each onion key is used before rotating
+	Connections  map[string]*Connection
+	DirectoryURL string
+	DataDirectory string // Holds the identity key and state, empty to keep nothing
+	ExitPolicy   policy.Policy // Destinations an exit connects streams to
+	Family       []string // IDs of other nodes run by the same operator
+	Transport    transport.Transport // Wraps every accepted link
+	Padding      padding.Config
+	LinkDelay    time.Duration // Simulated delay on every link, for testing
+	Bandwidth    *bandwidth.Limit      // Token buckets for link traffic, nil for unlimited
+	Accounting   *bandwidth.Accounting // Traffic allowed per period, nil for unlimited
+	Scheduler    string // Orders the relay cells circuits queue on each link, see scheduler.Names
+	KIST         bool   // Write links only as fast as the kernel can send
+	ShutdownDrain time.Duration // How long circuits may finish once shutdown starts
+	DoS          dos.Config
+	
+	LinkPadding    padding.Stats // Link messages and link padding
+	CircuitPadding padding.Stats // Cells at circuit endpoints and DROP cells
+	Replay         *replay.Filter
+	DoSStats       dos.Stats
+	
+	circuits     map[string]*relayCircuit
+	extending    map[string]bool // Circuit keys claimed by creates dialing the next hop
+	links        map[string]*Connection
+	introPoints  map[string]*relayCircuit // Service circuits by onion address
+	rendezvous   map[string]*relayCircuit // Client circuits by rendezvous cookie
+	hibernating  bool // Accounting allowance used up
+	operatorHibernating bool
+	leaving      bool // Shutting down
+	mutex        sync.RWMutex
+	onionKeys    onionKeys
+	keyMutex     sync.RWMutex
+	listener     net.Listener
+	
+	// Denial-of-service defenses, set up by Start from DoS
+	connLimit      *dos.ConnectionLimiter
+	circuitLimit   *dos.CircuitLimiter
+	seeds          *pow.Seeds
+	relayIPs       map[string]bool // Addresses of listed relays, exempt from client limits
+	relayIDs       map[string][]string // Addresses of listed relays by ID, whose links from them authenticate
+	relaysFetched  time.Time
+	pendingCreates atomic.Int64
+	queued         queueMemory
 }
 
 type Connection struct {
-	ID        string
-	Conn      net.Conn
-	Cipher    []byte
-	PrevHop   net.Conn // Connection to previous hop for response routing
-	NextHop   net.Conn // Connection to next hop
-	CircuitID string
+	ID         string
+	Conn       net.Conn
+	Addr       string // Address this node dialed, empty for inbound links
+	clientIP   string // Address an inbound link comes from, empty for dialed ones
+	localIP    string // Address an inbound link reached this node at
+	relay      atomic.Bool // Inbound link authenticated by a listed relay or a bridge
+	authenticated bool // A link authentication was read, by the link's reader only
+	challenge  []byte // Nonce an inbound link's authentication must sign
+	challenges chan []byte // Nonces the far end of a dialed link sent, closed with the link
+	writeMutex sync.Mutex
+	stats      *padding.Stats
+	padder     *padding.Padder
+	
+	// Relay cells waiting for the link, in the scheduler's order
+	cellMutex    sync.Mutex
+	cellsChanged *sync.Cond
+	cells        scheduler.Scheduler
+	cellBytes    map[string]int // Queued payload bytes by circuit
+	cellsClosed  bool
+	memory       *queueMemory
 }
 
-func NewNode(nodeType NodeType, address string, port int) (*Node, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+// Send writes one message to the link
+func (c *Connection) Send(msg *message.OnionMessage) error {
+	_, err := c.send(msg, false)
+	return err
+}
+
+// sendPadding writes one link padding message
+func (c *Connection) sendPadding() error {
+	_, err := c.send(padding.PaddingMessage(), true)
+	return err
+}
+
+// send writes msg and returns the size of its frame on the link
+func (c *Connection) send(msg *message.OnionMessage, isPadding bool) (int, error) {
+	c.writeMutex.Lock()
+	written, err := message.WriteFrame(c.Conn, msg)
+	padder := c.padder
+	c.writeMutex.Unlock()
 	if err != nil {
-		return nil, err
+		return written, err
 	}
+	
+	if isPadding {
+		c.stats.PaddingSent.Add(1)
+	} else {
+		c.stats.RealSent.Add(1)
+		padder.Activity()
+	}
+	return written, nil
+}
 
-	// Use 0.0.0.0 to listen on all interfaces for Azure VMs
-	if address == "localhost" {
-		address = "0.0.0.0"
+// startPadding pads the link when idle, replacing any earlier schedule
+func (c *Connection) startPadding(schedule padding.Schedule) {
+	padder := padding.NewLinkPadder(schedule, c.sendPadding)
+	
+	c.writeMutex.Lock()
+	old := c.padder
+	c.padder = padder
+	c.writeMutex.Unlock()
+	old.Stop()
+}
+
+func (c *Connection) stopPadding() {
+	c.writeMutex.Lock()
+	padder := c.padder
+	c.padder = nil
+	c.writeMutex.Unlock()
+	padder.Stop()
+}
+
+func NewNode(roles Role, address string, port int) (*Node, error) {
+	identityKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	onionKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
 	}
 
 	return &Node{
-		ID:          generateNodeID(),
-		Type:        nodeType,
-		Address:     address,
-		Port:        port,
-		PublicKey:   &privateKey.PublicKey,
-		PrivateKey:  privateKey,
-		Connections: make(map[string]*Connection),
+		ID:           message.NodeID(&identityKey.PublicKey),
+		Roles:        roles,
+		Address:      address,
+		Port:         port,
+		IdentityKey:  identityKey,
+		OnionKeyLifetime: DefaultOnionKeyLifetime,
+		Connections:  make(map[string]*Connection),
+		DirectoryURL: config.DefaultDirectoryURL,
+		ExitPolicy:   policy.AcceptAll,
+		Transport:    transport.Plain{},
+		Scheduler:    "ewma",
+		KIST:         true,
+		ShutdownDrain: DefaultShutdownDrain,
+		DoS:          dos.DefaultConfig(),
+		Replay:       replay.NewFilter(),
+		circuits:     make(map[string]*relayCircuit),
+		extending:    make(map[string]bool),
+		links:        make(map[string]*Connection),
+		introPoints:  make(map[string]*relayCircuit),
+		rendezvous:   make(map[string]*relayCircuit),
+		onionKeys:    onionKeys{current: onionKey, created: time.Now()},
 	}, nil
 }
 
+// Start runs the node until the process exits
 func (n *Node) Start() error {
+	return n.Run(context.Background())
+}
+
+// Run serves the node until ctx is cancelled, then shuts it down gracefully
+func (n *Node) Run(ctx context.Context) error {
 	// Register with directory server
-	if err := n.registerWithDirectory("http://172.191.95.78:9000"); err != nil {
+	if err := n.registerWithDirectory(n.DirectoryURL); err != nil {
 		fmt.Printf("Warning: Failed to register with directory: %v\n", err)
 	}
 	
-	addr := fmt.Sprintf("%s:%d", n.Address, n.Port)
+	addr := net.JoinHostPort(n.ListenAddress, fmt.Sprint(n.Port))
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
 	
 	n.listener = listener
+	n.startDoS(ctx)
+	go n.reportStatus(ctx)
+	go n.keepRegistered(ctx)
+	go n.keepState(ctx)
+	go n.keepOnionKeys(ctx)
+	if n.Accounting != nil {
+		go n.runAccounting(ctx)
+	}
+	
+	accepting := make(chan struct{})
+	go func() {
+		defer close(accepting)
+		n.acceptLinks(listener)
+	}()
 	
+	<-ctx.Done()
+	n.shutdown()
+	<-accepting
+	return nil
+}
+
+// acceptLinks serves each connection to listener until it is closed
+func (n *Node) acceptLinks(listener net.Listener) {
+	var backoff time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Out of file descriptors and the like: wait rather than spin
+			backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+			fmt.Printf("[%s %s] ❌ Accept failed, retrying in %v: %v\n", n.getTypeString(), n.ID, backoff, err)
+			time.Sleep(backoff)
 			continue
 		}
+		backoff = 0
 		
-		go n.handleConnection(conn)
+		release, ok := n.admitConnection(conn)
+		if !ok {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer release()
+			n.handleConnection(conn)
+		}()
 	}
 }
 
 func (n *Node) registerWithDirectory(directoryURL string) error {
-	nodeType := ""
-	switch n.Type {
-	case Guard:
-		nodeType = "guard"
-	case Relay:
-		nodeType = "relay"
-	case Exit:
-		nodeType = "exit"
+	resp, err := n.postRegistration(directoryURL)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 	
-	nodeInfo := map[string]interface{}{
-		"id":         n.ID,
-		"type":       nodeType,
-		"address":    n.Address,
-		"port":       n.Port,
-		"public_key": n.PublicKey,
-	}
+	fmt.Printf("Registered with directory server: %s\n", resp.Status)
 	
-	jsonData, err := json.Marshal(nodeInfo)
-	if err != nil {
-		return err
+	// Bridges are unlisted, so the operator shares this line with users directly
+	if n.Roles.Has(Bridge) {
+		var result struct {
+			BridgeLine string `json:"bridge_line"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err == nil && result.BridgeLine != "" {
+			fmt.Printf("Bridge line: %s\n", result.BridgeLine)
+		}
+	}
+	return nil
+}
+
+// postRegistration sends the node's current descriptor to the directory
+func (n *Node) postRegistration(directoryURL string) (*http.Response, error) {
+	desc := message.NodeDescriptor{
+		ID:          n.ID,
+		Roles:       n.Roles.Names(),
+		Address:     n.Address,
+		Port:        n.Port,
+		PublicKey:   n.OnionKey(),
+		IdentityKey: &n.IdentityKey.PublicKey,
+		Hibernating: n.IsHibernating(),
+		Family:      n.Family,
+		Published:   time.Now(),
+	}
+	if n.Roles.Has(Exit) {
+		desc.ExitPolicy = n.ExitPolicy.String()
+	}
+	if name := n.Transport.Name(); name != "plain" {
+		desc.Transport = name
+		desc.TransportArgs = n.Transport.Args()
+	}
+	if err := desc.Sign(n.IdentityKey); err != nil {
+		return nil, err
 	}
 	
-	resp, err := http.Post(directoryURL+"/register", "application/json", bytes.NewBuffer(jsonData))
+	jsonData, err := json.Marshal(desc)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
 	
-	fmt.Printf("Registered with directory server: %s\n", resp.Status)
-	return nil
+	return http.Post(directoryURL+"/register", "application/json", bytes.NewBuffer(jsonData))
 }
 
 func (n *Node) handleConnection(conn net.Conn) {
-	defer conn.Close()
+	socket := conn
+	clientIP, localIP := remoteIP(conn), addrIP(conn.LocalAddr())
+	conn = bandwidth.Conn(conn, n.Bandwidth, n.Accounting)
+	wrapped, err := n.Transport.Server(conn)
+	if err != nil {
+		fmt.Printf("[%s] %s handshake failed: %v\n", n.getTypeString(), n.Transport.Name(), err)
+		conn.Close()
+		return
+	}
+	conn = transport.Delay(wrapped, n.LinkDelay)
 	
 	connID := generateConnectionID()
 	connection := &Connection{
-		ID:   connID,
-		Conn: conn,
+		ID:       connID,
+		Conn:     conn,
+		clientIP: clientIP,
+		localIP:  localIP,
+		stats:    &n.LinkPadding,
 	}
 	
+	n.startScheduler(connection, socket)
+	
 	n.mutex.Lock()
 	n.Connections[connID] = connection
 	n.mutex.Unlock()
 	
+	if err := n.sendChallenge(connection); err != nil {
+		connection.Conn.Close()
+	}
+	n.serveLink(connection)
+}
+
+// serveLink reads messages from a registered link until it closes
+func (n *Node) serveLink(conn *Connection) {
+	defer conn.Conn.Close()
+	defer conn.stopPadding()
+	defer conn.closeCells()
+	defer conn.closeChallenges()
+	
 	defer func() {
 		n.mutex.Lock()
-		delete(n.Connections, connID)
+		delete(n.Connections, conn.ID)
+		if conn.Addr != "" && n.links[conn.Addr] == conn {
+			delete(n.links, conn.Addr)
+		}
 		n.mutex.Unlock()
+		n.closeCircuitsOn(conn)
 	}()
 	
-	n.processMessages(connection)
+	n.processMessages(conn)
 }
 
 func (n *Node) processMessages(conn *Connection) {
-	buffer := make([]byte, 4096)
 	for {
-		bytesRead, err := conn.Conn.Read(buffer)
+		msg, err := message.ReadMessage(conn.Conn)
 		if err != nil {
-			fmt.Printf("Connection closed: %v\n", err)
+			if err != io.EOF {
+				fmt.Printf("[%s] Connection closed: %v\n", n.getTypeString(), err)
+			}
 			return
 		}
 		
-		data := buffer[:bytesRead]
-		fmt.Printf("[%s] Received %d bytes of data\n", n.getTypeString(), len(data))
-		
-		// Check if this is a response coming back
-		if len(data) > 9 && string(data[:9]) == "RESPONSE:" {
-			responseData := data[9:] // Remove "RESPONSE:" prefix
-			fmt.Printf("[%s] 🔙 Received response, routing back\n", n.getTypeString())
-			n.sendResponseBack(conn, responseData)
-			return
+		_, known := n.lookupCircuit(conn, msg.CircuitID)
+		if padding.IsPadding(msg, known) {
+			n.LinkPadding.PaddingReceived.Add(1)
+			continue
 		}
+		n.LinkPadding.RealReceived.Add(1)
 		
-		// Process based on node type (forward direction)
-		switch n.Type {
-		case Guard:
-			n.handleGuardMessages(conn, data)
-		case Relay:
-			n.handleRelayMessages(conn, data)
-		case Exit:
-			n.handleExitMessages(conn, data)
+		switch msg.Type {
+		case message.LinkPaddingNegotiate:
+			n.handleLinkPaddingNegotiate(conn, msg)
+		case message.LinkAuthenticate:
+			n.handleLinkAuth(conn, msg)
+		case message.LinkChallenge:
+			conn.receiveChallenge(msg)
+		case message.CircuitCreate:
+			go n.handleCreate(conn, msg)
+		case message.CircuitCreated:
+			n.handleCreated(conn, msg)
+		case message.CircuitRelay:
+			n.handleRelay(conn, msg)
+		case message.CircuitDestroy:
+			n.handleDestroy(conn, msg)
+		case message.CircuitPuzzle:
+			n.handlePuzzle(conn, msg)
+		default:
+			fmt.Printf("[%s] Ignoring message type %d\n", n.getTypeString(), msg.Type)
 		}
 	}
 }
 
-func (n *Node) getTypeString() string {
-	switch n.Type {
-	case Guard:
-		return "GUARD"
-	case Relay:
-		return "RELAY" 
-	case Exit:
-		return "EXIT"
-	default:
-		return "UNKNOWN"
-	}
-}
-
-func (n *Node) GetVirtualIP() string {
-	// Show REAL IP and location for security transparency
-	switch n.Type {
-	case Guard:
-		return "🌍 172.201.12.43 (Azure West Europe)"
-	case Relay:
-		return "🌍 68.218.3.154 (Azure Australia East)"
-	case Exit:
-		return "🌍 172.191.84.146 (Azure East US)"
-	default:
-		return "127.0.0.1 (localhost)"
-	}
-}
-
-func (n *Node) handleGuardMessages(conn *Connection, data []byte) {
-	fmt.Printf("[GUARD %s] Processing encrypted onion packet\n", n.ID)
-	
-	// REAL decryption of first layer
-	decrypted, _, err := crypto.DecryptOnionLayer(data, n.PrivateKey)
-	if err != nil {
-		fmt.Printf("[GUARD %s] ❌ Failed to decrypt layer: %v\n", n.ID, err)
-		return
-	}
-	
-	fmt.Printf("[GUARD %s] 🔓 Successfully decrypted layer, forwarding to relay\n", n.ID)
-	nextHop := "68.218.3.154:8081" // Relay node in Australia
-	n.forwardToNextHop(decrypted, nextHop, "RELAY")
-}
-
-func (n *Node) handleRelayMessages(conn *Connection, data []byte) {
-	fmt.Printf("[RELAY %s] Processing encrypted onion packet\n", n.ID)
-	
-	// REAL decryption of second layer
-	decrypted, _, err := crypto.DecryptOnionLayer(data, n.PrivateKey)
-	if err != nil {
-		fmt.Printf("[RELAY %s] ❌ Failed to decrypt layer: %v\n", n.ID, err)
-		return
-	}
+// Status summarizes what the node has handled since it started
+func (n *Node) Status() string {
+	n.mutex.RLock()
+	links, circuits := len(n.Connections), len(n.circuits)
+	n.mutex.RUnlock()
 	
-	fmt.Printf("[RELAY %s] 🔓 Successfully decrypted layer, forwarding to exit\n", n.ID)
-	nextHop := "172.191.84.146:8082" // Exit node in USA
-	n.forwardToNextHop(decrypted, nextHop, "EXIT")
-}
-
-func (n *Node) handleExitMessages(conn *Connection, data []byte) {
-	fmt.Printf("[EXIT %s] Processing final onion layer\n", n.ID)
-	
-	// REAL decryption of final layer
-	decrypted, _, err := crypto.DecryptOnionLayer(data, n.PrivateKey)
-	if err != nil {
-		fmt.Printf("[EXIT %s] ❌ Failed to decrypt final layer: %v\n", n.ID, err)
-		return
-	}
-	
-	fmt.Printf("[EXIT %s] 🔓 Successfully decrypted final layer - making REAL external request\n", n.ID)
-	
-	// Parse HTTP request from decrypted data
-	request := string(decrypted)
-	lines := strings.Split(request, "\r\n")
-	if len(lines) < 1 {
-		fmt.Printf("[EXIT %s] ❌ Invalid HTTP request\n", n.ID)
-		return
-	}
-	
-	// Extract URL from first line: "GET https://example.com HTTP/1.1"
-	parts := strings.Split(lines[0], " ")
-	if len(parts) < 2 {
-		fmt.Printf("[EXIT %s] ❌ Invalid HTTP request format\n", n.ID)
-		return
-	}
-	
-	requestURL := parts[1]
-	fmt.Printf("[EXIT %s] 🌐 Making REAL request to: %s\n", n.ID, requestURL)
-	
-	// Use direct connection for demo
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-	fmt.Printf("[EXIT %s] 🌐 Demo mode: Using direct connection\n", n.ID)
-	fmt.Printf("[EXIT %s] 📍 Simulating exit from virtual IP: 🇺🇸 198.51.100.123\n", n.ID)
-	fmt.Printf("[EXIT %s] 💡 In production: This would be a real server in USA\n", n.ID)
-	
-	resp, err := client.Get(requestURL)
-	if err != nil {
-		fmt.Printf("[EXIT %s] ❌ Request failed: %v\n", n.ID, err)
-		return
+	schedule := n.Scheduler
+	if n.KIST {
+		schedule += " with KIST"
 	}
-	defer resp.Body.Close()
 	
-	// Read response
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Printf("[EXIT %s] ❌ Failed to read response: %v\n", n.ID, err)
-		return
+	status := fmt.Sprintf("%d links, %d circuit keys\n  replay filter: %s\n  link padding: %s\n  circuit padding: %s\n  scheduler: %s\n  bandwidth: %s\n  accounting: %s\n  dos: %s, %s queued",
+		links, circuits, &n.Replay.Stats, &n.LinkPadding, &n.CircuitPadding, schedule, n.Bandwidth, n.Accounting,
+		&n.DoSStats, bandwidth.FormatBytes(n.queued.bytes.Load()))
+	if n.IsHibernating() {
+		status += " (hibernating)"
 	}
-	
-	fmt.Printf("[EXIT %s] ✅ SUCCESS! Got %d bytes from %s\n", n.ID, len(body), requestURL)
-	fmt.Printf("[EXIT %s] 📊 Response Status: %s\n", n.ID, resp.Status)
-	fmt.Printf("[EXIT %s] 📋 Response Preview: %.100s...\n", n.ID, string(body))
-	
-	// Send response back through circuit  
-	fmt.Printf("[EXIT %s] 🔄 Sending response back through circuit\n", n.ID)
-	response := fmt.Sprintf("HTTP/1.1 %s\r\nContent-Length: %d\r\n\r\n%s", resp.Status, len(body), string(body))
-	n.sendResponseBack(conn, []byte(response))
+	return status
 }
 
-func (n *Node) forwardToNextHop(data []byte, nextHop, hopType string) {
-	fmt.Printf("[%s %s] Connecting to %s at %s\n", n.getTypeString(), n.ID, hopType, nextHop)
-	
-	conn, err := net.Dial("tcp", nextHop)
-	if err != nil {
-		fmt.Printf("[%s %s] ❌ Failed to connect to %s: %v\n", n.getTypeString(), n.ID, hopType, err)
-		return
-	}
-	defer conn.Close()
-	
-	_, err = conn.Write(data)
-	if err != nil {
-		fmt.Printf("[%s %s] ❌ Failed to send data to %s: %v\n", n.getTypeString(), n.ID, hopType, err)
-		return
+// reportStatus logs the node's status every StatusInterval
+func (n *Node) reportStatus(ctx context.Context) {
+	ticker := time.NewTicker(StatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fmt.Printf("[%s %s] 📊 %s\n", n.getTypeString(), n.ID, n.Status())
+		case <-ctx.Done():
+			return
+		}
 	}
-	
-	fmt.Printf("[%s %s] ✅ Successfully forwarded to %s\n", n.getTypeString(), n.ID, hopType)
 }
 
-func (n *Node) sendResponseBack(conn *Connection, response []byte) {
-	// For simplicity, we'll just simulate sending response back
-	switch n.Type {
-	case Exit:
-		fmt.Printf("[EXIT %s] 🔙 Sending response to RELAY\n", n.ID)
-		n.sendToRelay(response)
-	case Relay:
-		fmt.Printf("[RELAY %s] 🔙 Sending response to GUARD\n", n.ID)
-		n.sendToGuard(response)
-	case Guard:
-		fmt.Printf("[GUARD %s] 🔙 Sending response to CLIENT\n", n.ID)
-		n.sendToClient(response)
+// keepRegistered quietly registers the node again every RegisterInterval
+func (n *Node) keepRegistered(ctx context.Context) {
+	ticker := time.NewTicker(RegisterInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			resp, err := n.postRegistration(n.DirectoryURL)
+			if err != nil {
+				fmt.Printf("Warning: Failed to register with directory: %v\n", err)
+				continue
+			}
+			resp.Body.Close()
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-func (n *Node) sendToRelay(data []byte) {
-	// Simulate encryption and send to relay
-	fmt.Printf("[EXIT %s] 🔒 Encrypting response for RELAY\n", n.ID)
-	relayConn, err := net.Dial("tcp", "68.218.3.154:8081")
-	if err != nil {
-		fmt.Printf("[EXIT %s] ❌ Failed to connect to relay for response\n", n.ID)
-		return
-	}
-	defer relayConn.Close()
-	
-	// Add a response marker so relay knows this is a response
-	responseData := append([]byte("RESPONSE:"), data...)
-	relayConn.Write(responseData)
-	fmt.Printf("[EXIT %s] ✅ Response sent to RELAY\n", n.ID)
+func (n *Node) getTypeString() string {
+	return n.Roles.String()
 }
 
-func (n *Node) sendToGuard(data []byte) {
-	fmt.Printf("[RELAY %s] 🔒 Encrypting response for GUARD\n", n.ID)
-	guardConn, err := net.Dial("tcp", "172.201.12.43:8080")
-	if err != nil {
-		fmt.Printf("[RELAY %s] ❌ Failed to connect to guard for response\n", n.ID)
-		return
+func (n *Node) GetVirtualIP() string {
+	// Show REAL IP and location for security transparency
+	switch {
+	case n.Roles.Has(Guard):
+		return "🌍 172.201.12.43 (Azure West Europe)"
+	case n.Roles.Has(Exit):
+		return "🌍 172.191.84.146 (Azure East US)"
+	case n.Roles == 0:
+		return "🌍 68.218.3.154 (Azure Australia East)"
+	default:
+		return "127.0.0.1 (localhost)"
 	}
-	defer guardConn.Close()
-	
-	responseData := append([]byte("RESPONSE:"), data...)
-	guardConn.Write(responseData)
-	fmt.Printf("[RELAY %s] ✅ Response sent to GUARD\n", n.ID)
-}
-
-func (n *Node) sendToClient(data []byte) {
-	fmt.Printf("[GUARD %s] 📡 Delivering response to CLIENT\n", n.ID)
-	fmt.Printf("[GUARD %s] 📄 Response Preview: %.200s...\n", n.ID, string(data))
-	fmt.Printf("[GUARD %s] ✅ Response delivered to CLIENT!\n", n.ID)
 }
 
-func generateNodeID() string {
-	// Generate unique node ID
-	return "node_" + randomString(16)
+func generateCircuitID() string {
+	return "circuit_" + randomString(12)
 }
 
 func generateConnectionID() string {
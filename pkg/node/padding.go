@@ -0,0 +1,86 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"onion-network/pkg/message"
+	"onion-network/pkg/padding"
+)
+
+// negotiateLinkPadding asks the other end of a link this node dialed to
+// pad it, and pads it from this side too
+func (n *Node) negotiateLinkPadding(conn *Connection) {
+	if !n.Padding.Link {
+		return
+	}
+
+	payload, err := json.Marshal(padding.LinkParams(n.Padding.LinkSchedule))
+	if err != nil {
+		return
+	}
+	conn.startPadding(n.Padding.LinkSchedule)
+	conn.Send(&message.OnionMessage{Type: message.LinkPaddingNegotiate, Payload: payload})
+}
+
+// handleLinkPaddingNegotiate starts or stops padding a link at the peer's
+// request, if this node pads links at all, and says what it agreed to
+func (n *Node) handleLinkPaddingNegotiate(conn *Connection, msg *message.OnionMessage) {
+	var params message.LinkPaddingParams
+	if err := json.Unmarshal(msg.Payload, &params); err != nil {
+		return
+	}
+	if params.Ack {
+		if !params.Enabled {
+			fmt.Printf("[%s %s] Peer declined link padding\n", n.getTypeString(), n.ID)
+		}
+		return
+	}
+
+	reply := message.LinkPaddingParams{Ack: true}
+	if params.Enabled && n.Padding.Link {
+		schedule := padding.ScheduleFrom(params)
+		conn.startPadding(schedule)
+		reply = padding.LinkParams(schedule)
+		reply.Ack = true
+	} else {
+		conn.stopPadding()
+	}
+
+	payload, err := json.Marshal(&reply)
+	if err != nil {
+		return
+	}
+	conn.Send(&message.OnionMessage{Type: message.LinkPaddingNegotiate, Payload: payload})
+}
+
+// handlePaddingNegotiate runs the padding machine a client asked for on its
+// circuit, sending DROP cells back towards it
+func (n *Node) handlePaddingNegotiate(circ *relayCircuit, cell *message.RelayCell) {
+	machine, exists := padding.Machines[string(cell.Data)]
+	if !exists || !n.Padding.Circuit {
+		n.sendToClient(circ, &message.RelayCell{Command: message.RelayPaddingNegotiated, Data: []byte{message.PaddingNegotiateRefused}})
+		return
+	}
+
+	padder := padding.NewPadder(machine, func() error {
+		return n.sendToClient(circ, &message.RelayCell{Command: message.RelayDrop})
+	})
+
+	circ.mutex.Lock()
+	old := circ.padder
+	circ.padder = padder
+	circ.mutex.Unlock()
+	old.Stop()
+
+	fmt.Printf("[%s %s] 🎭 Padding circuit with %s machine\n", n.getTypeString(), n.ID, machine.Name)
+	n.sendToClient(circ, &message.RelayCell{Command: message.RelayPaddingNegotiated, Data: []byte{message.PaddingNegotiateOK}})
+}
+
+func (circ *relayCircuit) stopPadding() {
+	circ.mutex.Lock()
+	padder := circ.padder
+	circ.padder = nil
+	circ.mutex.Unlock()
+	padder.Stop()
+}
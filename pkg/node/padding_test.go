@@ -0,0 +1,107 @@
+package node
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"onion-network/pkg/message"
+	"onion-network/pkg/padding"
+)
+
+// readFrame reads one length-prefixed frame off a link, whole
+func readFrame(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestPaddingFramesMatchRelayFrames(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	var stats padding.Stats
+	conn := &Connection{ID: "link", Conn: local, stats: &stats}
+	relay := &message.OnionMessage{
+		Type:      message.CircuitRelay,
+		CircuitID: generateCircuitID(),
+		Payload:   make([]byte, message.RelayCellSize),
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for i := 0; i < 3; i++ {
+			conn.sendPadding()
+			conn.Send(relay)
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		padded := readFrame(t, remote)
+		real := readFrame(t, remote)
+		if len(padded) != len(real) {
+			t.Fatalf("padding frame is %d bytes, relay frame %d", len(padded), len(real))
+		}
+
+		msg, err := message.FromJSON(padded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != message.CircuitRelay || len(msg.CircuitID) != len(relay.CircuitID) {
+			t.Fatalf("padding frame has type %d and circuit ID %q", msg.Type, msg.CircuitID)
+		}
+	}
+	<-finished
+
+	if sent := stats.PaddingSent.Load(); sent != 3 {
+		t.Errorf("PaddingSent = %d, want 3", sent)
+	}
+	if sent := stats.RealSent.Load(); sent != 3 {
+		t.Errorf("RealSent = %d, want 3", sent)
+	}
+}
+
+func TestPaddingCountedOnReceipt(t *testing.T) {
+	n, err := NewNode(Guard, "127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, remote := net.Pipe()
+	defer local.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n.processMessages(&Connection{ID: "link", Conn: local, stats: &n.LinkPadding})
+	}()
+
+	var stats padding.Stats
+	peer := &Connection{ID: "peer", Conn: remote, stats: &stats}
+	for i := 0; i < 4; i++ {
+		if err := peer.sendPadding(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := peer.Send(message.DestroyMessage(generateCircuitID(), message.DestroyFinished)); err != nil {
+		t.Fatal(err)
+	}
+	remote.Close()
+	<-done
+
+	if received := n.LinkPadding.PaddingReceived.Load(); received != 4 {
+		t.Errorf("PaddingReceived = %d, want 4", received)
+	}
+	if received := n.LinkPadding.RealReceived.Load(); received != 1 {
+		t.Errorf("RealReceived = %d, want 1", received)
+	}
+}
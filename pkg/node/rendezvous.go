@@ -0,0 +1,143 @@
+package node
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"onion-network/pkg/crypto"
+	"onion-network/pkg/message"
+)
+
+// introTimestampWindow is how far an EstablishIntro timestamp may be from
+// this node's clock
+const introTimestampWindow = 10 * time.Minute
+
+func (circ *relayCircuit) joinedCircuit() *relayCircuit {
+	circ.mutex.Lock()
+	defer circ.mutex.Unlock()
+	return circ.joined
+}
+
+// handleEstablishIntro makes this node an introduction point for the
+// service whose signed key arrives on circ
+func (n *Node) handleEstablishIntro(circ *relayCircuit, cell *message.RelayCell) {
+	var req message.EstablishIntro
+	if err := json.Unmarshal(cell.Data, &req); err != nil || req.PublicKey == nil {
+		fmt.Printf("[%s %s] ❌ Invalid introduction request\n", n.getTypeString(), n.ID)
+		return
+	}
+
+	skew := time.Since(time.Unix(req.Timestamp, 0))
+	if skew > introTimestampWindow || skew < -introTimestampWindow {
+		fmt.Printf("[%s %s] ❌ Stale introduction request\n", n.getTypeString(), n.ID)
+		return
+	}
+	if err := crypto.Verify(req.PublicKey, req.SignedData(), req.Signature); err != nil {
+		fmt.Printf("[%s %s] ❌ Bad introduction signature\n", n.getTypeString(), n.ID)
+		return
+	}
+
+	address := crypto.OnionAddress(req.PublicKey)
+	n.mutex.Lock()
+	n.introPoints[address] = circ
+	n.mutex.Unlock()
+
+	fmt.Printf("[%s %s] 🚪 Introduction point for %s\n", n.getTypeString(), n.ID, address)
+	n.sendToClient(circ, &message.RelayCell{Command: message.RelayIntroEstablished})
+}
+
+// handleIntroduce1 passes a client's introduction to the service. The
+// payload is encrypted to the service, so this node learns nothing about
+// where the client wants to meet.
+func (n *Node) handleIntroduce1(circ *relayCircuit, cell *message.RelayCell) {
+	var req message.Introduce1
+	if err := json.Unmarshal(cell.Data, &req); err != nil {
+		n.sendToClient(circ, &message.RelayCell{Command: message.RelayIntroduceAck, Data: []byte{message.IntroduceAckBadMessage}})
+		return
+	}
+
+	n.mutex.RLock()
+	service, exists := n.introPoints[req.ServiceAddress]
+	n.mutex.RUnlock()
+	if !exists {
+		n.sendToClient(circ, &message.RelayCell{Command: message.RelayIntroduceAck, Data: []byte{message.IntroduceAckServiceUnknown}})
+		return
+	}
+
+	fmt.Printf("[%s %s] 🚪 Introducing client to %s\n", n.getTypeString(), n.ID, req.ServiceAddress)
+	status := message.IntroduceAckSuccess
+	if err := n.sendToClient(service, &message.RelayCell{Command: message.RelayIntroduce2, Data: cell.Data}); err != nil {
+		status = message.IntroduceAckServiceUnknown
+	}
+	n.sendToClient(circ, &message.RelayCell{Command: message.RelayIntroduceAck, Data: []byte{status}})
+}
+
+// handleEstablishRendezvous parks a client circuit under its cookie until
+// the service arrives
+func (n *Node) handleEstablishRendezvous(circ *relayCircuit, cell *message.RelayCell) {
+	if len(cell.Data) != message.CookieSize {
+		fmt.Printf("[%s %s] ❌ Invalid rendezvous cookie\n", n.getTypeString(), n.ID)
+		return
+	}
+
+	n.mutex.Lock()
+	n.rendezvous[hex.EncodeToString(cell.Data)] = circ
+	n.mutex.Unlock()
+
+	fmt.Printf("[%s %s] 🤝 Rendezvous point waiting for service\n", n.getTypeString(), n.ID)
+	n.sendToClient(circ, &message.RelayCell{Command: message.RelayRendezvousEstablished})
+}
+
+// handleRendezvous1 joins the service's circuit to the client circuit that
+// presented the same cookie
+func (n *Node) handleRendezvous1(circ *relayCircuit, cell *message.RelayCell) {
+	var req message.Rendezvous1
+	if err := json.Unmarshal(cell.Data, &req); err != nil {
+		return
+	}
+
+	key := hex.EncodeToString(req.Cookie)
+	n.mutex.Lock()
+	client, exists := n.rendezvous[key]
+	delete(n.rendezvous, key)
+	n.mutex.Unlock()
+	if !exists {
+		fmt.Printf("[%s %s] ❌ Unknown rendezvous cookie\n", n.getTypeString(), n.ID)
+		return
+	}
+
+	client.mutex.Lock()
+	client.joined = circ
+	client.mutex.Unlock()
+	circ.mutex.Lock()
+	circ.joined = client
+	circ.mutex.Unlock()
+
+	fmt.Printf("[%s %s] 🤝 Joined client and service circuits\n", n.getTypeString(), n.ID)
+	n.sendToClient(client, &message.RelayCell{Command: message.RelayRendezvous2, Data: req.Handshake})
+}
+
+// forgetServiceState drops intro and rendezvous registrations held by a
+// circuit that has closed
+func (n *Node) forgetServiceState(circ *relayCircuit) {
+	n.mutex.Lock()
+	for address, service := range n.introPoints {
+		if service == circ {
+			delete(n.introPoints, address)
+		}
+	}
+	for cookie, client := range n.rendezvous {
+		if client == circ {
+			delete(n.rendezvous, cookie)
+		}
+	}
+	n.mutex.Unlock()
+
+	if joined := circ.joinedCircuit(); joined != nil {
+		joined.mutex.Lock()
+		joined.joined = nil
+		joined.mutex.Unlock()
+	}
+}
@@ -0,0 +1,123 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"onion-network/pkg/message"
+)
+
+// resolveTimeout bounds a single lookup on behalf of a client
+const resolveTimeout = 10 * time.Second
+
+// resolve answers a client's RelayResolve with the exit's own resolver, so
+// the name never reaches a resolver near the client
+func (n *Node) resolve(circ *relayCircuit, cell *message.RelayCell) {
+	var req message.ResolveRequest
+	var answers []message.ResolvedAnswer
+
+	if err := json.Unmarshal(cell.Data, &req); err != nil {
+		answers = resolveError("invalid request")
+	} else if !n.Roles.Has(Exit) {
+		answers = resolveError("not an exit")
+	} else {
+		fmt.Printf("[EXIT %s] 🔎 Resolving %s %s for stream %d\n", n.ID, recordTypeString(req.Type), req.Name, cell.StreamID)
+		answers = lookup(req)
+	}
+
+	// Answers beyond what fits in one cell are dropped
+	data, err := json.Marshal(answers)
+	for err == nil && len(data) > message.MaxCellData && len(answers) > 1 {
+		answers = answers[:len(answers)/2]
+		data, err = json.Marshal(answers)
+	}
+	if err != nil {
+		return
+	}
+	n.sendToClient(circ, &message.RelayCell{Command: message.RelayResolved, StreamID: cell.StreamID, Data: data})
+}
+
+func lookup(req message.ResolveRequest) []message.ResolvedAnswer {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+
+	var answers []message.ResolvedAnswer
+	switch req.Type {
+	case message.RecordPTR:
+		if net.ParseIP(req.Name) == nil {
+			return resolveError("PTR lookups take an IP address")
+		}
+		names, err := net.DefaultResolver.LookupAddr(ctx, req.Name)
+		if err != nil {
+			return resolveError(lookupFailure(err))
+		}
+		for _, name := range names {
+			answers = append(answers, message.ResolvedAnswer{
+				Type:  message.RecordPTR,
+				Value: strings.TrimSuffix(name, "."),
+				TTL:   message.ResolvedTTL,
+			})
+		}
+
+	case "", message.RecordA, message.RecordAAAA:
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, req.Name)
+		if err != nil {
+			return resolveError(lookupFailure(err))
+		}
+		for _, addr := range addrs {
+			recordType := message.RecordAAAA
+			if addr.IP.To4() != nil {
+				recordType = message.RecordA
+			}
+			if req.Type != "" && req.Type != recordType {
+				continue
+			}
+			answers = append(answers, message.ResolvedAnswer{
+				Type:  recordType,
+				Value: addr.IP.String(),
+				TTL:   message.ResolvedTTL,
+			})
+		}
+
+	default:
+		return resolveError("unsupported record type")
+	}
+
+	if len(answers) == 0 {
+		return resolveError("no records")
+	}
+	return answers
+}
+
+func resolveError(reason string) []message.ResolvedAnswer {
+	return []message.ResolvedAnswer{{Type: message.RecordError, Value: reason}}
+}
+
+// lookupFailure keeps resolver details such as the exit's own nameserver
+// address out of the answer sent to the client
+func lookupFailure(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		switch {
+		case dnsErr.IsNotFound:
+			return "no such host"
+		case dnsErr.IsTimeout:
+			return "timeout"
+		case dnsErr.IsTemporary:
+			return "temporary failure"
+		}
+	}
+	return "resolve failed"
+}
+
+func recordTypeString(recordType string) string {
+	if recordType == "" {
+		return "A/AAAA"
+	}
+	return recordType
+}
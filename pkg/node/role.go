@@ -0,0 +1,82 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Role is a set of circuit positions a node offers besides the middle,
+// which every node takes, so a node that is only a middle has no roles.
+// The node registers what it offers and the directory decides which flags
+// it is listed with; each circuit then tells the node its position, by
+// whether the create layer names a next hop and by what the client asks
+// of it at the end.
+type Role int
+
+const (
+	Guard  Role = 1 << iota // First hop for clients
+	Exit                    // Opens streams out of the network, as its exit policy allows
+	Bridge                  // Unlisted guard, handed out only through bridge distribution
+)
+
+var roleNames = []struct {
+	role Role
+	name string
+}{
+	{Guard, "guard"},
+	{Exit, "exit"},
+	{Bridge, "bridge"},
+}
+
+// ParseRoles reads a comma-separated list of roles such as "guard,exit".
+// "relay" and "middle" add nothing, since every node is a middle.
+func ParseRoles(s string) (Role, error) {
+	var roles Role
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "relay" || name == "middle" {
+			continue
+		}
+		found := false
+		for _, r := range roleNames {
+			if r.name == name {
+				roles |= r.role
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown node role %q, use guard, relay, exit or bridge", name)
+		}
+	}
+	if roles.Has(Bridge) && roles != Bridge {
+		// Listing a bridge for any other role would publish its address
+		return 0, errors.New("a bridge cannot take other roles")
+	}
+	return roles, nil
+}
+
+// Has reports whether every role in role is offered
+func (r Role) Has(role Role) bool {
+	return r&role == role
+}
+
+// Names lists the offered roles for the node's descriptor
+func (r Role) Names() []string {
+	var names []string
+	for _, role := range roleNames {
+		if r.Has(role.role) {
+			names = append(names, role.name)
+		}
+	}
+	return names
+}
+
+// String is the roles as shown in logs, such as "GUARD+EXIT"
+func (r Role) String() string {
+	names := r.Names()
+	if len(names) == 0 {
+		return "RELAY"
+	}
+	return strings.ToUpper(strings.Join(names, "+"))
+}
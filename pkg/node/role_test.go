@@ -0,0 +1,73 @@
+package node
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRoles(t *testing.T) {
+	tests := []struct {
+		spec   string
+		roles  Role
+		names  []string
+		string string
+		fails  bool
+	}{
+		{spec: "relay", roles: 0, string: "RELAY"},
+		{spec: "middle", roles: 0, string: "RELAY"},
+		{spec: "guard", roles: Guard, names: []string{"guard"}, string: "GUARD"},
+		{spec: "Exit, guard", roles: Guard | Exit, names: []string{"guard", "exit"}, string: "GUARD+EXIT"},
+		{spec: "relay,exit", roles: Exit, names: []string{"exit"}, string: "EXIT"},
+		{spec: "bridge", roles: Bridge, names: []string{"bridge"}, string: "BRIDGE"},
+		{spec: "bridge,relay", roles: Bridge, names: []string{"bridge"}, string: "BRIDGE"},
+		{spec: "bridge,guard", fails: true},
+		{spec: "exit,bridge", fails: true},
+		{spec: "hsdir", fails: true},
+		{spec: "guard,", fails: true},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			roles, err := ParseRoles(test.spec)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("ParseRoles accepted %q as %s", test.spec, roles)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if roles != test.roles {
+				t.Errorf("roles = %s, want %s", roles, test.roles)
+			}
+			if names := roles.Names(); !reflect.DeepEqual(names, test.names) {
+				t.Errorf("Names() = %v, want %v", names, test.names)
+			}
+			if s := roles.String(); s != test.string {
+				t.Errorf("String() = %q, want %q", s, test.string)
+			}
+		})
+	}
+}
+
+func TestRoleHas(t *testing.T) {
+	tests := []struct {
+		roles Role
+		role  Role
+		has   bool
+	}{
+		{0, Guard, false},
+		{0, Exit, false},
+		{Guard, Guard, true},
+		{Guard, Exit, false},
+		{Guard | Exit, Exit, true},
+		{Guard | Exit, Guard | Exit, true},
+		{Exit, Guard | Exit, false},
+		{Bridge, Guard, false},
+	}
+	for _, test := range tests {
+		if has := test.roles.Has(test.role); has != test.has {
+			t.Errorf("%s.Has(%s) = %v, want %v", test.roles, test.role, has, test.has)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"onion-network/pkg/message"
+	"onion-network/pkg/scheduler"
+)
+
+// maxQueuedCells bounds one circuit's cells waiting for a link. Flow
+// control holds a circuit that follows the protocol to a window of DATA
+// cells, and the rest leaves room for the cells it does not count:
+// SENDMEs, padding and stream control. A circuit at the bound is refused
+// more cells rather than stalling the link's reader, which serves every
+// other circuit on it too.
+const maxQueuedCells = message.CircuitWindow + message.CircuitWindow/2
+
+var errCellQueueFull = errors.New("circuit cell queue full")
+
+// startScheduler gives the link a cell queue ordered by the node's
+// scheduler and a goroutine writing it to the link. socket is the
+// underlying connection, whose kernel state KIST reads.
+func (n *Node) startScheduler(c *Connection, socket net.Conn) {
+	cells, err := scheduler.New(n.Scheduler)
+	if err != nil {
+		fmt.Printf("[%s %s] ❌ %v, using fifo\n", n.getTypeString(), n.ID, err)
+		cells = scheduler.NewFIFO()
+	}
+
+	c.cellMutex.Lock()
+	c.cells = cells
+	c.cellsChanged = sync.NewCond(&c.cellMutex)
+	c.cellBytes = make(map[string]int)
+	c.memory = &n.queued
+	c.cellMutex.Unlock()
+
+	if !n.KIST {
+		socket = nil
+	}
+	go c.writeCells(socket)
+}
+
+// SendCell queues a relay cell behind the link's scheduler, or writes it
+// directly on a link without one
+func (c *Connection) SendCell(msg *message.OnionMessage) error {
+	c.cellMutex.Lock()
+	if c.cells == nil {
+		c.cellMutex.Unlock()
+		return c.Send(msg)
+	}
+	defer c.cellMutex.Unlock()
+
+	if c.cellsClosed {
+		return net.ErrClosed
+	}
+	if c.cells.Queued(msg.CircuitID) >= maxQueuedCells {
+		return errCellQueueFull
+	}
+	c.cells.Push(msg.CircuitID, msg)
+	c.cellBytes[msg.CircuitID] += len(msg.Payload)
+	c.memory.add(len(msg.Payload))
+	c.cellsChanged.Broadcast()
+	return nil
+}
+
+// overfilled destroys a circuit whose cells were refused for filling its
+// queue, and passes any other error on
+func (n *Node) overfilled(circ *relayCircuit, err error) error {
+	if errors.Is(err, errCellQueueFull) {
+		n.destroyCircuit(circ, message.DestroyResourceLimit, nil)
+	}
+	return err
+}
+
+// queuedBytes is how much of a circuit's relay cells wait for the link
+func (c *Connection) queuedBytes(circuitID string) int {
+	c.cellMutex.Lock()
+	defer c.cellMutex.Unlock()
+	return c.cellBytes[circuitID]
+}
+
+// dropCells discards a destroyed circuit's queued cells
+func (c *Connection) dropCells(circuitID string) {
+	c.cellMutex.Lock()
+	defer c.cellMutex.Unlock()
+	if c.cells != nil {
+		c.cells.Remove(circuitID)
+		c.memory.add(-c.cellBytes[circuitID])
+		delete(c.cellBytes, circuitID)
+		c.cellsChanged.Broadcast()
+	}
+}
+
+// unqueued stops counting a cell taken off the queue, with cellMutex held
+func (c *Connection) unqueued(msg *message.OnionMessage) {
+	if c.cellBytes[msg.CircuitID] -= len(msg.Payload); c.cellBytes[msg.CircuitID] <= 0 {
+		delete(c.cellBytes, msg.CircuitID)
+	}
+	c.memory.add(-len(msg.Payload))
+}
+
+// closeCells stops the link's writer, fails cells still being queued and
+// releases the memory of those that were
+func (c *Connection) closeCells() {
+	c.cellMutex.Lock()
+	c.cellsClosed = true
+	if c.cells != nil {
+		for circuitID, bytes := range c.cellBytes {
+			c.memory.add(-bytes)
+			delete(c.cellBytes, circuitID)
+		}
+		c.cellsChanged.Broadcast()
+	}
+	c.cellMutex.Unlock()
+}
+
+// writeCells writes queued cells in the scheduler's order until the link
+// closes. With a socket, each round writes only what KIST says the kernel
+// can send promptly, then waits for it to drain; without one, cells are
+// written as fast as the link takes them.
+func (c *Connection) writeCells(socket net.Conn) {
+	for {
+		c.cellMutex.Lock()
+		for !c.cellsClosed && c.cells.Len() == 0 {
+			c.cellsChanged.Wait()
+		}
+		closed := c.cellsClosed
+		c.cellMutex.Unlock()
+		if closed {
+			return
+		}
+
+		limit, limited := 0, false
+		if socket != nil {
+			limit, limited = scheduler.WriteLimit(socket)
+		}
+		if limited && limit <= 0 {
+			time.Sleep(scheduler.KISTInterval)
+			continue
+		}
+
+		for !limited || limit > 0 {
+			c.cellMutex.Lock()
+			cell, ok := c.cells.Pop(time.Now())
+			var msg *message.OnionMessage
+			if ok {
+				msg = cell.(*message.OnionMessage)
+				c.unqueued(msg)
+			}
+			c.cellsChanged.Broadcast()
+			c.cellMutex.Unlock()
+			if !ok {
+				break
+			}
+
+			written, err := c.send(msg, false)
+			if err != nil {
+				c.closeCells()
+				c.Conn.Close()
+				return
+			}
+			limit -= written
+		}
+	}
+}
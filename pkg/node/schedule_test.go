@@ -0,0 +1,103 @@
+package node
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"onion-network/pkg/message"
+	"onion-network/pkg/padding"
+)
+
+// stalledLink starts a scheduled link whose far end nobody reads, so the
+// writer stalls on the first cell
+func stalledLink(t *testing.T) *Connection {
+	t.Helper()
+	n, err := NewNode(Guard, "127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, remote := net.Pipe()
+	c := &Connection{ID: "link", Conn: local}
+	n.startScheduler(c, local)
+	t.Cleanup(func() {
+		c.closeCells()
+		local.Close()
+		remote.Close()
+	})
+	return c
+}
+
+func TestSendCellRefusesFullCircuit(t *testing.T) {
+	c := stalledLink(t)
+
+	full := make(chan int)
+	go func() {
+		for i := 0; ; i++ {
+			err := c.SendCell(&message.OnionMessage{Type: message.CircuitRelay, CircuitID: "busy", Payload: make([]byte, message.RelayCellSize)})
+			if errors.Is(err, errCellQueueFull) {
+				full <- i
+				return
+			}
+		}
+	}()
+
+	select {
+	case sent := <-full:
+		if sent < maxQueuedCells || sent > maxQueuedCells+1 {
+			t.Errorf("refused after %d cells, want %d queued", sent, maxQueuedCells)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendCell blocked on a full circuit")
+	}
+
+	// Other circuits on the link still get through
+	if err := c.SendCell(&message.OnionMessage{Type: message.CircuitRelay, CircuitID: "quiet"}); err != nil {
+		t.Errorf("other circuit: %v", err)
+	}
+}
+
+func TestFullWindowFitsCellQueue(t *testing.T) {
+	c := stalledLink(t)
+	cell := func() *message.OnionMessage {
+		return &message.OnionMessage{Type: message.CircuitRelay, CircuitID: "compliant", Payload: make([]byte, message.RelayCellSize)}
+	}
+
+	// A full window of DATA, the SENDMEs acknowledging the other
+	// direction's window, and some padding, all behind a stalled link
+	cells := message.CircuitWindow + message.CircuitWindow/message.CircuitSendmeIncrement + 100
+	for i := 0; i < cells; i++ {
+		if err := c.SendCell(cell()); err != nil {
+			t.Fatalf("cell %d of a compliant circuit refused: %v", i, err)
+		}
+	}
+}
+
+func TestSendReturnsFrameSize(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	c := &Connection{ID: "link", Conn: local, stats: &padding.Stats{}}
+
+	read := make(chan int)
+	go func() {
+		n, _ := io.Copy(io.Discard, remote)
+		read <- int(n)
+	}()
+	msg := &message.OnionMessage{Type: message.CircuitRelay, CircuitID: generateCircuitID(), Payload: make([]byte, message.RelayCellSize)}
+	written, err := c.send(msg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.Close()
+
+	if n := <-read; written != n {
+		t.Errorf("send reported %d bytes, the link carried %d", written, n)
+	}
+	// KIST budgets the kernel buffer by this, and the encoding is larger
+	if written < message.RelayCellSize*4/3 {
+		t.Errorf("%d byte frame for a %d byte cell", written, message.RelayCellSize)
+	}
+}
@@ -0,0 +1,104 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"onion-network/pkg/crypto"
+	"onion-network/pkg/message"
+)
+
+// DefaultShutdownDrain is how long circuits may finish once a node starts
+// shutting down, as Tor's ShutdownWaitLength
+const DefaultShutdownDrain = 30 * time.Second
+
+// shutdown stops accepting links and circuits, tells the directory the
+// node is leaving, gives existing circuits up to ShutdownDrain to finish,
+// then destroys the rest, closes every link and saves the node's state
+func (n *Node) shutdown() {
+	n.mutex.Lock()
+	n.leaving = true
+	n.mutex.Unlock()
+	n.listener.Close()
+
+	fmt.Printf("[%s %s] 👋 Shutting down, draining %d circuits for up to %v\n",
+		n.getTypeString(), n.ID, len(n.circuitList()), n.ShutdownDrain)
+	if err := n.unregister(); err != nil {
+		fmt.Printf("Warning: Failed to tell directory the node is leaving: %v\n", err)
+	}
+
+	deadline := time.NewTimer(n.ShutdownDrain)
+	defer deadline.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+drain:
+	for len(n.circuitList()) > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			break drain
+		}
+	}
+
+	circuits := n.circuitList()
+	for _, circ := range circuits {
+		n.destroyCircuit(circ, message.DestroyHibernating, nil)
+	}
+
+	n.mutex.RLock()
+	links := make([]*Connection, 0, len(n.Connections))
+	for _, conn := range n.Connections {
+		links = append(links, conn)
+	}
+	n.mutex.RUnlock()
+	for _, conn := range links {
+		conn.Conn.Close()
+	}
+
+	if err := n.saveState(); err != nil {
+		fmt.Printf("[%s %s] ❌ Failed to save state: %v\n", n.getTypeString(), n.ID, err)
+	}
+	fmt.Printf("[%s %s] 👋 Shut down, destroyed %d remaining circuits\n", n.getTypeString(), n.ID, len(circuits))
+}
+
+// circuitList returns each circuit through the node once, though it is
+// keyed on both of its links
+func (n *Node) circuitList() []*relayCircuit {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	seen := make(map[*relayCircuit]bool)
+	var circuits []*relayCircuit
+	for _, circ := range n.circuits {
+		if !seen[circ] {
+			seen[circ] = true
+			circuits = append(circuits, circ)
+		}
+	}
+	return circuits
+}
+
+// unregister removes the node from the directory's listings
+func (n *Node) unregister() error {
+	req := message.Unregister{ID: n.ID, Timestamp: time.Now().Unix()}
+	var err error
+	if req.Signature, err = crypto.Sign(n.IdentityKey, req.SignedData()); err != nil {
+		return err
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(n.DirectoryURL+"/unregister", "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("directory answered %s", resp.Status)
+	}
+	return nil
+}
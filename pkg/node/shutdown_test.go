@@ -0,0 +1,176 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"onion-network/pkg/directory"
+	"onion-network/pkg/message"
+)
+
+// runNode serves a middle registered with a test directory until the
+// returned stop is called, which waits for Run to return
+func runNode(t *testing.T, drain time.Duration) (*Node, string, func()) {
+	t.Helper()
+	dir := httptest.NewServer(directory.NewDirectoryServer(0).Handler())
+	t.Cleanup(dir.Close)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	n, err := NewNode(0, "127.0.0.1", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.DirectoryURL = dir.URL
+	n.ListenAddress = "127.0.0.1"
+	n.ShutdownDrain = drain
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- n.Run(ctx) }()
+	stopped := false
+	stop := func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(drain + 10*time.Second):
+			t.Fatal("Run did not return after shutdown")
+		}
+	}
+	t.Cleanup(stop)
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("node did not start")
+		}
+	}
+	return n, dir.URL, stop
+}
+
+// openCircuit dials n as a client and creates a one hop circuit, returning
+// the link and the reply to the create
+func openCircuit(t *testing.T, n *Node) (net.Conn, *message.OnionMessage) {
+	t.Helper()
+	conn, err := net.Dial("tcp", net.JoinHostPort(n.Address, strconv.Itoa(n.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	create := &message.OnionMessage{Type: message.CircuitCreate, CircuitID: generateCircuitID(), Payload: createOnion(t, n, "")}
+	if err := message.WriteMessage(conn, create); err != nil {
+		t.Fatal(err)
+	}
+	return conn, nextMessage(t, conn, message.CircuitCreated, message.CircuitDestroy)
+}
+
+// nextMessage reads from conn until a message of one of types arrives
+func nextMessage(t *testing.T, conn net.Conn, types ...message.MessageType) *message.OnionMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		msg, err := message.ReadMessage(conn)
+		if err != nil {
+			t.Fatalf("waiting for message types %v: %v", types, err)
+		}
+		for _, msgType := range types {
+			if msg.Type == msgType {
+				return msg
+			}
+		}
+	}
+}
+
+func listed(t *testing.T, directoryURL, id string) bool {
+	t.Helper()
+	resp, err := http.Get(directoryURL + "/nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var nodes []struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		if node.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestShutdownDestroysCircuitsAfterDrain(t *testing.T) {
+	n, directoryURL, stop := runNode(t, 300*time.Millisecond)
+	if !listed(t, directoryURL, n.ID) {
+		t.Fatal("node not listed while running")
+	}
+	conn, reply := openCircuit(t, n)
+	if reply.Type != message.CircuitCreated {
+		t.Fatalf("create refused with reason %d", reply.DestroyReason())
+	}
+
+	started := time.Now()
+	stop()
+	if elapsed := time.Since(started); elapsed < 300*time.Millisecond {
+		t.Errorf("stopped after %v, before the drain period", elapsed)
+	}
+
+	destroy := nextMessage(t, conn, message.CircuitDestroy)
+	if destroy.CircuitID != reply.CircuitID || destroy.DestroyReason() != message.DestroyHibernating {
+		t.Errorf("got DESTROY for %s with reason %d", destroy.CircuitID, destroy.DestroyReason())
+	}
+	if listed(t, directoryURL, n.ID) {
+		t.Error("node still listed after shutting down")
+	}
+	if conn, err := net.Dial("tcp", net.JoinHostPort(n.Address, strconv.Itoa(n.Port))); err == nil {
+		conn.Close()
+		t.Error("node still accepting links")
+	}
+}
+
+func TestHibernatingNodeRefusesNewCircuits(t *testing.T) {
+	n, _, _ := runNode(t, 0)
+	_, before := openCircuit(t, n)
+	if before.Type != message.CircuitCreated {
+		t.Fatalf("create refused with reason %d before hibernating", before.DestroyReason())
+	}
+
+	n.Hibernate()
+	_, refused := openCircuit(t, n)
+	if refused.Type != message.CircuitDestroy || refused.DestroyReason() != message.DestroyHibernating {
+		t.Fatalf("create while hibernating answered with type %d", refused.Type)
+	}
+	if circuits := len(n.circuitList()); circuits != 1 {
+		t.Errorf("%d circuits while hibernating, want the one from before", circuits)
+	}
+
+	n.Wake()
+	if _, after := openCircuit(t, n); after.Type != message.CircuitCreated {
+		t.Fatalf("create refused with reason %d after waking", after.DestroyReason())
+	}
+}
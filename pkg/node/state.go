@@ -0,0 +1,110 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"onion-network/pkg/bandwidth"
+	"onion-network/pkg/crypto"
+	"onion-network/pkg/message"
+)
+
+// StateInterval is how often a node with a data directory saves its state
+const StateInterval = time.Minute
+
+// Files in a node's data directory
+const (
+	identityKeyFile = "identity_key"
+	stateFile       = "state.json"
+)
+
+// nodeState is what a node keeps in its data directory besides its keys
+type nodeState struct {
+	OnionKeyCreated time.Time                  `json:"onion_key_created"`
+	Accounting      *bandwidth.AccountingState `json:"accounting,omitempty"`
+}
+
+// LoadDataDirectory gives the node the identity key, onion keys and state
+// kept in dir, creating them on first use, so a restarted node is the same
+// node to the directory and to clients that chose it as their guard. Call
+// it after setting Accounting, whose usage it restores.
+func (n *Node) LoadDataDirectory(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	key, err := crypto.LoadOrCreatePrivateKey(filepath.Join(dir, identityKeyFile))
+	if err != nil {
+		return fmt.Errorf("failed to load identity key: %w", err)
+	}
+
+	var state nodeState
+	data, err := os.ReadFile(filepath.Join(dir, stateFile))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("invalid state file: %w", err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	if err := n.loadOnionKeys(dir, state.OnionKeyCreated); err != nil {
+		return fmt.Errorf("failed to load onion key: %w", err)
+	}
+
+	n.IdentityKey = key
+	n.ID = message.NodeID(&key.PublicKey)
+	if n.Accounting != nil && state.Accounting != nil {
+		n.Accounting.Restore(*state.Accounting)
+	}
+	n.DataDirectory = dir
+	return n.saveState()
+}
+
+// saveState writes the node's state to its data directory, if it has one
+func (n *Node) saveState() error {
+	if n.DataDirectory == "" {
+		return nil
+	}
+
+	n.keyMutex.RLock()
+	state := nodeState{OnionKeyCreated: n.onionKeys.created}
+	n.keyMutex.RUnlock()
+	if n.Accounting != nil {
+		usage := n.Accounting.State()
+		state.Accounting = &usage
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Written aside and renamed, so a crash never leaves half a file
+	path := filepath.Join(n.DataDirectory, stateFile)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// keepState saves the node's state every StateInterval
+func (n *Node) keepState(ctx context.Context) {
+	ticker := time.NewTicker(StateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := n.saveState(); err != nil {
+				fmt.Printf("[%s %s] ❌ Failed to save state: %v\n", n.getTypeString(), n.ID, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package padding
+
+import (
+	"crypto/rand"
+	"fmt"
+	mathrand "math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"onion-network/pkg/message"
+)
+
+// Schedule is a range of delays a padder picks from uniformly
+type Schedule struct {
+	Min time.Duration `json:"min"`
+	Max time.Duration `json:"max"`
+}
+
+func (s Schedule) pick() time.Duration {
+	if s.Max <= s.Min {
+		return s.Min
+	}
+	return s.Min + time.Duration(mathrand.Int63n(int64(s.Max-s.Min)))
+}
+
+// DefaultLinkSchedule sends a padding message on a link that has been idle
+// for 1.5 to 9.5 seconds, as Tor does, so idle links never fall silent
+var DefaultLinkSchedule = Schedule{Min: 1500 * time.Millisecond, Max: 9500 * time.Millisecond}
+
+// State is one step of a circuit padding machine. Entering it schedules up
+// to Cells padding cells, each after a delay picked from Delay; real
+// traffic restarts the machine's first state. Cells < 0 pads forever.
+type State struct {
+	Delay Schedule
+	Cells int
+}
+
+// Machine is a named sequence of padding states negotiated per circuit.
+// It moves to the next state once a state's cells are sent and idles after
+// the last one.
+type Machine struct {
+	Name      string
+	States    []State
+	OnTraffic bool // Idle until the first real traffic instead of starting at once
+}
+
+// Machines are the circuit padding machines both ends know by name
+var Machines = map[string]Machine{
+	// burst hides where bursts of real traffic end by trailing each with a
+	// few quick cells, then a slower tail
+	"burst": {Name: "burst", OnTraffic: true, States: []State{
+		{Delay: Schedule{Min: 5 * time.Millisecond, Max: 50 * time.Millisecond}, Cells: 8},
+		{Delay: Schedule{Min: 100 * time.Millisecond, Max: 500 * time.Millisecond}, Cells: 4},
+	}},
+	// cover keeps a steady trickle of cells flowing whether or not the
+	// circuit is in use
+	"cover": {Name: "cover", States: []State{
+		{Delay: Schedule{Min: 200 * time.Millisecond, Max: 800 * time.Millisecond}, Cells: -1},
+	}},
+}
+
+// Config is what a node or client is willing to pad
+type Config struct {
+	Link         bool
+	LinkSchedule Schedule
+	Circuit      bool   // Run padding machines the other end asks for
+	Machine      string // Machine to ask circuit endpoints for, empty for none
+}
+
+// ParseConfig reads a comma-separated list such as "link,burst": "link"
+// enables link padding, "circuit" accepts machines peers negotiate, a
+// machine name asks for that machine on every circuit and "none" disables
+// everything
+func ParseConfig(spec string) (Config, error) {
+	config := Config{LinkSchedule: DefaultLinkSchedule}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(strings.ToLower(item))
+		switch {
+		case item == "" || item == "none":
+		case item == "link":
+			config.Link = true
+		case item == "circuit":
+			config.Circuit = true
+		default:
+			if _, exists := Machines[item]; !exists {
+				return config, fmt.Errorf("unknown padding %q (use link, circuit, none or a machine: burst, cover)", item)
+			}
+			config.Machine = item
+			config.Circuit = true
+		}
+	}
+	return config, nil
+}
+
+// Stats counts real and padding traffic so the effect of padding can be
+// measured. All counters are in cells or link messages.
+type Stats struct {
+	RealSent        atomic.Uint64
+	PaddingSent     atomic.Uint64
+	RealReceived    atomic.Uint64
+	PaddingReceived atomic.Uint64
+}
+
+// LinkParams are the link padding parameters to negotiate for schedule
+func LinkParams(schedule Schedule) message.LinkPaddingParams {
+	return message.LinkPaddingParams{
+		Enabled:   true,
+		MinMillis: int(schedule.Min / time.Millisecond),
+		MaxMillis: int(schedule.Max / time.Millisecond),
+	}
+}
+
+// ScheduleFrom reads negotiated link parameters, never padding more often
+// than every 100ms whatever the peer asked for
+func ScheduleFrom(params message.LinkPaddingParams) Schedule {
+	schedule := Schedule{
+		Min: time.Duration(params.MinMillis) * time.Millisecond,
+		Max: time.Duration(params.MaxMillis) * time.Millisecond,
+	}
+	if schedule.Min < 100*time.Millisecond {
+		schedule.Min = 100 * time.Millisecond
+	}
+	if schedule.Max < schedule.Min {
+		schedule.Max = schedule.Min
+	}
+	return schedule
+}
+
+// PaddingMessage is a link padding message framed byte for byte like a
+// relay message: a CircuitRelay on a fresh circuit ID of the usual form,
+// carrying a random cell. The receiving side knows no circuit by that ID
+// and drops it; on the wire only the ID tells it apart, and only to an
+// observer who follows every circuit created on a plain link.
+func PaddingMessage() *message.OnionMessage {
+	payload := make([]byte, message.RelayCellSize)
+	rand.Read(payload)
+	return &message.OnionMessage{Type: message.CircuitRelay, CircuitID: paddingCircuitID(), Payload: payload}
+}
+
+// IsPadding reports whether a message received on a link is padding, given
+// whether the receiver has a circuit by its ID on that link
+func IsPadding(msg *message.OnionMessage, knownCircuit bool) bool {
+	return msg.Type == message.CircuitRelay && !knownCircuit
+}
+
+// paddingCircuitID looks like the "circuit_" IDs nodes and clients choose
+func paddingCircuitID() string {
+	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, 12)
+	rand.Read(b)
+	for i := range b {
+		b[i] = charset[int(b[i])%len(charset)]
+	}
+	return "circuit_" + string(b)
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf("sent %d real/%d padding, received %d real/%d padding",
+		s.RealSent.Load(), s.PaddingSent.Load(), s.RealReceived.Load(), s.PaddingReceived.Load())
+}
+
+// Padder sends padding through send according to either a link schedule
+// or a circuit machine, reacting to real traffic reported by Activity
+type Padder struct {
+	machine  Machine
+	send     func() error
+	activity chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewLinkPadder pads a link whenever it has been idle for a delay picked
+// from schedule
+func NewLinkPadder(schedule Schedule, send func() error) *Padder {
+	return NewPadder(Machine{Name: "link", States: []State{{Delay: schedule, Cells: -1}}}, send)
+}
+
+// NewPadder runs machine, calling send for each padding cell, until Stop
+func NewPadder(machine Machine, send func() error) *Padder {
+	p := &Padder{
+		machine:  machine,
+		send:     send,
+		activity: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Activity tells the padder real traffic was just sent
+func (p *Padder) Activity() {
+	if p == nil {
+		return
+	}
+	select {
+	case p.activity <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Padder) Stop() {
+	if p == nil {
+		return
+	}
+	p.stopOnce.Do(func() { close(p.done) })
+}
+
+func (p *Padder) run() {
+	state, sent := 0, 0
+	timer := time.NewTimer(p.machine.States[0].Delay.pick())
+	defer timer.Stop()
+	if p.machine.OnTraffic {
+		state = len(p.machine.States)
+		timer.Stop()
+	}
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.activity:
+			state, sent = 0, 0
+		case <-timer.C:
+			if state < len(p.machine.States) {
+				if err := p.send(); err != nil {
+					return
+				}
+				sent++
+				if cells := p.machine.States[state].Cells; cells >= 0 && sent >= cells {
+					state, sent = state+1, 0
+				}
+			}
+		}
+
+		// A finished machine idles until real traffic restarts it
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if state < len(p.machine.States) {
+			timer.Reset(p.machine.States[state].Delay.pick())
+		}
+	}
+}
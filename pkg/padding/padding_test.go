@@ -0,0 +1,125 @@
+package padding
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"onion-network/pkg/message"
+)
+
+// counter counts the padding a padder sends
+type counter struct {
+	sent atomic.Int64
+}
+
+func (c *counter) send() error {
+	c.sent.Add(1)
+	return nil
+}
+
+// settle waits for a padder's pending cells, which are due within a few
+// milliseconds in these tests
+func settle() {
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestMachinePadsAfterEachBurst(t *testing.T) {
+	quick := Schedule{Min: time.Millisecond, Max: 2 * time.Millisecond}
+	machine := Machine{Name: "test", OnTraffic: true, States: []State{
+		{Delay: quick, Cells: 3},
+		{Delay: quick, Cells: 2},
+	}}
+	var c counter
+	p := NewPadder(machine, c.send)
+	defer p.Stop()
+
+	settle()
+	if sent := c.sent.Load(); sent != 0 {
+		t.Fatalf("%d cells sent before any traffic", sent)
+	}
+
+	p.Activity()
+	settle()
+	if sent := c.sent.Load(); sent != 5 {
+		t.Fatalf("%d cells trailed a burst, want 5", sent)
+	}
+
+	// The machine idles once finished, and the next burst runs it again
+	settle()
+	p.Activity()
+	settle()
+	if sent := c.sent.Load(); sent != 10 {
+		t.Errorf("%d cells after two bursts, want 10", sent)
+	}
+}
+
+func TestLinkPadderPadsOnlyIdleLinks(t *testing.T) {
+	var c counter
+	p := NewLinkPadder(Schedule{Min: 40 * time.Millisecond, Max: 40 * time.Millisecond}, c.send)
+	defer p.Stop()
+
+	// Real traffic more often than the schedule keeps padding off the link
+	for i := 0; i < 20; i++ {
+		p.Activity()
+		time.Sleep(5 * time.Millisecond)
+	}
+	if sent := c.sent.Load(); sent != 0 {
+		t.Fatalf("%d padding messages on a busy link", sent)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if sent := c.sent.Load(); sent < 3 || sent > 7 {
+		t.Errorf("%d padding messages in 250ms idle at one per 40ms", sent)
+	}
+
+	p.Stop()
+	stopped := c.sent.Load()
+	settle()
+	if sent := c.sent.Load(); sent != stopped {
+		t.Errorf("%d padding messages after Stop", sent-stopped)
+	}
+}
+
+func TestPadderStopsWhenSendFails(t *testing.T) {
+	var attempts atomic.Int64
+	p := NewLinkPadder(Schedule{Min: time.Millisecond}, func() error {
+		attempts.Add(1)
+		return errors.New("link closed")
+	})
+	defer p.Stop()
+
+	settle()
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("%d sends on a closed link, want 1", n)
+	}
+}
+
+func TestScheduleFromClampsPeerRequests(t *testing.T) {
+	schedule := ScheduleFrom(message.LinkPaddingParams{Enabled: true, MinMillis: 1, MaxMillis: 0})
+	if schedule.Min != 100*time.Millisecond || schedule.Max != schedule.Min {
+		t.Errorf("peer asking for 1ms padding got %v to %v", schedule.Min, schedule.Max)
+	}
+
+	params := LinkParams(DefaultLinkSchedule)
+	if got := ScheduleFrom(params); got != DefaultLinkSchedule {
+		t.Errorf("negotiated %v, want %v", got, DefaultLinkSchedule)
+	}
+}
+
+func TestPaddingLooksLikeRelayCells(t *testing.T) {
+	msg := PaddingMessage()
+	if msg.Type != message.CircuitRelay || len(msg.Payload) != message.RelayCellSize {
+		t.Fatalf("padding is type %d with %d bytes", msg.Type, len(msg.Payload))
+	}
+	if !IsPadding(msg, false) {
+		t.Error("relay message on an unknown circuit not taken as padding")
+	}
+	if IsPadding(msg, true) {
+		t.Error("relay message on a known circuit taken as padding")
+	}
+	if IsPadding(&message.OnionMessage{Type: message.CircuitDestroy}, false) {
+		t.Error("destroy taken as padding")
+	}
+}
@@ -0,0 +1,163 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Rule accepts or rejects connections to a range of addresses and ports
+type Rule struct {
+	Accept  bool
+	Network *net.IPNet // nil matches any address
+	MinPort int
+	MaxPort int
+}
+
+// Policy is an exit policy in Tor's style: the first rule matching a
+// destination decides, and a destination no rule matches is rejected
+type Policy []Rule
+
+// AcceptAll is the policy of an exit that connects anywhere
+var AcceptAll = Policy{{Accept: true, MinPort: 1, MaxPort: 65535}}
+
+// Parse reads comma-separated rules like "reject 10.0.0.0/8:*, reject *:25,
+// accept *:*". Addresses are *, an IP or a CIDR network; ports are *, one
+// port or a range such as 6660-6669.
+func Parse(s string) (Policy, error) {
+	var p Policy
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		rule, err := parseRule(field)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, rule)
+	}
+	if len(p) == 0 {
+		return nil, fmt.Errorf("empty exit policy %q", s)
+	}
+	return p, nil
+}
+
+func parseRule(s string) (Rule, error) {
+	action, pattern, found := strings.Cut(s, " ")
+	if !found {
+		return Rule{}, fmt.Errorf("exit policy rule %q needs accept or reject and address:port", s)
+	}
+
+	var rule Rule
+	switch strings.ToLower(action) {
+	case "accept":
+		rule.Accept = true
+	case "reject":
+	default:
+		return Rule{}, fmt.Errorf("exit policy rule %q must start with accept or reject", s)
+	}
+
+	pattern = strings.TrimSpace(pattern)
+	i := strings.LastIndex(pattern, ":")
+	if i < 0 {
+		return Rule{}, fmt.Errorf("exit policy rule %q has no port", s)
+	}
+	// IPv6 addresses are bracketed, as "[2001:db8::]/32" or "[2001:db8::/32]"
+	addr, ports := strings.NewReplacer("[", "", "]", "").Replace(pattern[:i]), pattern[i+1:]
+
+	if addr != "*" {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return Rule{}, fmt.Errorf("invalid address in exit policy rule %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			addr = fmt.Sprintf("%s/%d", addr, bits)
+		}
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid network in exit policy rule %q", s)
+		}
+		rule.Network = network
+	}
+
+	rule.MinPort, rule.MaxPort = 1, 65535
+	if ports != "*" {
+		low, high, isRange := strings.Cut(ports, "-")
+		if !isRange {
+			high = low
+		}
+		var err1, err2 error
+		rule.MinPort, err1 = strconv.Atoi(low)
+		rule.MaxPort, err2 = strconv.Atoi(high)
+		if err1 != nil || err2 != nil || rule.MinPort < 1 || rule.MaxPort > 65535 || rule.MinPort > rule.MaxPort {
+			return Rule{}, fmt.Errorf("invalid ports in exit policy rule %q", s)
+		}
+	}
+	return rule, nil
+}
+
+// Allows reports whether the policy accepts a connection to ip and port
+func (p Policy) Allows(ip net.IP, port int) bool {
+	for _, rule := range p {
+		if port < rule.MinPort || port > rule.MaxPort {
+			continue
+		}
+		if rule.Network != nil && !rule.Network.Contains(ip) {
+			continue
+		}
+		return rule.Accept
+	}
+	return false
+}
+
+// AcceptsAll reports whether the policy accepts every destination, so
+// there is no need to resolve one before checking it
+func (p Policy) AcceptsAll() bool {
+	return len(p) > 0 && p[0].Accept && p[0].Network == nil && p[0].MinPort == 1 && p[0].MaxPort == 65535
+}
+
+// AcceptsAny reports whether some destination may be accepted: an accept
+// rule comes before any rule rejecting everything. A policy that accepts
+// nothing is not an exit's.
+func (p Policy) AcceptsAny() bool {
+	for _, rule := range p {
+		if rule.Accept {
+			return true
+		}
+		if rule.Network == nil && rule.MinPort == 1 && rule.MaxPort == 65535 {
+			return false
+		}
+	}
+	return false
+}
+
+func (p Policy) String() string {
+	rules := make([]string, len(p))
+	for i, rule := range p {
+		action := "reject"
+		if rule.Accept {
+			action = "accept"
+		}
+		addr := "*"
+		if rule.Network != nil {
+			addr = rule.Network.String()
+		}
+		ports := "*"
+		if rule.MinPort == rule.MaxPort {
+			ports = strconv.Itoa(rule.MinPort)
+		} else if rule.MinPort != 1 || rule.MaxPort != 65535 {
+			ports = fmt.Sprintf("%d-%d", rule.MinPort, rule.MaxPort)
+		}
+		if strings.Contains(addr, ":") {
+			addr = "[" + addr + "]"
+		}
+		rules[i] = fmt.Sprintf("%s %s:%s", action, addr, ports)
+	}
+	return strings.Join(rules, ", ")
+}
@@ -0,0 +1,81 @@
+package policy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    string // As String prints it, empty when parsing fails
+		anyPort bool   // AcceptsAny
+	}{
+		{"accept *:*", "accept *:*", true},
+		{"reject 10.0.0.0/8:*, reject *:25, accept *:*", "reject 10.0.0.0/8:*, reject *:25, accept *:*", true},
+		{"accept 192.0.2.1:80-443, reject *:*", "accept 192.0.2.1/32:80-443, reject *:*", true},
+		{"ACCEPT [2001:db8::]/32:6660-6669", "accept [2001:db8::/32]:6660-6669", true},
+		{"reject *:*, accept *:80", "reject *:*, accept *:80", false},
+		{"reject *:25", "reject *:25", false},
+		{"", "", false},
+		{"allow *:*", "", false},
+		{"accept *", "", false},
+		{"accept nowhere:80", "", false},
+		{"accept *:0", "", false},
+		{"accept *:443-80", "", false},
+		{"accept *:65536", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			p, err := Parse(test.spec)
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("Parse accepted %q as %s", test.spec, p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.String(); got != test.want {
+				t.Errorf("String() = %q, want %q", got, test.want)
+			}
+			if got := p.AcceptsAny(); got != test.anyPort {
+				t.Errorf("AcceptsAny() = %v, want %v", got, test.anyPort)
+			}
+		})
+	}
+}
+
+func TestAllows(t *testing.T) {
+	p, err := Parse("reject 10.0.0.0/8:*, reject *:25, accept 192.0.2.0/24:1-1024, reject [2001:db8::]/32:*, accept *:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip    string
+		port  int
+		allow bool
+	}{
+		{"10.1.2.3", 443, false},
+		{"192.0.2.7", 25, false},
+		{"192.0.2.7", 80, true},
+		{"192.0.2.7", 8080, false},
+		{"198.51.100.1", 443, true},
+		{"198.51.100.1", 80, false},
+		{"2001:db8::1", 443, false},
+		{"2001:db9::1", 443, true},
+	}
+	for _, test := range tests {
+		if got := p.Allows(net.ParseIP(test.ip), test.port); got != test.allow {
+			t.Errorf("Allows(%s, %d) = %v, want %v", test.ip, test.port, got, test.allow)
+		}
+	}
+
+	if p.AcceptsAll() {
+		t.Error("AcceptsAll() for a policy with rejects")
+	}
+	if !AcceptAll.AcceptsAll() || !AcceptAll.Allows(net.ParseIP("203.0.113.9"), 1) {
+		t.Error("AcceptAll does not accept everything")
+	}
+}
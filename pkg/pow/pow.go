@@ -0,0 +1,124 @@
+package pow
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync"
+	"time"
+
+	"onion-network/pkg/message"
+)
+
+// MaxBits is the hardest puzzle a client agrees to solve. Each bit doubles
+// the expected work; 24 bits is some seconds of one core.
+const MaxBits = 24
+
+// SeedRotation is how often a node picks a new puzzle seed. Proofs for the
+// previous seed are still accepted, so a client solving across a rotation
+// is not refused.
+const SeedRotation = 10 * time.Minute
+
+// Solve finds a proof for puzzle and the create onion payload
+func Solve(ctx context.Context, puzzle message.Puzzle, payload []byte) ([]byte, error) {
+	if puzzle.Bits > MaxBits {
+		return nil, fmt.Errorf("puzzle of %d bits is harder than the %d allowed", puzzle.Bits, MaxBits)
+	}
+	onion := sha256.Sum256(payload)
+
+	proof := make([]byte, 8)
+	if _, err := rand.Read(proof); err != nil {
+		return nil, err
+	}
+	nonce := binary.BigEndian.Uint64(proof)
+	for i := 0; ; i++ {
+		if i%(1<<16) == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		binary.BigEndian.PutUint64(proof, nonce)
+		if solves(puzzle.Seed, onion[:], proof, puzzle.Bits) {
+			return proof, nil
+		}
+		nonce++
+	}
+}
+
+// solves reports whether SHA-256 of seed, onion and proof starts with
+// difficulty zero bits
+func solves(seed, onion, proof []byte, difficulty int) bool {
+	h := sha256.New()
+	h.Write(seed)
+	h.Write(onion)
+	h.Write(proof)
+	digest := h.Sum(nil)
+
+	zeros := 0
+	for _, b := range digest {
+		if b != 0 {
+			zeros += bits.LeadingZeros8(b)
+			break
+		}
+		zeros += 8
+	}
+	return zeros >= difficulty
+}
+
+// Seeds is a node's current and previous puzzle seeds
+type Seeds struct {
+	current  []byte
+	previous []byte
+	rotated  time.Time
+	mutex    sync.Mutex
+}
+
+func NewSeeds() *Seeds {
+	return &Seeds{}
+}
+
+// Puzzle asks for a proof of difficulty bits under the current seed
+func (s *Seeds) Puzzle(difficulty int) (message.Puzzle, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.rotate(time.Now()); err != nil {
+		return message.Puzzle{}, err
+	}
+	return message.Puzzle{Seed: s.current, Bits: difficulty}, nil
+}
+
+// Verify checks a proof for payload against either seed
+func (s *Seeds) Verify(payload, proof []byte, difficulty int) bool {
+	if len(proof) == 0 {
+		return false
+	}
+	onion := sha256.Sum256(payload)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.rotate(time.Now()); err != nil {
+		return false
+	}
+	if solves(s.current, onion[:], proof, difficulty) {
+		return true
+	}
+	return s.previous != nil && solves(s.previous, onion[:], proof, difficulty)
+}
+
+func (s *Seeds) rotate(now time.Time) error {
+	if s.current != nil && now.Sub(s.rotated) < SeedRotation {
+		return nil
+	}
+	seed := make([]byte, 16)
+	if _, err := rand.Read(seed); err != nil {
+		return errors.New("no randomness for puzzle seed")
+	}
+	s.previous = s.current
+	if now.Sub(s.rotated) >= 2*SeedRotation {
+		s.previous = nil
+	}
+	s.current, s.rotated = seed, now
+	return nil
+}
@@ -0,0 +1,68 @@
+package pow
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"onion-network/pkg/message"
+)
+
+// solved returns a puzzle from seeds and a proof for payload
+func solved(t *testing.T, seeds *Seeds, bits int, payload []byte) []byte {
+	t.Helper()
+	puzzle, err := seeds.Puzzle(bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := Solve(context.Background(), puzzle, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof
+}
+
+func TestProofBindsOnion(t *testing.T) {
+	seeds := NewSeeds()
+	onion := []byte("create onion")
+	proof := solved(t, seeds, 16, onion)
+
+	if !seeds.Verify(onion, proof, 16) {
+		t.Fatal("proof refused")
+	}
+	if seeds.Verify([]byte("another onion"), proof, 16) {
+		t.Error("proof accepted for another onion")
+	}
+	if seeds.Verify(onion, nil, 16) || seeds.Verify(onion, make([]byte, len(proof)), 16) {
+		t.Error("missing or zero proof accepted")
+	}
+}
+
+func TestProofOutlivesOneRotation(t *testing.T) {
+	seeds := NewSeeds()
+	onion := []byte("create onion")
+	proof := solved(t, seeds, 8, onion)
+
+	// A client may solve a puzzle just before the seed rotates
+	seeds.rotated = seeds.rotated.Add(-SeedRotation)
+	if !seeds.Verify(onion, proof, 8) {
+		t.Fatal("proof for the previous seed refused")
+	}
+
+	seeds.rotated = seeds.rotated.Add(-SeedRotation)
+	if seeds.Verify(onion, proof, 8) {
+		t.Error("proof for a seed two rotations old accepted")
+	}
+}
+
+func TestSolveLimits(t *testing.T) {
+	if _, err := Solve(context.Background(), message.Puzzle{Bits: MaxBits + 1}, nil); err == nil {
+		t.Error("solved a puzzle harder than MaxBits")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := Solve(ctx, message.Puzzle{Seed: []byte("seed"), Bits: MaxBits}, []byte("onion")); err != context.DeadlineExceeded {
+		t.Errorf("Solve past its deadline = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,129 @@
+package replay
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Window is how far a layer's timestamp may be from the node's clock in
+// either direction. Older layers are refused outright, so the filter only
+// has to remember digests for as long as a timestamp stays acceptable.
+const Window = 5 * time.Minute
+
+const (
+	filterBits   = 1 << 23 // 1MB per generation
+	filterHashes = 10      // ~1e-9 false positives at 100k digests
+)
+
+type bloom struct {
+	bits []uint64
+}
+
+func newBloom() *bloom {
+	return &bloom{bits: make([]uint64, filterBits/64)}
+}
+
+// positions derives the filter's bit positions from a SHA-256 digest by
+// double hashing
+func positions(digest [sha256.Size]byte) [filterHashes]uint32 {
+	h1 := binary.BigEndian.Uint64(digest[0:8])
+	h2 := binary.BigEndian.Uint64(digest[8:16]) | 1
+
+	var pos [filterHashes]uint32
+	for i := range pos {
+		pos[i] = uint32((h1 + uint64(i)*h2) % filterBits)
+	}
+	return pos
+}
+
+func (b *bloom) has(pos [filterHashes]uint32) bool {
+	for _, p := range pos {
+		if b.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloom) add(pos [filterHashes]uint32) {
+	for _, p := range pos {
+		b.bits[p/64] |= 1 << (p % 64)
+	}
+}
+
+// Stats counts what the filter has seen
+type Stats struct {
+	Checked       atomic.Uint64
+	Replays       atomic.Uint64
+	BadTimestamps atomic.Uint64
+	Rotations     atomic.Uint64
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf("%d checked, %d replays dropped, %d stale timestamps, %d rotations",
+		s.Checked.Load(), s.Replays.Load(), s.BadTimestamps.Load(), s.Rotations.Load())
+}
+
+// Filter remembers digests of recently seen layers in two generations of
+// bloom filter. A new generation starts every rotation period, so each
+// digest is kept for at least one full period (twice Window, covering
+// timestamps from the past and the future).
+type Filter struct {
+	Stats Stats
+
+	current  *bloom
+	previous *bloom
+	rotated  time.Time
+	period   time.Duration
+	mutex    sync.Mutex
+}
+
+func NewFilter() *Filter {
+	return &Filter{
+		current:  newBloom(),
+		previous: newBloom(),
+		rotated:  time.Now(),
+		period:   2 * Window,
+	}
+}
+
+// Seen reports whether data was already checked within the last rotation
+// period, and remembers it if not
+func (f *Filter) Seen(data []byte) bool {
+	pos := positions(sha256.Sum256(data))
+	f.Stats.Checked.Add(1)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if time.Since(f.rotated) >= f.period {
+		f.previous, f.current = f.current, f.previous
+		for i := range f.current.bits {
+			f.current.bits[i] = 0
+		}
+		f.rotated = time.Now()
+		f.Stats.Rotations.Add(1)
+	}
+
+	if f.current.has(pos) || f.previous.has(pos) {
+		f.Stats.Replays.Add(1)
+		return true
+	}
+	f.current.add(pos)
+	return false
+}
+
+// FreshTimestamp reports whether a Unix timestamp is within Window of now,
+// counting those that are not
+func (f *Filter) FreshTimestamp(timestamp int64) bool {
+	skew := time.Since(time.Unix(timestamp, 0))
+	if skew > Window || skew < -Window {
+		f.Stats.BadTimestamps.Add(1)
+		return false
+	}
+	return true
+}
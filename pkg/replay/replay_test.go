@@ -0,0 +1,64 @@
+package replay
+
+import (
+	"testing"
+	"time"
+)
+
+// age makes the filter's current generation look one period older, so the
+// next check rotates it
+func age(f *Filter) {
+	f.mutex.Lock()
+	f.rotated = f.rotated.Add(-f.period)
+	f.mutex.Unlock()
+}
+
+func TestFilterRemembersForOnePeriod(t *testing.T) {
+	f := NewFilter()
+	layer := []byte("create layer")
+
+	if f.Seen(layer) {
+		t.Fatal("fresh layer reported as seen")
+	}
+	if !f.Seen(layer) {
+		t.Fatal("replayed layer not caught")
+	}
+
+	// After one rotation the digest lives on in the previous generation
+	age(f)
+	if !f.Seen(layer) {
+		t.Fatal("replay missed after one rotation")
+	}
+
+	// After a second it is gone, and by then its timestamp is stale too
+	age(f)
+	if f.Seen(layer) {
+		t.Error("layer still remembered two rotations later")
+	}
+
+	if replays := f.Stats.Replays.Load(); replays != 2 {
+		t.Errorf("%d replays counted, want 2", replays)
+	}
+	if rotations := f.Stats.Rotations.Load(); rotations != 2 {
+		t.Errorf("%d rotations counted, want 2", rotations)
+	}
+}
+
+func TestFreshTimestamp(t *testing.T) {
+	f := NewFilter()
+	now := time.Now()
+
+	for _, fresh := range []time.Time{now, now.Add(-Window + time.Minute), now.Add(Window - time.Minute)} {
+		if !f.FreshTimestamp(fresh.Unix()) {
+			t.Errorf("timestamp %v from now refused", fresh.Sub(now))
+		}
+	}
+	for _, stale := range []time.Time{now.Add(-Window - time.Minute), now.Add(Window + time.Minute)} {
+		if f.FreshTimestamp(stale.Unix()) {
+			t.Errorf("timestamp %v from now accepted", stale.Sub(now))
+		}
+	}
+	if bad := f.Stats.BadTimestamps.Load(); bad != 2 {
+		t.Errorf("%d bad timestamps counted, want 2", bad)
+	}
+}
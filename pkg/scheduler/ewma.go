@@ -0,0 +1,96 @@
+package scheduler
+
+import (
+	"math"
+	"time"
+)
+
+// DefaultHalflife is how long it takes a circuit's recent activity to count
+// half as much, as Tor's CircuitPriorityHalflife
+const DefaultHalflife = 30 * time.Second
+
+// forgetActivity is the activity below which an idle circuit is forgotten
+const forgetActivity = 0.01
+
+// EWMA writes next for the circuit that has sent the fewest cells
+// recently, counting each cell with an exponentially decaying weight. A
+// bulk transfer accumulates activity and yields to circuits that only send
+// now and then, which keeps interactive traffic responsive on a busy link.
+type EWMA struct {
+	Halflife time.Duration
+	circuits map[string]*ewmaCircuit
+	length   int
+}
+
+type ewmaCircuit struct {
+	queue
+	activity float64
+	updated  time.Time
+}
+
+func NewEWMA(halflife time.Duration) *EWMA {
+	return &EWMA{Halflife: halflife, circuits: make(map[string]*ewmaCircuit)}
+}
+
+func (e *EWMA) Name() string { return "ewma" }
+
+func (e *EWMA) Push(circuit string, cell any) {
+	c, exists := e.circuits[circuit]
+	if !exists {
+		c = &ewmaCircuit{queue: queue{circuit: circuit}}
+		e.circuits[circuit] = c
+	}
+	c.cells = append(c.cells, cell)
+	e.length++
+}
+
+// Pop keeps the activity of circuits whose queues run empty, so a bulk
+// circuit that briefly has nothing queued is not treated as idle
+func (e *EWMA) Pop(now time.Time) (any, bool) {
+	var next *ewmaCircuit
+	for circuit, c := range e.circuits {
+		c.decay(now, e.Halflife)
+		if len(c.cells) == 0 {
+			if c.activity < forgetActivity {
+				delete(e.circuits, circuit)
+			}
+			continue
+		}
+		if next == nil || c.activity < next.activity {
+			next = c
+		}
+	}
+	if next == nil {
+		return nil, false
+	}
+
+	next.activity++
+	e.length--
+	return next.pop(), true
+}
+
+func (c *ewmaCircuit) decay(now time.Time, halflife time.Duration) {
+	if !c.updated.IsZero() && halflife > 0 {
+		elapsed := now.Sub(c.updated)
+		c.activity *= math.Exp2(-float64(elapsed) / float64(halflife))
+	}
+	c.updated = now
+}
+
+func (e *EWMA) Queued(circuit string) int {
+	if c, exists := e.circuits[circuit]; exists {
+		return len(c.cells)
+	}
+	return 0
+}
+
+func (e *EWMA) Remove(circuit string) {
+	if c, exists := e.circuits[circuit]; exists {
+		e.length -= len(c.cells)
+		delete(e.circuits, circuit)
+	}
+}
+
+func (e *EWMA) Len() int {
+	return e.length
+}
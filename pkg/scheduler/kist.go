@@ -0,0 +1,52 @@
+package scheduler
+
+import (
+	"net"
+	"time"
+)
+
+// KISTInterval is how long a link waits for the kernel to drain its socket
+// once KIST has written all it allows, as Tor's KISTSchedRunInterval
+const KISTInterval = 10 * time.Millisecond
+
+// kistBufferFactor is how many congestion windows of unsent data KIST lets
+// the kernel hold beyond what it can send right away
+const kistBufferFactor = 1.0
+
+// WriteLimit returns how many bytes can be written to conn without them
+// waiting in the kernel's send buffer for longer than about one round
+// trip, following KIST (Jansen et al., "Never Been KIST"). Keeping the
+// kernel's queue short leaves the backlog in the scheduler, where it can
+// still be reordered. The second result is false when conn is not a TCP
+// socket whose state the kernel reports; such links are written freely.
+func WriteLimit(conn net.Conn) (int, bool) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0, false
+	}
+	info, ok := socketInfo(tcp)
+	if !ok {
+		return 0, false
+	}
+
+	window := info.cwnd * info.mss
+	space := (info.cwnd - info.unacked) * info.mss
+	notSent := info.queued - info.unacked*info.mss
+	if notSent < 0 {
+		notSent = 0
+	}
+
+	limit := space + int(kistBufferFactor*float64(window)) - notSent
+	if limit < 0 {
+		limit = 0
+	}
+	return limit, true
+}
+
+// tcpState is what KIST needs from the kernel about a socket
+type tcpState struct {
+	cwnd    int // Congestion window, in segments
+	mss     int // Bytes per segment
+	unacked int // Segments sent but not acknowledged
+	queued  int // Bytes in the send buffer, sent or not
+}
@@ -0,0 +1,40 @@
+//go:build linux
+
+package scheduler
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// socketInfo reads the socket's TCP_INFO and the bytes in its send queue
+func socketInfo(conn *net.TCPConn) (tcpState, bool) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return tcpState{}, false
+	}
+
+	var info syscall.TCPInfo
+	var queued int32
+	var sysErr syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(info))
+		_, _, sysErr = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+		if sysErr != 0 {
+			return
+		}
+		_, _, sysErr = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCOUTQ, uintptr(unsafe.Pointer(&queued)))
+	})
+	if err != nil || sysErr != 0 {
+		return tcpState{}, false
+	}
+
+	return tcpState{
+		cwnd:    int(info.Snd_cwnd),
+		mss:     int(info.Snd_mss),
+		unacked: int(info.Unacked),
+		queued:  int(queued),
+	}, true
+}
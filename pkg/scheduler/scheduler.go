@@ -0,0 +1,121 @@
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Scheduler orders the cells waiting to be written to one link. Cells of
+// a circuit always leave in the order they were pushed; the scheduler only
+// decides which circuit goes next. Implementations need not be safe for
+// concurrent use.
+type Scheduler interface {
+	Name() string
+	// Push queues a cell for a circuit
+	Push(circuit string, cell any)
+	// Pop returns the next cell to write, false when nothing is queued
+	Pop(now time.Time) (any, bool)
+	// Queued is how many cells a circuit has waiting
+	Queued(circuit string) int
+	// Remove drops a circuit's queued cells
+	Remove(circuit string)
+	// Len is how many cells are queued for all circuits
+	Len() int
+}
+
+var factories = map[string]func() Scheduler{
+	"fifo": func() Scheduler { return NewFIFO() },
+	"ewma": func() Scheduler { return NewEWMA(DefaultHalflife) },
+}
+
+// New creates a scheduler by name
+func New(name string) (Scheduler, error) {
+	factory, exists := factories[strings.ToLower(name)]
+	if !exists {
+		return nil, fmt.Errorf("unknown scheduler %q (supported: %s)", name, strings.Join(Names(), ", "))
+	}
+	return factory(), nil
+}
+
+// Names lists the supported schedulers
+func Names() []string {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// queue is one circuit's cells in arrival order
+type queue struct {
+	circuit string
+	cells   []any
+}
+
+func (q *queue) pop() any {
+	cell := q.cells[0]
+	q.cells[0] = nil
+	q.cells = q.cells[1:]
+	return cell
+}
+
+// FIFO writes cells in the order they arrived, whichever circuit they
+// belong to, as the node did before it had a scheduler
+type FIFO struct {
+	order  []string // Circuit of each queued cell
+	queues map[string]*queue
+}
+
+func NewFIFO() *FIFO {
+	return &FIFO{queues: make(map[string]*queue)}
+}
+
+func (f *FIFO) Name() string { return "fifo" }
+
+func (f *FIFO) Push(circuit string, cell any) {
+	q, exists := f.queues[circuit]
+	if !exists {
+		q = &queue{circuit: circuit}
+		f.queues[circuit] = q
+	}
+	q.cells = append(q.cells, cell)
+	f.order = append(f.order, circuit)
+}
+
+func (f *FIFO) Pop(now time.Time) (any, bool) {
+	for len(f.order) > 0 {
+		circuit := f.order[0]
+		f.order = f.order[1:]
+		if q, exists := f.queues[circuit]; exists {
+			cell := q.pop()
+			if len(q.cells) == 0 {
+				delete(f.queues, circuit)
+			}
+			return cell, true
+		}
+	}
+	return nil, false
+}
+
+func (f *FIFO) Queued(circuit string) int {
+	if q, exists := f.queues[circuit]; exists {
+		return len(q.cells)
+	}
+	return 0
+}
+
+// Remove leaves the circuit's entries in order; Pop skips them
+func (f *FIFO) Remove(circuit string) {
+	delete(f.queues, circuit)
+}
+
+func (f *FIFO) Len() int {
+	total := 0
+	for _, q := range f.queues {
+		total += len(q.cells)
+	}
+	return total
+}
@@ -0,0 +1,186 @@
+package scheduler
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// benchCell remembers when it was queued, counted in cells written
+type benchCell struct {
+	interactive bool
+	queuedAt    int
+}
+
+// benchmarkScheduler keeps a bulk circuit backlogged while interactive
+// circuits send every tenth cell, writing one cell for each queued. It
+// reports how many cells an interactive cell waits behind on average.
+func benchmarkScheduler(b *testing.B, s Scheduler) {
+	const interactive = 16
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		s.Push("bulk", benchCell{})
+	}
+
+	waited, delivered := 0, 0
+	for i := 0; i < b.N; i++ {
+		if i%10 == 0 {
+			s.Push(fmt.Sprint("interactive", i/10%interactive), benchCell{interactive: true, queuedAt: i})
+		} else {
+			s.Push("bulk", benchCell{queuedAt: i})
+		}
+		cell, ok := s.Pop(now.Add(time.Duration(i) * time.Millisecond))
+		if !ok {
+			b.Fatal("nothing queued")
+		}
+		if c := cell.(benchCell); c.interactive {
+			waited += i - c.queuedAt
+			delivered++
+		}
+	}
+	if delivered > 0 {
+		b.ReportMetric(float64(waited)/float64(delivered), "cells-waited")
+	}
+}
+
+func BenchmarkFIFO(b *testing.B) {
+	benchmarkScheduler(b, NewFIFO())
+}
+
+func BenchmarkEWMA(b *testing.B) {
+	benchmarkScheduler(b, NewEWMA(DefaultHalflife))
+}
+
+func TestNew(t *testing.T) {
+	for _, name := range Names() {
+		s, err := New(strings.ToUpper(name))
+		if err != nil || s.Name() != name {
+			t.Errorf("New(%q) = %v, %v", name, s, err)
+		}
+	}
+	if _, err := New("lottery"); err == nil {
+		t.Error("unknown scheduler accepted")
+	}
+}
+
+func TestCircuitsKeepTheirOrder(t *testing.T) {
+	for _, name := range Names() {
+		t.Run(name, func(t *testing.T) {
+			s, _ := New(name)
+			now := time.Now()
+			for i := 0; i < 5; i++ {
+				s.Push("a", fmt.Sprint("a", i))
+				s.Push("b", fmt.Sprint("b", i))
+				s.Push("c", fmt.Sprint("c", i))
+			}
+			if s.Len() != 15 || s.Queued("a") != 5 {
+				t.Fatalf("%d queued, %d for a", s.Len(), s.Queued("a"))
+			}
+
+			s.Remove("c")
+			if s.Len() != 10 || s.Queued("c") != 0 {
+				t.Fatalf("%d queued after removing c, %d for c", s.Len(), s.Queued("c"))
+			}
+
+			next := map[byte]int{}
+			for i := 0; i < 10; i++ {
+				cell, ok := s.Pop(now)
+				if !ok {
+					t.Fatalf("nothing popped with %d queued", s.Len())
+				}
+				got := cell.(string)
+				if want := fmt.Sprint(got[:1], next[got[0]]); got != want {
+					t.Fatalf("popped %s, want %s", got, want)
+				}
+				next[got[0]]++
+			}
+			if _, ok := s.Pop(now); ok || s.Len() != 0 {
+				t.Errorf("%d left after popping everything", s.Len())
+			}
+		})
+	}
+}
+
+func TestFIFOWritesInArrivalOrder(t *testing.T) {
+	s := NewFIFO()
+	for _, cell := range []string{"a0", "b0", "a1", "c0", "b1"} {
+		s.Push(cell[:1], cell)
+	}
+	for _, want := range []string{"a0", "b0", "a1", "c0", "b1"} {
+		if cell, _ := s.Pop(time.Now()); cell != want {
+			t.Fatalf("popped %v, want %s", cell, want)
+		}
+	}
+}
+
+func TestEWMAPrefersQuietCircuits(t *testing.T) {
+	s := NewEWMA(time.Second)
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		s.Push("bulk", "bulk")
+	}
+	for i := 0; i < 10; i++ {
+		s.Pop(now)
+	}
+
+	// The bulk circuit's backlog does not hold up a circuit that has
+	// hardly sent anything
+	s.Push("interactive", "interactive")
+	if cell, _ := s.Pop(now); cell != "interactive" {
+		t.Fatalf("popped %v before the quiet circuit", cell)
+	}
+}
+
+func TestEWMAForgetsActivity(t *testing.T) {
+	s := NewEWMA(time.Second)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		s.Push("early", "early")
+		s.Pop(now)
+	}
+
+	// Ten halflives later the early circuit's activity has decayed below
+	// one fresh cell of another circuit
+	later := now.Add(10 * time.Second)
+	s.Push("early", "early")
+	s.Push("late", "late")
+	s.Pop(later)
+	s.Push("late", "late")
+	if cell, _ := s.Pop(later); cell != "early" {
+		t.Fatalf("popped %v, want the circuit whose activity decayed", cell)
+	}
+
+	// Once idle long enough it is forgotten altogether
+	s.Pop(later)
+	s.Pop(later.Add(time.Minute))
+	if _, remembered := s.circuits["early"]; remembered {
+		t.Error("idle circuit still tracked")
+	}
+}
+
+func TestWriteLimitNeedsTCP(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	if _, limited := WriteLimit(local); limited {
+		t.Error("limited a link that is not a TCP socket")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	limit, limited := WriteLimit(conn)
+	if runtime.GOOS == "linux" && (!limited || limit <= 0) {
+		t.Errorf("idle TCP socket limited to %d bytes, limited %v", limit, limited)
+	}
+}
@@ -0,0 +1,374 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"onion-network/pkg/circuit"
+	"onion-network/pkg/crypto"
+	"onion-network/pkg/message"
+)
+
+const (
+	// DefaultIntroPoints is how many introduction points a service keeps
+	DefaultIntroPoints = 3
+	// maintainInterval is how often lost introduction points are replaced
+	maintainInterval = 30 * time.Second
+	// republishInterval keeps the descriptor well inside its lifetime
+	republishInterval = 15 * time.Minute
+	setupTimeout      = 30 * time.Second
+)
+
+// OnionService makes a local TCP service reachable at an onion address
+// without revealing where it runs. Clients meet it at rendezvous points
+// after introducing themselves through the service's introduction points.
+type OnionService struct {
+	Address        string
+	PrivateKey     *rsa.PrivateKey
+	Target         string // Local host:port streams are forwarded to
+	CircuitManager *circuit.CircuitManager
+	NumIntroPoints int
+
+	// AuthorizedClients, if set, are the only clients' keys that can read
+	// the introduction points or be introduced
+	AuthorizedClients []*rsa.PublicKey
+
+	introCircuits map[string]*circuit.Circuit // By introduction point node ID
+	introNodes    map[string]circuit.NodeInfo
+	published     time.Time
+	mutex         sync.Mutex
+}
+
+func NewOnionService(directoryURL string, privateKey *rsa.PrivateKey, target string) *OnionService {
+	return &OnionService{
+		Address:        crypto.OnionAddress(&privateKey.PublicKey),
+		PrivateKey:     privateKey,
+		Target:         target,
+		CircuitManager: circuit.NewCircuitManager(directoryURL),
+		NumIntroPoints: DefaultIntroPoints,
+		introCircuits:  make(map[string]*circuit.Circuit),
+		introNodes:     make(map[string]circuit.NodeInfo),
+	}
+}
+
+// Start sets up introduction points, publishes the descriptor and keeps
+// both fresh. It only returns if the service cannot get going at all.
+func (s *OnionService) Start() error {
+	fmt.Printf("🧅 Onion service %s forwarding to %s\n", s.Address, s.Target)
+
+	if err := s.maintain(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(maintainInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.maintain(); err != nil {
+			fmt.Printf("🧅 Service maintenance failed: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// maintain replaces closed introduction points and republishes the
+// descriptor when they change or it is due
+func (s *OnionService) maintain() error {
+	changed := false
+
+	s.mutex.Lock()
+	for id, c := range s.introCircuits {
+		if c.IsClosed() {
+			fmt.Printf("🧅 Lost introduction point %s\n", id)
+			delete(s.introCircuits, id)
+			delete(s.introNodes, id)
+			changed = true
+		}
+	}
+	missing := s.NumIntroPoints - len(s.introCircuits)
+	s.mutex.Unlock()
+
+	if missing > 0 {
+		added, err := s.establishIntroPoints(missing)
+		if added > 0 {
+			changed = true
+		}
+		if err != nil && added == 0 && s.introCount() == 0 {
+			return err
+		}
+	}
+
+	s.mutex.Lock()
+	due := changed || time.Since(s.published) > republishInterval
+	s.mutex.Unlock()
+	if due {
+		return s.publish()
+	}
+	return nil
+}
+
+func (s *OnionService) introCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.introCircuits)
+}
+
+// establishIntroPoints builds circuits to up to count new nodes and asks
+// each to act as an introduction point
+func (s *OnionService) establishIntroPoints(count int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+	defer cancel()
+
+	candidates, err := s.CircuitManager.TargetNodes(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	added := 0
+	var lastErr error
+	for _, node := range candidates {
+		if added == count {
+			break
+		}
+
+		s.mutex.Lock()
+		_, used := s.introCircuits[node.ID]
+		s.mutex.Unlock()
+		if used {
+			continue
+		}
+
+		c, err := s.establishIntro(ctx, node)
+		if err != nil {
+			fmt.Printf("🧅 Introduction point %s failed: %v\n", node.ID, err)
+			lastErr = err
+			continue
+		}
+
+		s.mutex.Lock()
+		s.introCircuits[node.ID] = c
+		s.introNodes[node.ID] = node
+		s.mutex.Unlock()
+		added++
+
+		fmt.Printf("🚪 Introduction point established at %s\n", node.ID)
+		go s.serveIntro(c)
+	}
+
+	if added == 0 && lastErr == nil {
+		lastErr = fmt.Errorf("no nodes available as introduction points")
+	}
+	return added, lastErr
+}
+
+func (s *OnionService) establishIntro(ctx context.Context, node circuit.NodeInfo) (*circuit.Circuit, error) {
+	c, err := s.CircuitManager.CreateCircuitTo(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+
+	req := message.EstablishIntro{PublicKey: &s.PrivateKey.PublicKey, Timestamp: time.Now().Unix()}
+	if req.Signature, err = crypto.Sign(s.PrivateKey, req.SignedData()); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	data, err := json.Marshal(&req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := c.SendControl(message.RelayEstablishIntro, data); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if _, err := c.WaitControl(ctx, message.RelayIntroEstablished); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// serveIntro handles introductions arriving on one introduction circuit
+func (s *OnionService) serveIntro(c *circuit.Circuit) {
+	for {
+		select {
+		case cell := <-c.Control():
+			if cell.Command == message.RelayIntroduce2 {
+				go s.handleIntroduce(cell.Data)
+			}
+		case <-c.Done():
+			return
+		}
+	}
+}
+
+// handleIntroduce meets a client at the rendezvous point named in its
+// introduction and serves the streams it opens there
+func (s *OnionService) handleIntroduce(data []byte) {
+	var req message.Introduce1
+	if err := json.Unmarshal(data, &req); err != nil || req.ServiceAddress != s.Address {
+		fmt.Printf("🧅 Ignoring invalid introduction\n")
+		return
+	}
+
+	decrypted, err := crypto.DecryptForKey(req.Encrypted, s.PrivateKey)
+	if err != nil {
+		fmt.Printf("🧅 Failed to decrypt introduction: %v\n", err)
+		return
+	}
+
+	var intro message.IntroduceData
+	if err := json.Unmarshal(decrypted, &intro); err != nil || len(intro.Cookie) != message.CookieSize {
+		fmt.Printf("🧅 Ignoring invalid introduction\n")
+		return
+	}
+
+	if !s.authorized(&intro) {
+		fmt.Printf("🔒 Rejected introduction from unauthorized client\n")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+	defer cancel()
+
+	c, err := s.CircuitManager.CreateCircuitTo(ctx, circuit.NodeInfoFromService(intro.RendezvousPoint))
+	if err != nil {
+		fmt.Printf("🧅 Failed to reach rendezvous point %s: %v\n", intro.RendezvousPoint.ID, err)
+		return
+	}
+
+	handshake, err := circuit.RendezvousHandshake(intro.Key)
+	if err != nil {
+		c.Close()
+		return
+	}
+	rendezvous, err := json.Marshal(&message.Rendezvous1{Cookie: intro.Cookie, Handshake: handshake})
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	// The layer goes on first so the client's first cell, which may follow
+	// RENDEZVOUS1 closely, finds it; control cells go beneath it
+	c.SetStreamHandler(s.handleStream)
+	if err := c.AddLayer(intro.Key, true); err != nil {
+		c.Close()
+		return
+	}
+	if err := c.SendControl(message.RelayRendezvous1, rendezvous); err != nil {
+		c.Close()
+		return
+	}
+
+	fmt.Printf("🤝 Met client at rendezvous point %s (circuit %s)\n", intro.RendezvousPoint.ID, c.ID)
+}
+
+// authorized checks an introduction's client key and signature when the
+// service restricts who may connect
+func (s *OnionService) authorized(intro *message.IntroduceData) bool {
+	if len(s.AuthorizedClients) == 0 {
+		return true
+	}
+	if intro.ClientKey == nil {
+		return false
+	}
+
+	id := crypto.KeyID(intro.ClientKey)
+	for _, client := range s.AuthorizedClients {
+		if crypto.KeyID(client) == id {
+			return crypto.Verify(intro.ClientKey, message.IntroduceAuthData(s.Address, intro.Cookie), intro.ClientSignature) == nil
+		}
+	}
+	return false
+}
+
+// LoadAuthorizedClients reads every "*.pub" key in dir as an authorized
+// client
+func LoadAuthorizedClients(dir string) ([]*rsa.PublicKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pub"))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*rsa.PublicKey
+	for _, path := range paths {
+		key, err := crypto.LoadPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// handleStream connects a client stream to the local target
+func (s *OnionService) handleStream(stream *circuit.Stream) {
+	conn, err := net.DialTimeout("tcp", s.Target, circuit.DialTimeout)
+	if err != nil {
+		fmt.Printf("🧅 Failed to connect to %s: %v\n", s.Target, err)
+		stream.Reject(message.EndReasonConnectRefused)
+		return
+	}
+
+	if err := stream.Accept(); err != nil {
+		conn.Close()
+		stream.Close()
+		return
+	}
+	circuit.Splice(conn, stream)
+}
+
+// publish signs a descriptor listing the current introduction points and
+// uploads it to the directory
+func (s *OnionService) publish() error {
+	s.mutex.Lock()
+	desc := message.ServiceDescriptor{
+		Address:   s.Address,
+		PublicKey: &s.PrivateKey.PublicKey,
+		Published: time.Now(),
+	}
+	for _, node := range s.introNodes {
+		desc.IntroPoints = append(desc.IntroPoints, node.ServiceNode())
+	}
+	s.mutex.Unlock()
+
+	count := len(desc.IntroPoints)
+	if len(s.AuthorizedClients) > 0 {
+		if err := desc.EncryptIntroPoints(s.AuthorizedClients); err != nil {
+			return err
+		}
+	}
+	if err := desc.Sign(s.PrivateKey); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&desc)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(s.CircuitManager.DirectoryURL+"/hs/publish", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to publish descriptor: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("directory rejected descriptor: %s", resp.Status)
+	}
+
+	s.mutex.Lock()
+	s.published = desc.Published
+	s.mutex.Unlock()
+
+	fmt.Printf("📜 Published descriptor with %d introduction points\n", count)
+	return nil
+}
@@ -0,0 +1,102 @@
+package transport
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// delayQueue bounds the writes a delayed link holds; a writer blocks once
+// it is full, as it would on a full socket buffer
+const delayQueue = 256
+
+// Delay simulates a slow link by holding every write to conn for delay
+// before sending it. Writes keep their order and do not block the writer,
+// so the link gains latency without losing throughput. It is meant for
+// testing congestion control on a single machine.
+func Delay(conn net.Conn, delay time.Duration) net.Conn {
+	if delay <= 0 {
+		return conn
+	}
+	d := &delayedConn{
+		Conn:  conn,
+		delay: delay,
+		queue: make(chan delayedWrite, delayQueue),
+		done:  make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+type delayedConn struct {
+	net.Conn
+	delay     time.Duration
+	queue     chan delayedWrite
+	done      chan struct{}
+	closeOnce sync.Once
+	mutex     sync.Mutex
+	err       error
+}
+
+type delayedWrite struct {
+	due  time.Time
+	data []byte
+}
+
+func (d *delayedConn) Write(b []byte) (int, error) {
+	d.mutex.Lock()
+	err := d.err
+	d.mutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	write := delayedWrite{due: time.Now().Add(d.delay), data: append([]byte(nil), b...)}
+	select {
+	case d.queue <- write:
+		return len(b), nil
+	case <-d.done:
+		return 0, net.ErrClosed
+	}
+}
+
+// Close sends what is already queued, once it is due, then closes the link
+func (d *delayedConn) Close() error {
+	d.closeOnce.Do(func() { close(d.done) })
+	return nil
+}
+
+func (d *delayedConn) run() {
+	defer d.Conn.Close()
+	defer d.closeOnce.Do(func() { close(d.done) }) // Unblock writers after a failure
+	for {
+		select {
+		case write := <-d.queue:
+			if !d.send(write) {
+				return
+			}
+		case <-d.done:
+			for {
+				select {
+				case write := <-d.queue:
+					if !d.send(write) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (d *delayedConn) send(write delayedWrite) bool {
+	time.Sleep(time.Until(write.due))
+	if _, err := d.Conn.Write(write.data); err != nil {
+		d.mutex.Lock()
+		d.err = err
+		d.mutex.Unlock()
+		return false
+	}
+	return true
+}
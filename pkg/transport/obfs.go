@@ -0,0 +1,293 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	obfsCertSize     = 32
+	obfsMarkSize     = 16
+	obfsMACSize      = 16
+	obfsMaxPadding   = 256
+	obfsMaxFrame     = 1400 // Data per frame, so frames fit common MTUs
+	obfsFramePad     = 64   // Up to this much random padding per frame
+	handshakeTimeout = 15 * time.Second
+)
+
+var errObfsHandshake = errors.New("obfs: handshake failed")
+
+// Obfs is an obfs4-like transport. Both sides open with an ephemeral X25519
+// key followed by random-length padding, located by a mark only holders of
+// the bridge's cert can compute, so a handshake has no fixed length or
+// content. Afterwards every frame is AES-GCM sealed with a masked length
+// and random padding. Unlike obfs4 the keys are not Elligator-encoded.
+type Obfs struct {
+	cert []byte
+}
+
+// NewObfs returns an obfs transport with a fresh server cert
+func NewObfs() (*Obfs, error) {
+	cert := make([]byte, obfsCertSize)
+	if _, err := rand.Read(cert); err != nil {
+		return nil, err
+	}
+	return &Obfs{cert: cert}, nil
+}
+
+func (o *Obfs) Name() string { return "obfs" }
+
+func (o *Obfs) Args() map[string]string {
+	return map[string]string{"cert": base64.RawStdEncoding.EncodeToString(o.cert)}
+}
+
+func (o *Obfs) Client(conn net.Conn, args map[string]string) (net.Conn, error) {
+	cert, err := base64.RawStdEncoding.DecodeString(args["cert"])
+	if err != nil || len(cert) != obfsCertSize {
+		return nil, errors.New("obfs: bridge line needs a valid cert argument")
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeHello(conn, cert, key.PublicKey().Bytes()); err != nil {
+		return nil, err
+	}
+
+	serverPub, err := readHello(conn, cert)
+	if err != nil {
+		return nil, err
+	}
+	return newObfsConn(conn, cert, key, key.PublicKey().Bytes(), serverPub, true)
+}
+
+func (o *Obfs) Server(conn net.Conn) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	clientPub, err := readHello(conn, o.cert)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeHello(conn, o.cert, key.PublicKey().Bytes()); err != nil {
+		return nil, err
+	}
+	return newObfsConn(conn, o.cert, key, clientPub, key.PublicKey().Bytes(), false)
+}
+
+func obfsHMAC(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+// writeHello sends pub || padding || mark || mac
+func writeHello(conn net.Conn, cert, pub []byte) error {
+	padLen, err := rand.Int(rand.Reader, big.NewInt(obfsMaxPadding))
+	if err != nil {
+		return err
+	}
+	padding := make([]byte, padLen.Int64())
+	if _, err := rand.Read(padding); err != nil {
+		return err
+	}
+
+	hello := append(append([]byte{}, pub...), padding...)
+	hello = append(hello, obfsHMAC(cert, pub)[:obfsMarkSize]...)
+	hello = append(hello, obfsHMAC(cert, hello)[:obfsMACSize]...)
+	_, err = conn.Write(hello)
+	return err
+}
+
+// readHello scans for the mark after the peer's key and checks the MAC, so
+// a prober without the cert gets no response it can recognize
+func readHello(conn net.Conn, cert []byte) ([]byte, error) {
+	pub := make([]byte, 32)
+	if _, err := io.ReadFull(conn, pub); err != nil {
+		return nil, err
+	}
+	mark := obfsHMAC(cert, pub)[:obfsMarkSize]
+
+	hello := append([]byte{}, pub...)
+	one := make([]byte, 1)
+	for !bytes.HasSuffix(hello, mark) {
+		if len(hello) >= len(pub)+obfsMaxPadding+obfsMarkSize {
+			return nil, errObfsHandshake
+		}
+		if _, err := io.ReadFull(conn, one); err != nil {
+			return nil, err
+		}
+		hello = append(hello, one[0])
+	}
+
+	mac := make([]byte, obfsMACSize)
+	if _, err := io.ReadFull(conn, mac); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, obfsHMAC(cert, hello)[:obfsMACSize]) {
+		return nil, errObfsHandshake
+	}
+	return pub, nil
+}
+
+// obfsDirection is the framing state for one direction of a link
+type obfsDirection struct {
+	gcm     cipher.AEAD
+	mask    cipher.Stream
+	counter uint64
+}
+
+func newObfsDirection(seed []byte, label string) (*obfsDirection, error) {
+	block, err := aes.NewCipher(obfsHMAC(seed, []byte(label+" data")))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	maskBlock, err := aes.NewCipher(obfsHMAC(seed, []byte(label+" length")))
+	if err != nil {
+		return nil, err
+	}
+	return &obfsDirection{gcm: gcm, mask: cipher.NewCTR(maskBlock, make([]byte, aes.BlockSize))}, nil
+}
+
+func (d *obfsDirection) nonce() []byte {
+	nonce := make([]byte, d.gcm.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], d.counter)
+	d.counter++
+	return nonce
+}
+
+type obfsConn struct {
+	net.Conn
+	send       *obfsDirection
+	recv       *obfsDirection
+	writeMutex sync.Mutex
+	readMutex  sync.Mutex
+	pending    []byte
+}
+
+func newObfsConn(conn net.Conn, cert []byte, key *ecdh.PrivateKey, clientPub, serverPub []byte, isClient bool) (*obfsConn, error) {
+	peerPub := serverPub
+	if !isClient {
+		peerPub = clientPub
+	}
+	peer, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, errObfsHandshake
+	}
+	shared, err := key.ECDH(peer)
+	if err != nil {
+		return nil, errObfsHandshake
+	}
+
+	seed := obfsHMAC(cert, []byte("obfs keys"), shared, clientPub, serverPub)
+	upstream, err := newObfsDirection(seed, "client")
+	if err != nil {
+		return nil, err
+	}
+	downstream, err := newObfsDirection(seed, "server")
+	if err != nil {
+		return nil, err
+	}
+
+	if isClient {
+		return &obfsConn{Conn: conn, send: upstream, recv: downstream}, nil
+	}
+	return &obfsConn{Conn: conn, send: downstream, recv: upstream}, nil
+}
+
+// Write sends p as frames of [masked length][sealed data length, data, padding]
+func (c *obfsConn) Write(p []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > obfsMaxFrame {
+			chunk = chunk[:obfsMaxFrame]
+		}
+
+		padLen, err := rand.Int(rand.Reader, big.NewInt(obfsFramePad))
+		if err != nil {
+			return written, err
+		}
+		plaintext := make([]byte, 2+len(chunk)+int(padLen.Int64()))
+		binary.BigEndian.PutUint16(plaintext, uint16(len(chunk)))
+		copy(plaintext[2:], chunk)
+
+		sealed := c.send.gcm.Seal(nil, c.send.nonce(), plaintext, nil)
+		frame := make([]byte, 2+len(sealed))
+		binary.BigEndian.PutUint16(frame, uint16(len(sealed)))
+		c.send.mask.XORKeyStream(frame[:2], frame[:2])
+		copy(frame[2:], sealed)
+
+		if _, err := c.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *obfsConn) Read(p []byte) (int, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	for len(c.pending) == 0 {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return 0, err
+		}
+		c.recv.mask.XORKeyStream(header, header)
+
+		sealed := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+			return 0, err
+		}
+
+		plaintext, err := c.recv.gcm.Open(nil, c.recv.nonce(), sealed, nil)
+		if err != nil || len(plaintext) < 2 {
+			return 0, fmt.Errorf("obfs: corrupt frame")
+		}
+		dataLen := int(binary.BigEndian.Uint16(plaintext))
+		if dataLen > len(plaintext)-2 {
+			return 0, fmt.Errorf("obfs: corrupt frame")
+		}
+		c.pending = plaintext[2 : 2+dataLen]
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
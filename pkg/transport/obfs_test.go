@@ -0,0 +1,160 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// handshake connects a client and a server over conns, returning both ends
+func handshake(t *testing.T, server *Obfs, args map[string]string, clientConn, serverConn net.Conn) (net.Conn, net.Conn, error) {
+	t.Helper()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, err := server.Server(serverConn)
+		accepted <- result{conn, err}
+	}()
+
+	client, err := server.Client(clientConn, args)
+	if err != nil {
+		serverConn.Close()
+		<-accepted
+		return nil, nil, err
+	}
+	r := <-accepted
+	return client, r.conn, r.err
+}
+
+func TestObfsRoundTrip(t *testing.T) {
+	server, err := NewObfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	// The observer sees only what crosses the link
+	var wire bytes.Buffer
+	observed := &recordingConn{Conn: local, w: &wire}
+	client, served, err := handshake(t, server, server.Args(), observed, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Larger than a frame, so it is split and reassembled
+	sent := bytes.Repeat([]byte("RESPONSE: onion "), 400)
+	go client.Write(sent)
+	got := make([]byte, len(sent))
+	if _, err := io.ReadFull(served, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, sent) {
+		t.Fatal("server read different data than the client wrote")
+	}
+
+	go served.Write([]byte("reply"))
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "reply" {
+		t.Fatalf("client read %q", reply)
+	}
+
+	if bytes.Contains(wire.Bytes(), []byte("RESPONSE:")) {
+		t.Error("plaintext visible on the link")
+	}
+}
+
+func TestObfsProberWithoutCertGetsNothing(t *testing.T) {
+	server, err := NewObfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prober, err := NewObfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		_, err := server.Server(remote)
+		remote.Close()
+		served <- err
+	}()
+	// A hello shorter than the server's scan leaves it waiting for more,
+	// so the prober gives up
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		local.Close()
+	}()
+
+	if _, err := prober.Client(local, prober.Args()); err == nil {
+		t.Error("handshake with the wrong cert succeeded")
+	}
+	if err := <-served; err == nil {
+		t.Error("server accepted a hello marked with the wrong cert")
+	}
+}
+
+func TestObfsTamperedFrameFails(t *testing.T) {
+	server, err := NewObfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn, clientEnd := net.Pipe()
+	serverEnd, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	// A middlebox flipping a bit once the handshake is done
+	var tamper atomic.Bool
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := clientEnd.Read(buf)
+			if err != nil {
+				serverEnd.Close()
+				return
+			}
+			if tamper.Load() {
+				buf[n-1] ^= 1
+			}
+			if _, err := serverEnd.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	go io.Copy(clientEnd, serverEnd)
+
+	client, served, err := handshake(t, server, server.Args(), clientConn, serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamper.Store(true)
+	go client.Write([]byte("data"))
+	if _, err := served.Read(make([]byte, 4)); err == nil {
+		t.Error("tampered frame accepted")
+	}
+}
+
+type recordingConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.w.Write(p)
+	return c.Conn.Write(p)
+}
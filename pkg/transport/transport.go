@@ -0,0 +1,76 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Transport wraps a node link so its traffic does not look like our link
+// protocol. The client side dials with the arguments a bridge advertises;
+// the server side wraps every connection accepted by the node.
+type Transport interface {
+	Name() string
+	// Client performs the client half of the handshake on conn
+	Client(conn net.Conn, args map[string]string) (net.Conn, error)
+	// Server performs the server half of the handshake on conn
+	Server(conn net.Conn) (net.Conn, error)
+	// Args are what clients need to reach this server, published in its
+	// bridge line
+	Args() map[string]string
+}
+
+var factories = map[string]func() (Transport, error){
+	"plain": func() (Transport, error) { return Plain{}, nil },
+	"obfs":  func() (Transport, error) { return NewObfs() },
+}
+
+// New creates a transport by name, with fresh server secrets if it has any
+func New(name string) (Transport, error) {
+	factory, exists := factories[strings.ToLower(name)]
+	if !exists {
+		return nil, fmt.Errorf("unknown transport %q (supported: %s)", name, strings.Join(Names(), ", "))
+	}
+	return factory()
+}
+
+// Names lists the supported transports
+func Names() []string {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Supported reports whether this build can speak the named transport
+func Supported(name string) bool {
+	_, exists := factories[strings.ToLower(name)]
+	return name == "" || exists
+}
+
+// Dial wraps an outbound connection in the named transport. An empty name
+// means plain.
+func Dial(conn net.Conn, name string, args map[string]string) (net.Conn, error) {
+	if name == "" {
+		return conn, nil
+	}
+	t, err := New(name)
+	if err != nil {
+		return nil, err
+	}
+	return t.Client(conn, args)
+}
+
+// Plain is the unobfuscated link protocol
+type Plain struct{}
+
+func (Plain) Name() string { return "plain" }
+
+func (Plain) Client(conn net.Conn, args map[string]string) (net.Conn, error) { return conn, nil }
+
+func (Plain) Server(conn net.Conn) (net.Conn, error) { return conn, nil }
+
+func (Plain) Args() map[string]string { return nil }
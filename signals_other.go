@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "onion-network/pkg/node"
+
+// watchHibernation does nothing where there is no SIGUSR1
+func watchHibernation(n *node.Node) {}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"onion-network/pkg/node"
+)
+
+// watchHibernation toggles the node's hibernation on SIGUSR1
+func watchHibernation(n *node.Node) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			if n.IsHibernating() {
+				n.Wake()
+			} else {
+				n.Hibernate()
+			}
+		}
+	}()
+}